@@ -0,0 +1,318 @@
+package cluster
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// tombstoneTTL is how long a removed channel, or a channel of a node that left, is remembered
+// so that older gossip does not bring it back.
+const tombstoneTTL = time.Minute
+
+// Channel is a channel held by a node of the cluster.
+type Channel struct {
+	ID        string
+	Node      string
+	ServerURL string
+	Connected bool
+	// ResumeHash is the SHA-256 of the token with which the client may move the channel to another node,
+	// set while the node is draining. Owner is the identity of the client certificate that issued the channel.
+	ResumeHash string
+	Owner      string
+}
+
+// channelEntry is the gossiped state of a channel. Only the node that holds a channel changes it,
+// and the entry with the highest version wins.
+type channelEntry struct {
+	ID        string `json:"id"`
+	Node      string `json:"node"`
+	Connected bool   `json:"connected,omitempty"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	Resume    string `json:"resume,omitempty"`
+	Owner     string `json:"owner,omitempty"`
+	Version   uint64 `json:"version"`
+
+	updatedAt time.Time
+}
+
+// pushPullState is the whole map of a node, exchanged on memberlist's push/pull.
+type pushPullState struct {
+	Node        string          `json:"node"`
+	Incarnation uint64          `json:"incarnation"`
+	Channels    []*channelEntry `json:"channels"`
+}
+
+// channelBroadcast is a change of a channel queued for gossip. A newer change of the same channel replaces it.
+type channelBroadcast struct {
+	id  string
+	msg []byte
+}
+
+var _ memberlist.NamedBroadcast = (*channelBroadcast)(nil)
+
+func (b *channelBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	o, ok := other.(*channelBroadcast)
+	return ok && o.id == b.id
+}
+
+func (b *channelBroadcast) Name() string    { return b.id }
+func (b *channelBroadcast) Message() []byte { return b.msg }
+func (b *channelBroadcast) Finished()       {}
+
+// channelDirectory keeps an eventually consistent map of the channels of every node. Changes of the local
+// channels are broadcast, and the whole map is exchanged on memberlist's push/pull to repair missed broadcasts.
+type channelDirectory struct {
+	self      string
+	serverURL string
+	queue     *memberlist.TransmitLimitedQueue
+	// incarnation tells the runs of a node apart. memberlist keeps its own incarnation numbers to itself.
+	incarnation uint64
+
+	mu           sync.RWMutex
+	channels     map[string]*channelEntry
+	nodes        map[string]string // alive node name -> server URL
+	synced       map[string]time.Time
+	incarnations map[string]uint64
+	lastVersion  uint64
+}
+
+var (
+	_ memberlist.Delegate      = (*channelDirectory)(nil)
+	_ memberlist.EventDelegate = (*channelDirectory)(nil)
+)
+
+func newChannelDirectory(self, serverURL string, retransmitMult int) *channelDirectory {
+	d := &channelDirectory{
+		self:         self,
+		serverURL:    serverURL,
+		incarnation:  uint64(time.Now().UnixNano()), //nolint: gosec
+		channels:     make(map[string]*channelEntry),
+		nodes:        make(map[string]string),
+		synced:       make(map[string]time.Time),
+		incarnations: make(map[string]uint64),
+	}
+	d.queue = &memberlist.TransmitLimitedQueue{NumNodes: d.numNodes, RetransmitMult: retransmitMult}
+	return d
+}
+
+func (d *channelDirectory) numNodes() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return max(len(d.nodes), 1)
+}
+
+// nextVersion returns a version higher than every version this node has used. It starts from the clock,
+// so that a restarted node still supersedes what it gossiped before. mu must be held.
+func (d *channelDirectory) nextVersion() uint64 {
+	v := uint64(time.Now().UnixNano()) //nolint: gosec
+	if v <= d.lastVersion {
+		v = d.lastVersion + 1
+	}
+	d.lastVersion = v
+	return v
+}
+
+// set records a change of a local channel and broadcasts it.
+func (d *channelDirectory) set(id string, connected, deleted bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.publish(&channelEntry{ID: id, Node: d.self, Connected: connected, Deleted: deleted, Version: d.nextVersion()})
+}
+
+// migrate offers a connected local channel to the client that presents the resume token of resumeHash.
+func (d *channelDirectory) migrate(id, resumeHash, owner string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.publish(&channelEntry{ID: id, Node: d.self, Connected: true, Resume: resumeHash, Owner: owner, Version: d.nextVersion()})
+}
+
+// publish stores an entry of a local channel and queues it for broadcast. mu must be held.
+func (d *channelDirectory) publish(e *channelEntry) {
+	e.updatedAt = time.Now()
+	d.channels[e.ID] = e
+	msg, err := json.Marshal([]*channelEntry{e})
+	if err != nil {
+		return
+	}
+	d.queue.QueueBroadcast(&channelBroadcast{id: e.ID, msg: msg})
+}
+
+// merge applies the entries gossiped by other nodes.
+func (d *channelDirectory) merge(entries []*channelEntry) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, e := range entries {
+		cur, ok := d.channels[e.ID]
+		if ok && cur.Version >= e.Version {
+			continue
+		}
+		if e.Node == d.self {
+			// Gossip about this node from before it restarted, or about a channel it no longer holds.
+			// Supersede it so that the other nodes stop routing to stale channels.
+			d.lastVersion = max(d.lastVersion, e.Version)
+			if ok && cur.Node == d.self {
+				again := *cur
+				again.Version = d.nextVersion()
+				d.publish(&again)
+			} else {
+				d.publish(&channelEntry{ID: e.ID, Node: d.self, Deleted: true, Version: d.nextVersion()})
+			}
+			continue
+		}
+		e.updatedAt = now
+		d.channels[e.ID] = e
+	}
+}
+
+// purge forgets tombstones and the channels of nodes that have left once they are old enough. mu must be held.
+func (d *channelDirectory) purge() {
+	for id, e := range d.channels {
+		if time.Since(e.updatedAt) < tombstoneTTL {
+			continue
+		}
+		if _, alive := d.nodes[e.Node]; e.Deleted || (!alive && e.Node != d.self) {
+			delete(d.channels, id)
+		}
+	}
+}
+
+// peerChannels returns the channels held by the other alive nodes.
+func (d *channelDirectory) peerChannels() []Channel {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	channels := make([]Channel, 0, len(d.channels))
+	for _, e := range d.channels {
+		if c, ok := d.peerChannelLocked(e); ok {
+			channels = append(channels, c)
+		}
+	}
+	return channels
+}
+
+// peerChannel returns the channel id when another alive node holds it.
+func (d *channelDirectory) peerChannel(id string) (Channel, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	e, ok := d.channels[id]
+	if !ok {
+		return Channel{}, false
+	}
+	return d.peerChannelLocked(e)
+}
+
+func (d *channelDirectory) peerChannelLocked(e *channelEntry) (Channel, bool) {
+	if e.Deleted || e.Node == d.self {
+		return Channel{}, false
+	}
+	serverURL, alive := d.nodes[e.Node]
+	if !alive || serverURL == "" {
+		return Channel{}, false
+	}
+	return Channel{
+		ID:         e.ID,
+		Node:       e.Node,
+		ServerURL:  serverURL,
+		Connected:  e.Connected,
+		ResumeHash: e.Resume,
+		Owner:      e.Owner,
+	}, true
+}
+
+// nodeChannels counts the channels of each node, and how many of them have a client connected.
+func (d *channelDirectory) nodeChannels() (channels, connected map[string]int) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	channels, connected = make(map[string]int), make(map[string]int)
+	for _, e := range d.channels {
+		if e.Deleted {
+			continue
+		}
+		channels[e.Node]++
+		if e.Connected {
+			connected[e.Node]++
+		}
+	}
+	return channels, connected
+}
+
+// lastSync returns when this node last exchanged the whole map with node, and the incarnation node sent.
+func (d *channelDirectory) lastSync(node string) (time.Time, uint64) {
+	if node == d.self {
+		return time.Time{}, d.incarnation
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.synced[node], d.incarnations[node]
+}
+
+func (d *channelDirectory) NodeMeta(limit int) []byte {
+	if len(d.serverURL) > limit {
+		slog.Warn("The server URL is too long to be shared with the cluster", slog.String("server-url", d.serverURL))
+		return nil
+	}
+	return []byte(d.serverURL)
+}
+
+func (d *channelDirectory) NotifyMsg(buf []byte) {
+	var entries []*channelEntry
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		slog.Debug("Ignoring an invalid channel message", slog.String("error", err.Error()))
+		return
+	}
+	d.merge(entries)
+}
+
+func (d *channelDirectory) GetBroadcasts(overhead, limit int) [][]byte {
+	return d.queue.GetBroadcasts(overhead, limit)
+}
+
+func (d *channelDirectory) LocalState(bool) []byte {
+	d.mu.Lock()
+	d.purge()
+	state := pushPullState{Node: d.self, Incarnation: d.incarnation, Channels: make([]*channelEntry, 0, len(d.channels))}
+	for _, e := range d.channels {
+		state.Channels = append(state.Channels, e)
+	}
+	buf, err := json.Marshal(&state)
+	d.mu.Unlock()
+	if err != nil {
+		return nil
+	}
+	return buf
+}
+
+func (d *channelDirectory) MergeRemoteState(buf []byte, _ bool) {
+	var state pushPullState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		slog.Debug("Ignoring an invalid channel state", slog.String("error", err.Error()))
+		return
+	}
+	d.merge(state.Channels)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.synced[state.Node] = time.Now()
+	d.incarnations[state.Node] = state.Incarnation
+}
+
+func (d *channelDirectory) NotifyJoin(node *memberlist.Node) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nodes[node.Name] = string(node.Meta)
+}
+
+func (d *channelDirectory) NotifyUpdate(node *memberlist.Node) {
+	d.NotifyJoin(node)
+}
+
+// NotifyLeave keeps the channels of the node, hidden until it comes back or they are purged,
+// since a node that was only unreachable still holds them.
+func (d *channelDirectory) NotifyLeave(node *memberlist.Node) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.nodes, node.Name)
+}
@@ -0,0 +1,61 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelDirectory(t *testing.T) {
+	a := newChannelDirectory("a", "http://10.0.0.1:8080", 4)
+	b := newChannelDirectory("b", "http://10.0.0.2:8080", 4)
+	for _, d := range []*channelDirectory{a, b} {
+		d.NotifyJoin(&memberlist.Node{Name: "a", Meta: a.NodeMeta(512)})
+		d.NotifyJoin(&memberlist.Node{Name: "b", Meta: b.NodeMeta(512)})
+	}
+	// gossip delivers the broadcasts of from to to.
+	gossip := func(from, to *channelDirectory) {
+		for _, msg := range from.GetBroadcasts(0, 1<<20) {
+			to.NotifyMsg(msg)
+		}
+	}
+
+	a.set("ch1", false, false)
+	a.set("ch1", true, false)
+	gossip(a, b)
+	c, ok := b.peerChannel("ch1")
+	require.True(t, ok)
+	assert.Equal(t, Channel{ID: "ch1", Node: "a", ServerURL: "http://10.0.0.1:8080", Connected: true}, c)
+	_, ok = a.peerChannel("ch1")
+	assert.False(t, ok, "A node does not report its own channels as peer channels.")
+
+	// An older state never overwrites a newer one.
+	stale := a.LocalState(false)
+	a.set("ch1", false, true)
+	gossip(a, b)
+	b.MergeRemoteState(stale, false)
+	_, ok = b.peerChannel("ch1")
+	assert.False(t, ok, "A removed channel should not be revived by older gossip.")
+
+	// The channels of a node that left are hidden until it comes back.
+	a.set("ch2", true, false)
+	gossip(a, b)
+	b.NotifyLeave(&memberlist.Node{Name: "a"})
+	assert.Empty(t, b.peerChannels())
+	b.NotifyJoin(&memberlist.Node{Name: "a", Meta: a.NodeMeta(512)})
+	assert.Len(t, b.peerChannels(), 1)
+
+	// A restarted node supersedes what its previous run gossiped about channels it no longer holds.
+	restarted := newChannelDirectory("a", "http://10.0.0.1:8080", 4)
+	restarted.NotifyJoin(&memberlist.Node{Name: "b", Meta: b.NodeMeta(512)})
+	restarted.MergeRemoteState(b.LocalState(false), false)
+	gossip(restarted, b)
+	assert.Empty(t, b.peerChannels())
+	synced, incarnation := restarted.lastSync("b")
+	assert.False(t, synced.IsZero(), "A push/pull records when the nodes last synced.")
+	assert.Equal(t, b.incarnation, incarnation)
+	_, incarnation = b.lastSync("a")
+	assert.NotEqual(t, restarted.incarnation, incarnation, "A restarted node has a new incarnation.")
+}
@@ -0,0 +1,174 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Discoverer finds the memberlist agents to join. Addresses are host or host:port,
+// and the memberlist port of this node is used when the port is omitted.
+type Discoverer interface {
+	Discover(ctx context.Context) ([]string, error)
+	// String describes the source in logs.
+	String() string
+}
+
+// Watcher is a Discoverer that follows its source itself, so that new peers are joined without waiting for the next tick.
+type Watcher interface {
+	Discoverer
+	// Run follows the source until ctx is canceled.
+	Run(ctx context.Context)
+	// Changes is signaled when the discovered addresses change.
+	Changes() <-chan struct{}
+}
+
+// StaticDiscoverer returns a fixed list of addresses.
+type StaticDiscoverer []string
+
+func (d StaticDiscoverer) Discover(context.Context) ([]string, error) {
+	return slices.Clone(d), nil
+}
+
+func (d StaticDiscoverer) String() string {
+	return "static"
+}
+
+// DNSDiscoverer resolves the A and AAAA records of a domain, e.g. of a headless Service.
+type DNSDiscoverer struct {
+	Domain string
+}
+
+func (d DNSDiscoverer) Discover(ctx context.Context) ([]string, error) {
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, d.Domain)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, ip.IP.String())
+	}
+	return addrs, nil
+}
+
+func (d DNSDiscoverer) String() string {
+	return "dns:" + d.Domain
+}
+
+// SRVDiscoverer resolves the SRV records of a name such as _memberlist._tcp.example.com,
+// which also carry the port of each agent.
+type SRVDiscoverer struct {
+	Name string
+}
+
+func (d SRVDiscoverer) Discover(ctx context.Context) ([]string, error) {
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", d.Name)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(srvs))
+	for _, srv := range srvs {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+	}
+	return addrs, nil
+}
+
+func (d SRVDiscoverer) String() string {
+	return "srv:" + d.Name
+}
+
+// FileDiscoverer reads a file of one address per line, and reads it again when it is modified.
+// Empty lines and lines starting with # are ignored.
+type FileDiscoverer struct {
+	path     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	modTime time.Time
+	addrs   []string
+	changes chan struct{}
+}
+
+var _ Watcher = (*FileDiscoverer)(nil)
+
+// NewFileDiscoverer reads path, which Run checks for changes every interval.
+func NewFileDiscoverer(path string, interval time.Duration) *FileDiscoverer {
+	return &FileDiscoverer{path: path, interval: interval, changes: make(chan struct{}, 1)}
+}
+
+func (d *FileDiscoverer) Discover(context.Context) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peers file: %w", err)
+	}
+	if !info.ModTime().Equal(d.modTime) {
+		addrs, err := loadPeersFile(d.path)
+		if err != nil {
+			return nil, err
+		}
+		d.addrs = addrs
+		d.modTime = info.ModTime()
+	}
+	return slices.Clone(d.addrs), nil
+}
+
+// Run polls the modification time of the file until ctx is canceled, and signals Changes when it is modified.
+func (d *FileDiscoverer) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	// Changes made since the file was last read are signaled too.
+	d.mu.Lock()
+	lastModTime := d.modTime
+	d.mu.Unlock()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(d.path)
+			if err != nil || info.ModTime().Equal(lastModTime) {
+				continue
+			}
+			lastModTime = info.ModTime()
+			select {
+			case d.changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (d *FileDiscoverer) Changes() <-chan struct{} {
+	return d.changes
+}
+
+func (d *FileDiscoverer) String() string {
+	return "file:" + d.path
+}
+
+func loadPeersFile(path string) ([]string, error) {
+	buf, err := os.ReadFile(path) //nolint: gosec
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peers file: %w", err)
+	}
+	var addrs []string
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addrs = append(addrs, line)
+	}
+	return addrs, nil
+}
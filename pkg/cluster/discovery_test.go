@@ -0,0 +1,41 @@
+package cluster
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileDiscoverer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers")
+	require.NoError(t, os.WriteFile(path, []byte("# peers\n10.0.0.1\n\n10.0.0.2:7947\n"), 0o600))
+	d := NewFileDiscoverer(path, 10*time.Millisecond)
+	addrs, err := d.Discover(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2:7947"}, addrs)
+	go d.Run(t.Context())
+
+	require.NoError(t, os.WriteFile(path, []byte("10.0.0.3\n"), 0o600))
+	// Make the change visible on file systems with a coarse mtime.
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	select {
+	case <-d.Changes():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the change was not signaled")
+	}
+	addrs, err = d.Discover(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.3"}, addrs)
+}
+
+func TestIsSelf(t *testing.T) {
+	assert.True(t, isSelf("10.0.0.1", "10.0.0.1", "7946"))
+	assert.True(t, isSelf("10.0.0.1:7946", "10.0.0.1", "7946"))
+	assert.False(t, isSelf("10.0.0.1:7947", "10.0.0.1", "7946"), "Another agent on the same host is a peer.")
+	assert.False(t, isSelf("10.0.0.2", "10.0.0.1", "7946"))
+}
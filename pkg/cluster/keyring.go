@@ -0,0 +1,153 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+var ErrInvalidGossipKey = errors.New("gossip key must be 16, 24 or 32 bytes encoded in base64")
+
+// ParseKey decodes a base64 gossip key for AES-128, AES-192 or AES-256.
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidGossipKey, err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, ErrInvalidGossipKey
+	}
+}
+
+// LoadKeys reads a keyring file of one base64 key per line. The first key encrypts the gossip,
+// and every key is accepted for decryption. Empty lines and lines starting with # are ignored.
+func LoadKeys(path string) ([][]byte, error) {
+	buf, err := os.ReadFile(path) //nolint: gosec
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gossip keyring: %w", err)
+	}
+	var keys [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := ParseKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gossip keyring %s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("gossip keyring %s has no keys", path)
+	}
+	return keys, nil
+}
+
+// NewKeyring returns a keyring that encrypts with the first key and decrypts with any of keys.
+// It returns nil, which disables encryption, when keys is empty.
+func NewKeyring(keys [][]byte) (*memberlist.Keyring, error) {
+	if len(keys) == 0 {
+		return nil, nil //nolint: nilnil
+	}
+	return memberlist.NewKeyring(keys[1:], keys[0])
+}
+
+// KeyringReloader installs the keys of a keyring file into a memberlist keyring and reloads them when the file changes.
+// Keys are rotated without a restart by adding the new key on every node, moving it to the top, and then removing the old key.
+type KeyringReloader struct {
+	path    string
+	keyring *memberlist.Keyring
+	modTime time.Time
+}
+
+func NewKeyringReloader(path string) (*KeyringReloader, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gossip keyring: %w", err)
+	}
+	keys, err := LoadKeys(path)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := NewKeyring(keys)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyringReloader{path: path, keyring: keyring, modTime: info.ModTime()}, nil
+}
+
+// Keyring returns the keyring to pass to SetUp.
+func (r *KeyringReloader) Keyring() *memberlist.Keyring {
+	return r.keyring
+}
+
+// Watch polls the keyring file every interval until ctx is canceled.
+func (r *KeyringReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(r.path)
+			if err != nil {
+				slog.Warn("Failed to stat gossip keyring", slog.String("error", err.Error()))
+				continue
+			}
+			if info.ModTime().Equal(r.modTime) {
+				continue
+			}
+			if err := r.reload(); err != nil {
+				// Keep the current keys; the file may be mid-rotation.
+				slog.Warn("Failed to reload gossip keyring", slog.String("error", err.Error()))
+				continue
+			}
+			r.modTime = info.ModTime()
+			slog.Info("Gossip keyring has been reloaded", slog.String("path", r.path))
+		}
+	}
+}
+
+func (r *KeyringReloader) reload() error {
+	keys, err := LoadKeys(r.path)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := r.keyring.AddKey(key); err != nil {
+			return err
+		}
+	}
+	if err := r.keyring.UseKey(keys[0]); err != nil {
+		return err
+	}
+	// RemoveKey rewrites the installed keys, so collect the stale ones first.
+	var stale [][]byte
+	for _, key := range r.keyring.GetKeys() {
+		if !slices.ContainsFunc(keys, func(k []byte) bool { return bytes.Equal(k, key) }) {
+			stale = append(stale, bytes.Clone(key))
+		}
+	}
+	for _, key := range stale {
+		if err := r.keyring.RemoveKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
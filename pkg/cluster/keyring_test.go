@@ -0,0 +1,46 @@
+package cluster
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyringReloader(t *testing.T) {
+	oldKey := []byte(strings.Repeat("o", 32))
+	newKey := []byte(strings.Repeat("n", 32))
+	path := filepath.Join(t.TempDir(), "keyring")
+	write := func(keys ...[]byte) {
+		lines := []string{"# primary key first"}
+		for _, key := range keys {
+			lines = append(lines, base64.StdEncoding.EncodeToString(key))
+		}
+		require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600))
+	}
+
+	write(oldKey)
+	r, err := NewKeyringReloader(path)
+	require.NoError(t, err)
+	assert.Equal(t, oldKey, r.Keyring().GetPrimaryKey())
+
+	// Rotation: install the new key, promote it, then drop the old one.
+	write(oldKey, newKey)
+	require.NoError(t, r.reload())
+	assert.Equal(t, oldKey, r.Keyring().GetPrimaryKey())
+	assert.Len(t, r.Keyring().GetKeys(), 2)
+	write(newKey, oldKey)
+	require.NoError(t, r.reload())
+	assert.Equal(t, newKey, r.Keyring().GetPrimaryKey())
+	write(newKey)
+	require.NoError(t, r.reload())
+	assert.Equal(t, [][]byte{newKey}, r.Keyring().GetKeys())
+
+	write([]byte("short"))
+	assert.ErrorIs(t, r.reload(), ErrInvalidGossipKey)
+	assert.Equal(t, newKey, r.Keyring().GetPrimaryKey(), "An invalid file should keep the current keys.")
+}
@@ -0,0 +1,252 @@
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// memberlistPortName is the name of the Endpoints port used instead of the default memberlist port when present.
+	memberlistPortName = "memberlist"
+	kubernetesRetry    = 5 * time.Second
+)
+
+var ErrNotInCluster = errors.New("not running in a Kubernetes cluster")
+
+// endpoints is the part of a core/v1 Endpoints object that discovery needs.
+type endpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+type endpointsList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []endpoints `json:"items"`
+}
+
+type endpointsEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// KubernetesDiscoverer watches an Endpoints object, e.g. of the Service in front of the servers,
+// and returns the ready addresses. Only get, list and watch on endpoints are needed.
+type KubernetesDiscoverer struct {
+	apiURL      string
+	namespace   string
+	name        string
+	defaultPort int
+	tokenFile   string
+	client      *http.Client
+
+	mu      sync.RWMutex
+	addrs   []string
+	changes chan struct{}
+}
+
+var _ Watcher = (*KubernetesDiscoverer)(nil)
+
+// NewKubernetesDiscoverer watches the Endpoints name in namespace through the API server at apiURL.
+// The bearer token is read from tokenFile on every request, since service account tokens are rotated.
+func NewKubernetesDiscoverer(apiURL, namespace, name string, defaultPort int, client *http.Client, tokenFile string) *KubernetesDiscoverer {
+	return &KubernetesDiscoverer{
+		apiURL:      strings.TrimSuffix(apiURL, "/"),
+		namespace:   namespace,
+		name:        name,
+		defaultPort: defaultPort,
+		tokenFile:   tokenFile,
+		client:      client,
+		changes:     make(chan struct{}, 1),
+	}
+}
+
+// InClusterKubernetesDiscoverer watches ref, "[namespace/]name", with the service account of the pod.
+// The namespace of the pod is used when ref has none.
+func InClusterKubernetesDiscoverer(ref string, defaultPort int) (*KubernetesDiscoverer, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, ErrNotInCluster
+	}
+	namespace, name, ok := strings.Cut(ref, "/")
+	if !ok {
+		buf, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the namespace of the pod: %w", err)
+		}
+		namespace, name = strings.TrimSpace(string(buf)), ref
+	}
+	caCert, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the Kubernetes CA certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, errors.New("failed to parse the Kubernetes CA certificate")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint: forcetypeassert
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	apiURL := "https://" + net.JoinHostPort(host, port)
+	return NewKubernetesDiscoverer(apiURL, namespace, name, defaultPort, &http.Client{Transport: transport}, serviceAccountDir+"/token"), nil
+}
+
+func (d *KubernetesDiscoverer) Discover(context.Context) ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return slices.Clone(d.addrs), nil
+}
+
+func (d *KubernetesDiscoverer) Changes() <-chan struct{} {
+	return d.changes
+}
+
+func (d *KubernetesDiscoverer) String() string {
+	return "kubernetes:" + d.namespace + "/" + d.name
+}
+
+// Run lists the Endpoints and then watches them, listing again whenever the watch ends.
+func (d *KubernetesDiscoverer) Run(ctx context.Context) {
+	for {
+		err := d.listAndWatch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Info("Kubernetes endpoints watch failed, will retry", slog.String("discovery", d.String()), slog.String("error", err.Error()))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(kubernetesRetry):
+			}
+		}
+	}
+}
+
+func (d *KubernetesDiscoverer) listAndWatch(ctx context.Context) error {
+	var list endpointsList
+	if err := d.get(ctx, nil, func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&list)
+	}); err != nil {
+		return err
+	}
+	if len(list.Items) == 0 {
+		d.update(nil)
+	} else {
+		d.update(&list.Items[0])
+	}
+
+	query := url.Values{}
+	query.Set("watch", "true")
+	query.Set("resourceVersion", list.Metadata.ResourceVersion)
+	return d.get(ctx, query, func(body io.Reader) error {
+		decoder := json.NewDecoder(body)
+		for {
+			var event endpointsEvent
+			if err := decoder.Decode(&event); err != nil {
+				if errors.Is(err, io.EOF) {
+					// The API server closes watches after a while.
+					return nil
+				}
+				return err
+			}
+			switch event.Type {
+			case "ADDED", "MODIFIED":
+				var ep endpoints
+				if err := json.Unmarshal(event.Object, &ep); err != nil {
+					return err
+				}
+				d.update(&ep)
+			case "DELETED":
+				d.update(nil)
+			case "ERROR":
+				// Typically 410 Gone when the resource version is too old.
+				return fmt.Errorf("watch error: %s", event.Object)
+			}
+		}
+	})
+}
+
+// get requests the Endpoints collection, narrowed down to name, and hands the body to decode.
+func (d *KubernetesDiscoverer) get(ctx context.Context, query url.Values, decode func(io.Reader) error) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("fieldSelector", "metadata.name="+d.name)
+	u := d.apiURL + "/api/v1/namespaces/" + url.PathEscape(d.namespace) + "/endpoints?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if d.tokenFile != "" {
+		token, err := os.ReadFile(d.tokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read the service account token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return decode(resp.Body)
+}
+
+// update replaces the addresses with the ready addresses of ep and signals a change.
+func (d *KubernetesDiscoverer) update(ep *endpoints) {
+	var addrs []string
+	if ep != nil {
+		for _, subset := range ep.Subsets {
+			port := d.defaultPort
+			for _, p := range subset.Ports {
+				if p.Name == memberlistPortName {
+					port = p.Port
+				}
+			}
+			for _, addr := range subset.Addresses {
+				addrs = append(addrs, net.JoinHostPort(addr.IP, strconv.Itoa(port)))
+			}
+		}
+	}
+	slices.Sort(addrs)
+
+	d.mu.Lock()
+	changed := !slices.Equal(d.addrs, addrs)
+	d.addrs = addrs
+	d.mu.Unlock()
+	if changed {
+		select {
+		case d.changes <- struct{}{}:
+		default:
+		}
+	}
+}
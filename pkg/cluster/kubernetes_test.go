@@ -0,0 +1,76 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKubernetesDiscoverer(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("test-token\n"), 0o600))
+
+	events := make(chan string)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/default/endpoints" ||
+			r.URL.Query().Get("fieldSelector") != "metadata.name=webhook" ||
+			r.Header.Get("Authorization") != "Bearer test-token" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if r.URL.Query().Get("watch") != "true" {
+			fmt.Fprint(w, `{"metadata":{"resourceVersion":"1"},"items":[{"subsets":[{"addresses":[{"ip":"10.0.0.1"}],"ports":[{"name":"http","port":8080}]}]}]}`) //nolint: errcheck
+			return
+		}
+		assert.Equal(t, "1", r.URL.Query().Get("resourceVersion"))
+		w.(http.Flusher).Flush() //nolint: forcetypeassert
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event := <-events:
+				fmt.Fprintln(w, event)   //nolint: errcheck
+				w.(http.Flusher).Flush() //nolint: forcetypeassert
+			}
+		}
+	}))
+	defer api.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := NewKubernetesDiscoverer(api.URL, "default", "webhook", 7946, api.Client(), tokenFile)
+	go d.Run(ctx)
+
+	waitChange := func() {
+		t.Helper()
+		select {
+		case <-d.Changes():
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "no change was signaled")
+		}
+	}
+	waitChange()
+	addrs, err := d.Discover(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:7946"}, addrs, "The default port is used without a memberlist port.")
+
+	events <- `{"type":"MODIFIED","object":{"subsets":[{"addresses":[{"ip":"10.0.0.2"},{"ip":"10.0.0.1"}],"ports":[{"name":"memberlist","port":7947}]}]}}`
+	waitChange()
+	addrs, err = d.Discover(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:7947", "10.0.0.2:7947"}, addrs)
+
+	events <- `{"type":"DELETED","object":{}}`
+	waitChange()
+	addrs, err = d.Discover(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, addrs)
+}
@@ -4,18 +4,23 @@ import (
 	"context"
 	"log/slog"
 	"net"
+	"slices"
+	"strconv"
 	"time"
 
 	"github.com/hashicorp/memberlist"
 )
 
 type Memberlist struct {
-	myIP  string
-	mlist *memberlist.Memberlist
+	myIP     string
+	mlist    *memberlist.Memberlist
+	channels *channelDirectory
 }
 
-func (m *Memberlist) Start(ctx context.Context, peerDomain string, tickTime time.Duration) {
-	go startAutoJoin(ctx, m.mlist, peerDomain, m.myIP, tickTime)
+// Start joins the peers found by discoverers now and every tickTime, and as soon as a watching discoverer sees a change.
+func (m *Memberlist) Start(ctx context.Context, tickTime time.Duration, discoverers ...Discoverer) {
+	self := m.mlist.LocalNode()
+	go startAutoJoin(ctx, m.mlist, discoverers, m.myIP, strconv.Itoa(int(self.Port)), tickTime)
 }
 
 func (m *Memberlist) ActiveNodes() []*memberlist.Node {
@@ -45,35 +50,156 @@ func (m *Memberlist) MyNodeName() string {
 	return m.mlist.LocalNode().Name
 }
 
+// Join contacts the memberlist agents at addrs and returns how many were reached.
+func (m *Memberlist) Join(addrs []string) (int, error) {
+	return m.mlist.Join(addrs)
+}
+
+// Leave tells the peers that this node is going away and waits up to timeout for the message to be gossiped.
+// The channels of this node stop being routed on the peers once they have heard of it.
+func (m *Memberlist) Leave(timeout time.Duration) error {
+	return m.mlist.Leave(timeout)
+}
+
+// Shutdown stops the memberlist without notifying the peers.
+func (m *Memberlist) Shutdown() error {
+	return m.mlist.Shutdown()
+}
+
+// Member is a node of the cluster as seen by this node.
+type Member struct {
+	Name      string
+	Addr      string
+	ServerURL string
+	State     string
+	// Incarnation changes whenever the node restarts. It is zero until this node has synced with it.
+	Incarnation uint64
+	// Channels and Connected count the channels the node holds and those with a client connected, as gossiped.
+	Channels  int
+	Connected int
+	// LastSync is when this node last exchanged its whole channel map with the node, zero if never.
+	LastSync time.Time
+}
+
+// Members returns every node memberlist knows, including the suspect, dead and left ones it has not forgotten yet.
+func (m *Memberlist) Members() []Member {
+	channels, connected := m.channels.nodeChannels()
+	nodes := m.mlist.Members()
+	members := make([]Member, 0, len(nodes))
+	for _, node := range nodes {
+		lastSync, incarnation := m.channels.lastSync(node.Name)
+		members = append(members, Member{
+			Name:        node.Name,
+			Addr:        node.Address(),
+			ServerURL:   ServerURL(node),
+			State:       stateName(node.State),
+			Incarnation: incarnation,
+			Channels:    channels[node.Name],
+			Connected:   connected[node.Name],
+			LastSync:    lastSync,
+		})
+	}
+	return members
+}
+
+func stateName(state memberlist.NodeStateType) string {
+	switch state {
+	case memberlist.StateAlive:
+		return "alive"
+	case memberlist.StateSuspect:
+		return "suspect"
+	case memberlist.StateDead:
+		return "dead"
+	case memberlist.StateLeft:
+		return "left"
+	default:
+		return "unknown"
+	}
+}
+
+// ServerURL returns the URL under which the server of node is reachable, or an empty string
+// when the node did not advertise one.
+func ServerURL(node *memberlist.Node) string {
+	return string(node.Meta)
+}
+
+// SetChannel shares with the cluster that this node holds the channel id.
+func (m *Memberlist) SetChannel(id string, connected bool) {
+	m.channels.set(id, connected, false)
+}
+
+// MigrateChannel shares with the cluster that the client of the channel id may move it to another node
+// with the resume token whose SHA-256 is resumeHash.
+func (m *Memberlist) MigrateChannel(id, resumeHash, owner string) {
+	m.channels.migrate(id, resumeHash, owner)
+}
+
+// RemoveChannel shares with the cluster that this node no longer holds the channel id.
+func (m *Memberlist) RemoveChannel(id string) {
+	m.channels.set(id, false, true)
+}
+
+// PeerChannels returns the channels held by the other nodes, as far as the gossip has reached this node.
+func (m *Memberlist) PeerChannels() []Channel {
+	return m.channels.peerChannels()
+}
+
+// PeerChannel returns the channel id when another node holds it.
+func (m *Memberlist) PeerChannel(id string) (Channel, bool) {
+	return m.channels.peerChannel(id)
+}
+
 func startAutoJoin(
 	ctx context.Context,
 	mlist *memberlist.Memberlist,
-	peerDomain string,
+	discoverers []Discoverer,
 	myIP string,
+	myPort string,
 	tickTime time.Duration,
 ) {
-	if peerDomain == "" {
+	if len(discoverers) == 0 {
 		return
 	}
 
 	ticker := time.NewTicker(tickTime)
 	defer ticker.Stop()
-
-	tryJoin := func() {
-		ips, err := net.LookupIP(peerDomain)
-		if err != nil {
-			// NOTE: Common immediately after starting k8s
-			slog.Info("DNS lookup failed, will retry", slog.String("domain", peerDomain), slog.String("error", err.Error()))
-			return
+	changes := make(chan struct{}, 1)
+	for _, d := range discoverers {
+		if w, ok := d.(Watcher); ok {
+			go w.Run(ctx)
+			go func() {
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-w.Changes():
+						select {
+						case changes <- struct{}{}:
+						default:
+						}
+					}
+				}
+			}()
 		}
+	}
 
+	tryJoin := func() {
 		var joinAddrs []string
-		for _, ip := range ips {
-			ipStr := ip.String()
-			if ipStr != myIP {
-				joinAddrs = append(joinAddrs, ipStr)
+		for _, d := range discoverers {
+			addrs, err := d.Discover(ctx)
+			if err != nil {
+				// NOTE: Common immediately after starting k8s
+				slog.Info("Peer discovery failed, will retry", slog.String("discovery", d.String()), slog.String("error", err.Error()))
+				continue
+			}
+			for _, addr := range addrs {
+				if !isSelf(addr, myIP, myPort) {
+					joinAddrs = append(joinAddrs, addr)
+				}
 			}
 		}
+		slices.Sort(joinAddrs)
+		joinAddrs = slices.Compact(joinAddrs)
 
 		if len(joinAddrs) > 0 {
 			// NOTE: If idempotent and their respective IPs match, they begin clustering.
@@ -81,7 +207,7 @@ func startAutoJoin(
 			if err != nil {
 				slog.Warn("Failed to join peers", slog.String("error", err.Error()))
 			} else if num > 0 {
-				slog.Info("Successfully contacted peers", slog.Int("contacted_nodes", num))
+				slog.Debug("Successfully contacted peers", slog.Int("contacted_nodes", num))
 			}
 		}
 	}
@@ -95,6 +221,17 @@ func startAutoJoin(
 			return
 		case <-ticker.C:
 			tryJoin()
+		case <-changes:
+			tryJoin()
 		}
 	}
 }
+
+// isSelf reports whether addr, a host or host:port, is the memberlist agent of this node.
+func isSelf(addr, myIP, myPort string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr == myIP
+	}
+	return host == myIP && port == myPort
+}
@@ -25,11 +25,27 @@ func Config(port int, myIP string) *memberlist.Config {
 	return mConfig
 }
 
-func SetUp(port int, myIP string) (*Memberlist, error) {
+// SetUp creates the memberlist of this node, which advertises serverURL to its peers.
+// A non-nil keyring encrypts the gossip and rejects members without one of its keys.
+func SetUp(port int, myIP, serverURL string, keyring *memberlist.Keyring) (*Memberlist, error) {
 	mConfig := Config(port, myIP)
+	mConfig.Keyring = keyring
+	m, err := New(mConfig, serverURL)
+	if err != nil {
+		return nil, err
+	}
+	m.myIP = myIP
+	return m, nil
+}
+
+// New creates a memberlist from mConfig that advertises serverURL and gossips the channels of this node.
+func New(mConfig *memberlist.Config, serverURL string) (*Memberlist, error) {
+	channels := newChannelDirectory(mConfig.Name, serverURL, mConfig.RetransmitMult)
+	mConfig.Delegate = channels
+	mConfig.Events = channels
 	mlist, err := memberlist.Create(mConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create memberlist: %w", err)
 	}
-	return &Memberlist{mlist: mlist, myIP: myIP}, nil
+	return &Memberlist{mlist: mlist, channels: channels}, nil
 }
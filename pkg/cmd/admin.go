@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nonchan7720/webhook-over-websocket/pkg/tlsconfig"
+	"github.com/spf13/cobra"
+)
+
+// adminTokenEnv is read when --admin-token is not given, so that the token does not show up in the process list.
+const adminTokenEnv = "WEBHOOK_ADMIN_TOKEN"
+
+// adminArgs are the connection and output flags shared by the commands that call the server's /admin API.
+// Connection settings not given by flags are read from a profile.
+type adminArgs struct {
+	serverURL string
+	token     string
+	insecure  bool
+	caCert    string
+
+	profile     string
+	profileFile string
+
+	output string
+}
+
+func (a *adminArgs) addFlags(cmd *cobra.Command) {
+	flag := cmd.PersistentFlags()
+	flag.StringVar(&a.serverURL, "server-url", "", "webhook-over-websocket server URL (e.g. http://example.com)")
+	flag.StringVar(&a.token, "admin-token", "", "admin API token (default $"+adminTokenEnv+")")
+	flag.BoolVar(&a.insecure, "insecure", false, "insecure skip verify")
+	flag.StringVar(&a.caCert, "ca-cert", "", "CA certificate file used to verify the server")
+	flag.StringVar(&a.profile, "profile", "", "profile to read the connection settings from (default $"+profileEnv+" or the default of the profile file)")
+	flag.StringVar(&a.profileFile, "profile-file", "", "profile file (default "+defaultProfileFileHint+")")
+	flag.StringVarP(&a.output, "output", "o", outputTable, "output format (json|table)")
+}
+
+type adminClient struct {
+	serverURL  string
+	token      string
+	httpClient *http.Client
+}
+
+func newAdminClient(args *adminArgs) (*adminClient, error) {
+	if args.output != outputJSON && args.output != outputTable {
+		return nil, fmt.Errorf("invalid output format %q: expected json or table", args.output)
+	}
+	p, err := loadProfile(args.profileFile, args.profile)
+	if err != nil {
+		return nil, err
+	}
+	serverURL := cmp.Or(args.serverURL, p.ServerURL)
+	if serverURL == "" {
+		return nil, errors.New("--server-url is required")
+	}
+	token := cmp.Or(args.token, os.Getenv(adminTokenEnv), p.AdminToken)
+	if token == "" {
+		return nil, fmt.Errorf("--admin-token or $%s is required", adminTokenEnv)
+	}
+	tlsConfig, err := tlsconfig.NewClientConfig(cmp.Or(args.caCert, p.CACert), "", "", args.insecure || p.Insecure)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{Timeout: 5 * time.Minute} // Bulk redelivery waits for every webhook in turn.
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone() // nolint: errcheck,forcetypeassert
+		transport.TLSClientConfig = tlsConfig
+		httpClient.Transport = transport
+	}
+	return &adminClient{
+		serverURL:  strings.TrimSuffix(serverURL, "/"),
+		token:      token,
+		httpClient: httpClient,
+	}, nil
+}
+
+// do calls the admin API and decodes the JSON response into out unless it is nil.
+// Responses listed in accept are decoded even though they are not 2xx.
+func (c *adminClient) do(ctx context.Context, method, path string, query url.Values, out any, accept ...int) error {
+	u := c.serverURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint: errcheck
+	if resp.StatusCode >= http.StatusBadRequest && !slices.Contains(accept, resp.StatusCode) {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096)) //nolint: errcheck
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+const (
+	outputJSON  = "json"
+	outputTable = "table"
+)
+
+// print writes v as indented JSON, or as the table written by table.
+func (a *adminArgs) print(w io.Writer, v any, table func(tw *tabwriter.Writer)) error {
+	if a.output == outputJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	table(tw)
+	return tw.Flush()
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
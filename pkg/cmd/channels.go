@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nonchan7720/webhook-over-websocket/pkg/tunnel"
+	"github.com/spf13/cobra"
+)
+
+func channelsCommand() *cobra.Command {
+	var args adminArgs
+	cmd := &cobra.Command{
+		Use:   "channels",
+		Short: "Inspect and manage the channels of the cluster",
+	}
+	args.addFlags(cmd)
+	cmd.AddCommand(
+		channelsListCommand(&args),
+		channelsShowCommand(&args),
+		channelsActionCommand(&args, "revoke", "Revoke channels and disconnect their clients", http.MethodDelete, "", "revoked"),
+		channelsActionCommand(&args, "disconnect", "Disconnect the clients of channels but keep the channels", http.MethodPost, "/disconnect", "disconnected"),
+	)
+	return cmd
+}
+
+func channelsListCommand(args *adminArgs) *cobra.Command {
+	var connected bool
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the channels of every server",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			client, err := newAdminClient(args)
+			if err != nil {
+				return err
+			}
+			var list []tunnel.ChannelInfo
+			if err := client.do(cmd.Context(), http.MethodGet, "/admin/channels", nil, &list); err != nil {
+				return err
+			}
+			if connected {
+				filtered := list[:0]
+				for _, info := range list {
+					if info.Connected {
+						filtered = append(filtered, info)
+					}
+				}
+				list = filtered
+			}
+			return args.print(cmd.OutOrStdout(), list, func(tw *tabwriter.Writer) {
+				fmt.Fprintln(tw, "ID\tNODE\tOWNER\tCONNECTED\tREQUESTS\tFAILURES\tFILTERED\tCREATED") //nolint: errcheck
+				for _, info := range list {
+					fmt.Fprintf( //nolint: errcheck
+						tw, "%s\t%s\t%s\t%t\t%d\t%d\t%d\t%s\n",
+						info.ID, info.Node, orDash(info.Owner), info.Connected, info.Requests, info.Failures, info.Filtered, formatTime(&info.CreatedAt),
+					)
+				}
+			})
+		},
+	}
+	cmd.Flags().BoolVar(&connected, "connected", false, "only list channels with a connected client")
+	return cmd
+}
+
+func channelsShowCommand(args *adminArgs) *cobra.Command {
+	return &cobra.Command{
+		Use:   "show <id>",
+		Short: "Show a channel with its policy and recent errors",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, ids []string) error {
+			client, err := newAdminClient(args)
+			if err != nil {
+				return err
+			}
+			var info tunnel.ChannelInfo
+			if err := client.do(cmd.Context(), http.MethodGet, "/admin/channels/"+url.PathEscape(ids[0]), nil, &info); err != nil {
+				return err
+			}
+			if args.output == outputJSON {
+				return args.print(cmd.OutOrStdout(), &info, nil)
+			}
+			printChannel(cmd.OutOrStdout(), &info)
+			return nil
+		},
+	}
+}
+
+func printChannel(w io.Writer, info *tunnel.ChannelInfo) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	rows := [][2]string{
+		{"ID", info.ID},
+		{"Node", info.Node},
+		{"Owner", orDash(info.Owner)},
+		{"Connected", strconv.FormatBool(info.Connected)},
+		{"Encrypted", strconv.FormatBool(info.Encrypted)},
+		{"Created", formatTime(&info.CreatedAt)},
+		{"Connected at", formatTime(info.ConnectedAt)},
+		{"Last request", formatTime(info.LastRequestAt)},
+		{"Requests", strconv.FormatInt(info.Requests, 10)},
+		{"Failures", strconv.FormatInt(info.Failures, 10)},
+		{"Filtered", strconv.FormatInt(info.Filtered, 10)},
+		{"Blocked", strconv.FormatInt(info.Blocked, 10)},
+		{"Allow", orDash(strings.Join(info.Policy.Allow, ", "))},
+		{"Dedup key", orDash(info.Policy.DedupKey)},
+		{"Filter", orDash(strings.Join(append(info.Policy.Filter, info.Policy.FilterExpr...), ", "))},
+	}
+	for _, row := range rows {
+		fmt.Fprintf(tw, "%s:\t%s\n", row[0], row[1]) //nolint: errcheck
+	}
+	_ = tw.Flush() //nolint: errcheck
+	if len(info.RecentErrors) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "\nRecent errors:") //nolint: errcheck
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tREASON\tSTATUS\tERROR") //nolint: errcheck
+	for _, e := range info.RecentErrors {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", formatTime(&e.Time), e.Reason, e.Status, orDash(e.Error)) //nolint: errcheck
+	}
+	_ = tw.Flush() //nolint: errcheck
+}
+
+// channelsActionCommand returns a command that sends method to /admin/channels/{id}{suffix} for every id.
+func channelsActionCommand(args *adminArgs, use, short, method, suffix, done string) *cobra.Command {
+	return &cobra.Command{
+		Use:   use + " <id>...",
+		Short: short,
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, ids []string) error {
+			client, err := newAdminClient(args)
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				if err := client.do(cmd.Context(), method, "/admin/channels/"+url.PathEscape(id)+suffix, nil, nil); err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%s\t%s\n", id, done) //nolint: errcheck
+			}
+			return nil
+		},
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -1,34 +1,60 @@
 package cmd
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"crypto/tls"
-	"encoding/json"
 	"fmt"
-	"log/slog"
-	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os/signal"
-	"sync"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/gorilla/websocket"
-	"github.com/nonchan7720/webhook-over-websocket/pkg/retry"
+	"github.com/nonchan7720/webhook-over-websocket/pkg/tlsconfig"
+	"github.com/nonchan7720/webhook-over-websocket/pkg/tunnel"
 	"github.com/spf13/cobra"
 )
 
 type clientArgs struct {
-	serverURL string
-	targetURL string
+	serverURL  string
+	targetURL  string
+	routes     []string
+	configFile string
 
-	insecure bool
+	insecure   bool
+	caCert     string
+	clientCert string
+	clientKey  string
+
+	allowCIDRs []string
+
+	dedupKey string
+	dedupTTL time.Duration
+
+	filters      []string
+	filterExprs  []string
+	filterStatus int
+	filterBody   string
+
+	e2eEncryption bool
 
 	transferRequestTimeout        time.Duration
 	disableTransferRequestTimeout bool
+
+	fallbackStatus    int
+	fallbackHeaders   []string
+	fallbackBody      string
+	spoolDir          string
+	redeliverInterval time.Duration
+
+	retryMaxAttempts    int
+	retryStatusCodes    []int
+	retryMethods        []string
+	retryMaxElapsedTime time.Duration
+
+	circuitBreakerThreshold int
+	circuitBreakerCooldown  time.Duration
+
+	maxInFlight int
+	queueSize   int
 }
 
 func clientCommand() *cobra.Command {
@@ -37,25 +63,42 @@ func clientCommand() *cobra.Command {
 		Use:           "client",
 		SilenceErrors: true,
 		SilenceUsage:  true,
-		PreRun: func(cmd *cobra.Command, _ []string) {
-			if args.insecure {
-				tlsConfig := &tls.Config{
-					InsecureSkipVerify: true, //nolint: gosec
-				}
-				transport := http.DefaultTransport.(*http.Transport).Clone() // nolint: errcheck,forcetypeassert
-				transport.TLSClientConfig = tlsConfig
-				http.DefaultClient.Transport = transport
-				websocket.DefaultDialer.TLSClientConfig = tlsConfig
-			}
-		},
 		RunE: func(cmd *cobra.Command, _ []string) error {
-			return executeClient(cmd.Context(), &args)
+			return executeClient(cmd.Context(), cmd, &args)
 		},
 	}
 	flag := cmd.Flags()
 	flag.StringVar(&args.serverURL, "server-url", "", "webhook-over-websocket server URL (e.g. http://example.com)")
 	flag.StringVar(&args.targetURL, "target-url", "http://localhost:3000", "local server URL to forward webhook requests to")
+	flag.StringArrayVar(
+		&args.routes,
+		"route",
+		nil,
+		"routing rule to a local target, e.g. name=github,path=/github,header=X-GitHub-Event:push,target=http://localhost:3000,strip-prefix=true",
+	)
+	flag.StringVar(&args.configFile, "config", "", "client config file (YAML) with routing rules")
 	flag.BoolVar(&args.insecure, "insecure", false, "insecure skip verify")
+	flag.StringVar(&args.caCert, "ca-cert", "", "CA certificate file used to verify the server")
+	flag.StringVar(&args.clientCert, "client-cert", "", "client certificate file for mutual TLS")
+	flag.StringVar(&args.clientKey, "client-key", "", "client private key file for mutual TLS")
+	flag.StringSliceVar(&args.allowCIDRs, "allow", nil, "source IP allowlist for the channel (CIDR, IP or preset:<name> such as preset:github)")
+	flag.StringVar(&args.dedupKey, "dedup-key", "", "idempotency key to deduplicate webhooks on the server (header:<name> or json:<field>)")
+	flag.DurationVar(&args.dedupTTL, "dedup-ttl", 0, "how long the server remembers the first response (0 uses the server default)")
+	flag.StringArrayVar(
+		&args.filters,
+		"filter",
+		nil,
+		"only tunnel webhooks matching the rule, e.g. header:X-GitHub-Event=push|pull_request (repeatable, all must match)",
+	)
+	flag.StringArrayVar(
+		&args.filterExprs,
+		"filter-expr",
+		nil,
+		`only tunnel webhooks for which the CEL expression is true, e.g. body.action != "deleted" (repeatable)`,
+	)
+	flag.IntVar(&args.filterStatus, "filter-status", 0, "status returned for filtered webhooks (0 uses the server default)")
+	flag.StringVar(&args.filterBody, "filter-body", "", "body returned for filtered webhooks")
+	flag.BoolVar(&args.e2eEncryption, "e2e-encryption", false, "encrypt webhook payloads end-to-end so that the server cannot read them")
 	flag.DurationVar(
 		&args.transferRequestTimeout,
 		"transfer-request-timeout",
@@ -68,187 +111,141 @@ func clientCommand() *cobra.Command {
 		false,
 		"Disable the timeout when transfers to the local server",
 	)
+	flag.IntVar(
+		&args.fallbackStatus,
+		"fallback-status",
+		0,
+		"status returned instead of 502 while the local server is unreachable; the request is spooled and redelivered later (0 disables)",
+	)
+	flag.StringArrayVar(&args.fallbackHeaders, "fallback-header", nil, "header of the fallback response (e.g. Content-Type:application/json)")
+	flag.StringVar(&args.fallbackBody, "fallback-body", "", "body of the fallback response")
+	flag.StringVar(&args.spoolDir, "spool-dir", "", "directory to store requests waiting for redelivery (default: user cache directory)")
+	flag.DurationVar(&args.redeliverInterval, "redeliver-interval", 10*time.Second, "interval to retry spooled requests")
+	flag.IntVar(&args.retryMaxAttempts, "retry-max-attempts", 1, "maximum attempts to deliver a request to the local server (1 disables retries)")
+	flag.IntSliceVar(&args.retryStatusCodes, "retry-status", nil, "5xx status codes of the local server to retry (e.g. 502,503)")
+	flag.StringSliceVar(
+		&args.retryMethods,
+		"retry-methods",
+		nil,
+		"methods safe to retry (default GET,HEAD,OPTIONS,PUT,DELETE); mark routes idempotent to retry other methods",
+	)
+	flag.DurationVar(
+		&args.retryMaxElapsedTime,
+		"retry-max-elapsed-time",
+		20*time.Second,
+		"total time for all attempts; keep it below the server's webhook timeout",
+	)
+	flag.IntVar(
+		&args.circuitBreakerThreshold,
+		"circuit-breaker-threshold",
+		5,
+		"consecutive failures of the local server before requests fail fast (0 disables the circuit breaker)",
+	)
+	flag.DurationVar(&args.circuitBreakerCooldown, "circuit-breaker-cooldown", 30*time.Second, "how long requests fail fast before the local server is probed again")
+	flag.IntVar(&args.maxInFlight, "max-in-flight", 0, "maximum requests forwarded to the local server at the same time (0 means no limit)")
+	flag.IntVar(
+		&args.queueSize,
+		"queue-size",
+		100,
+		"requests waiting for a free slot when --max-in-flight is set; further requests get 503 with Retry-After",
+	)
 	_ = cmd.MarkFlagRequired("server-url") //nolint: errcheck
 	return cmd
 }
 
-func executeClient(ctx context.Context, args *clientArgs) error {
+func executeClient(ctx context.Context, cmd *cobra.Command, args *clientArgs) error {
 	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGTERM, syscall.SIGINT)
 	defer cancel()
-	u, err := url.Parse(args.serverURL)
+
+	tlsConfig, err := tlsconfig.NewClientConfig(args.caCert, args.clientCert, args.clientKey, args.insecure)
 	if err != nil {
-		return fmt.Errorf("Failed to parse server url: %w", err) //nolint:staticcheck
+		return err
 	}
-	isTLSConn := u.Scheme == "https"
-	websocketScheme := "ws"
-	if isTLSConn {
-		websocketScheme = "wss"
+	cfg, err := loadClientConfig(args)
+	if err != nil {
+		return err
 	}
-	// Have the server generate a channel_id
-	channelID, err := getNewChannel(args.serverURL)
+	transferTimeout := args.transferRequestTimeout
+	if args.disableTransferRequestTimeout {
+		transferTimeout = 0
+	}
+	opts := []tunnel.ClientOption{
+		tunnel.WithTargetURL(args.targetURL),
+		tunnel.WithRoutes(cfg.Routes...),
+		tunnel.WithTLSConfig(tlsConfig),
+		tunnel.WithAllowlist(args.allowCIDRs),
+		tunnel.WithDedup(args.dedupKey, args.dedupTTL),
+		tunnel.WithFilter(args.filters...),
+		tunnel.WithFilterExpr(args.filterExprs...),
+		tunnel.WithE2EEncryption(args.e2eEncryption),
+		tunnel.WithTransferTimeout(transferTimeout),
+		tunnel.WithCircuitBreaker(args.circuitBreakerThreshold, args.circuitBreakerCooldown),
+		tunnel.WithMaxInFlight(args.maxInFlight, args.queueSize),
+		tunnel.WithOnChannel(func(channelID, webhookURL string) {
+			fmt.Printf("Issued Channel ID: %s\n", channelID)
+			fmt.Printf("Please set the webhook destination as follows: %s\n", webhookURL)
+		}),
+	}
+	if cmd.Flags().Changed("filter-status") || cmd.Flags().Changed("filter-body") {
+		opts = append(opts, tunnel.WithFilterResponse(args.filterStatus, args.filterBody))
+	}
+	if cfg.Fallback != nil {
+		opts = append(opts, tunnel.WithFallback(*cfg.Fallback))
+	}
+	if cfg.Retry != nil {
+		opts = append(opts, tunnel.WithRetry(*cfg.Retry))
+	}
+	client, err := tunnel.NewClient(args.serverURL, opts...)
 	if err != nil {
-		return fmt.Errorf("failed to retrieve channel_id: %w", err)
+		return err
 	}
+	return client.Run(ctx)
+}
 
-	fmt.Printf("Issued Channel ID: %s\n", channelID)
-	fmt.Printf("Please set the webhook destination as follows: %s/webhook/%s\n", args.serverURL, channelID)
-
-	// Connect to the server via WebSocket
-	dialer := websocket.DefaultDialer
-	if args.insecure {
-		tls := &tls.Config{
-			InsecureSkipVerify: true,                 //nolint: gosec
-			NextProtos:         []string{"http/1.1"}, // Do not include h2
+// loadClientConfig merges the config file with the flags.
+// Routes given by flags are evaluated first, and the fallback and retry flags take precedence over the file.
+func loadClientConfig(args *clientArgs) (*tunnel.ClientConfig, error) {
+	cfg := &tunnel.ClientConfig{}
+	if args.configFile != "" {
+		var err error
+		if cfg, err = tunnel.LoadClientConfig(args.configFile); err != nil {
+			return nil, err
 		}
-		dialer.TLSClientConfig = tls
 	}
-	wsURL := fmt.Sprintf("%s://%s/ws/%s", websocketScheme, u.Host, channelID)
-	conn, err := retry.Retry(ctx, func() (*websocket.Conn, error) {
-		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	routes := make([]tunnel.Route, 0, len(args.routes)+len(cfg.Routes))
+	for _, v := range args.routes {
+		route, err := tunnel.ParseRoute(v)
 		if err != nil {
-			return nil, fmt.Errorf("WebSocket connection failed: %w", err)
+			return nil, err
 		}
-		return conn, nil
-	})
-	if err != nil {
-		return err
+		routes = append(routes, route)
 	}
-	defer conn.Close() //nolint: errcheck
-	slog.Info("A tunnel to the server has been established.")
-
-	var wsMutex sync.Mutex
-
-	// Close the WebSocket when canceling the context
-	go func() {
-		<-ctx.Done()
-		slog.Info("Shutting down client...")
-		_ = conn.Close() //nolint: errcheck
-	}()
-
-	// Message Receive Loop
-	for {
-		select {
-		case <-ctx.Done():
-			slog.Info("Context cancelled, exiting...")
-			return ctx.Err()
-		default:
-		}
+	cfg.Routes = append(routes, cfg.Routes...)
 
-		var msg TunnelMessage
-		err := conn.ReadJSON(&msg)
-		if err != nil {
-			select {
-			case <-ctx.Done():
-				slog.Info("Context cancelled during read")
-				return ctx.Err()
-			default:
-				slog.Error(fmt.Sprintf("WebSocket Disconnection: %v", err))
-				return err
+	if args.fallbackStatus != 0 {
+		headers := make(map[string]string, len(args.fallbackHeaders))
+		for _, h := range args.fallbackHeaders {
+			key, value, ok := strings.Cut(h, ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid fallback header %q: expected key:value", h)
 			}
+			headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+		cfg.Fallback = &tunnel.Fallback{
+			Status:            args.fallbackStatus,
+			Headers:           headers,
+			Body:              args.fallbackBody,
+			SpoolDir:          args.spoolDir,
+			RedeliverInterval: args.redeliverInterval,
 		}
-
-		// Forward each request to the local server in parallel processing
-		go handleHTTPRequest(
-			ctx,
-			msg,
-			conn,
-			&wsMutex,
-			args.targetURL,
-			args.transferRequestTimeout,
-			args.disableTransferRequestTimeout,
-		)
-	}
-}
-
-// getNewChannel hits the server's /new endpoint to retrieve the channel_id.
-func getNewChannel(serverURL string) (string, error) {
-	resp, err := http.Get(serverURL + "/new")
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close() //nolint: errcheck
-
-	var result map[string]string
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", err
-	}
-	return result["channel_id"], nil
-}
-
-// handleHTTPRequest reconstructs the received byte stream, sends it locally, and returns the result.
-func handleHTTPRequest(
-	ctx context.Context,
-	msg TunnelMessage,
-	wsConn *websocket.Conn,
-	wsMutex *sync.Mutex,
-	targetURL string,
-	timeout time.Duration,
-	disabledTimeout bool,
-) {
-	slog.Info(fmt.Sprintf("[ReqID: %s] Receive webhooks and forward them locally....", msg.ReqID))
-
-	// Restore the raw byte array to an HTTP request
-	reqReader := bufio.NewReader(bytes.NewReader(msg.Payload))
-	req, err := http.ReadRequest(reqReader)
-	if err != nil {
-		slog.Error(fmt.Sprintf("[ReqID: %s] Request Restore Error: %v", msg.ReqID, err))
-		sendErrorResponse(msg.ReqID, wsConn, wsMutex)
-		return
-	}
-
-	// Rewrite request information for the local server
-	req.RequestURI = "" // NOTE: When sending as a client, it must be left blank.
-	target, err := url.Parse(targetURL)
-	if err != nil {
-		slog.Error(fmt.Sprintf("[ReqID: %s] Target URL Parsing Error: %v", msg.ReqID, err))
-		sendErrorResponse(msg.ReqID, wsConn, wsMutex)
-		return
-	}
-	req.URL.Scheme = target.Scheme
-	req.URL.Host = target.Host
-	req.Host = target.Host
-	req = req.WithContext(ctx)
-
-	// Send to local server
-	client := &http.Client{}
-	if !disabledTimeout && timeout > 0 {
-		client.Timeout = timeout
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		slog.Error(fmt.Sprintf("[ReqID: %s] Error sending to local server: %v", msg.ReqID, err))
-		sendErrorResponse(msg.ReqID, wsConn, wsMutex)
-		return
-	}
-	defer resp.Body.Close() //nolint: errcheck
-
-	// Dump the received response as a raw byte stream
-	rawRespBytes, err := httputil.DumpResponse(resp, true)
-	if err != nil {
-		slog.Error(fmt.Sprintf("[ReqID: %s] Response Dump Error: %v", msg.ReqID, err))
-		return
-	}
-
-	respMsg := TunnelMessage{
-		ReqID:   msg.ReqID,
-		Payload: rawRespBytes,
 	}
-
-	wsMutex.Lock()
-	_ = wsConn.WriteJSON(respMsg) //nolint: errcheck
-	wsMutex.Unlock()
-
-	slog.Info(fmt.Sprintf("[ReqID: %s] The local response has been returned to the server. (Status: %d)", msg.ReqID, resp.StatusCode))
-}
-
-// sendErrorResponse returns a 502 Bad Gateway error when it cannot connect locally.
-func sendErrorResponse(reqID string, wsConn *websocket.Conn, wsMutex *sync.Mutex) {
-	badGatewayResp := "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
-	msg := TunnelMessage{
-		ReqID:   reqID,
-		Payload: []byte(badGatewayResp),
+	if args.retryMaxAttempts > 1 {
+		cfg.Retry = &tunnel.RetryPolicy{
+			MaxAttempts:    args.retryMaxAttempts,
+			StatusCodes:    args.retryStatusCodes,
+			Methods:        args.retryMethods,
+			MaxElapsedTime: args.retryMaxElapsedTime,
+		}
 	}
-	wsMutex.Lock()
-	_ = wsConn.WriteJSON(msg) //nolint: errcheck
-	wsMutex.Unlock()
+	return cfg, nil
 }
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/nonchan7720/webhook-over-websocket/pkg/tunnel"
+	"github.com/spf13/cobra"
+)
+
+func clusterCommand() *cobra.Command {
+	var args adminArgs
+	cmd := &cobra.Command{
+		Use:   "cluster",
+		Short: "Inspect the memberlist cluster",
+	}
+	args.addFlags(cmd)
+	cmd.AddCommand(clusterStatusCommand(&args))
+	return cmd
+}
+
+func clusterStatusCommand(args *adminArgs) *cobra.Command {
+	return &cobra.Command{
+		Use:   "status",
+		Short: "Show the memberlist nodes and the symptoms of a split brain",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			client, err := newAdminClient(args)
+			if err != nil {
+				return err
+			}
+			var status tunnel.ClusterStatus
+			if err := client.do(cmd.Context(), http.MethodGet, "/cluster/status", nil, &status); err != nil {
+				return err
+			}
+			return args.print(cmd.OutOrStdout(), status, func(tw *tabwriter.Writer) {
+				fmt.Fprintln(tw, "NAME\tADDRESS\tSTATE\tINCARNATION\tCHANNELS\tCONNECTED\tLAST SYNC") //nolint: errcheck
+				for _, m := range status.Members {
+					name := m.Name
+					if name == status.Node {
+						name += " (self)"
+					}
+					incarnation := "-"
+					if m.Incarnation != 0 {
+						incarnation = strconv.FormatUint(m.Incarnation, 10)
+					}
+					fmt.Fprintf( //nolint: errcheck
+						tw, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n",
+						name, orDash(m.Address), m.State, incarnation, m.Channels, m.ConnectedClients, formatTime(m.LastSync),
+					)
+				}
+				if len(status.Issues) == 0 {
+					fmt.Fprintln(tw, "\nNo issues found.") //nolint: errcheck
+					return
+				}
+				fmt.Fprintln(tw, "\nISSUE\tMESSAGE") //nolint: errcheck
+				for _, issue := range status.Issues {
+					fmt.Fprintf(tw, "%s\t%s\n", issue.Kind, issue.Message) //nolint: errcheck
+				}
+			})
+		},
+	}
+}
@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"text/tabwriter"
+
+	"github.com/nonchan7720/webhook-over-websocket/pkg/tunnel"
+	"github.com/spf13/cobra"
+)
+
+func deadLettersCommand() *cobra.Command {
+	var args adminArgs
+	cmd := &cobra.Command{
+		Use:     "deadletters",
+		Aliases: []string{"dlq"},
+		Short:   "Inspect and redeliver webhooks that failed delivery",
+	}
+	args.addFlags(cmd)
+	cmd.AddCommand(
+		deadLettersListCommand(&args),
+		deadLettersShowCommand(&args),
+		deadLettersRedeliverCommand(&args),
+		deadLettersDeleteCommand(&args),
+	)
+	return cmd
+}
+
+func deadLettersListCommand(args *adminArgs) *cobra.Command {
+	var channelID string
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List dead letters",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			client, err := newAdminClient(args)
+			if err != nil {
+				return err
+			}
+			query := url.Values{}
+			if channelID != "" {
+				query.Set("channel_id", channelID)
+			}
+			var list []*tunnel.DeadLetter
+			if err := client.do(cmd.Context(), http.MethodGet, "/admin/deadletters", query, &list); err != nil {
+				return err
+			}
+			return args.print(cmd.OutOrStdout(), list, func(tw *tabwriter.Writer) {
+				fmt.Fprintln(tw, "ID\tCHANNEL\tREASON\tSTATUS\tMETHOD\tPATH\tATTEMPTS\tCREATED") //nolint: errcheck
+				for _, dl := range list {
+					fmt.Fprintf( //nolint: errcheck
+						tw, "%s\t%s\t%s\t%d\t%s\t%s\t%d\t%s\n",
+						dl.ID, dl.ChannelID, dl.Reason, dl.Status, dl.Method, dl.Path, dl.Attempts, formatTime(&dl.CreatedAt),
+					)
+				}
+			})
+		},
+	}
+	cmd.Flags().StringVar(&channelID, "channel-id", "", "only list the dead letters of the channel")
+	return cmd
+}
+
+func deadLettersShowCommand(args *adminArgs) *cobra.Command {
+	return &cobra.Command{
+		Use:   "show <id>",
+		Short: "Show a dead letter with its request",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, ids []string) error {
+			client, err := newAdminClient(args)
+			if err != nil {
+				return err
+			}
+			var dl tunnel.DeadLetter
+			if err := client.do(cmd.Context(), http.MethodGet, "/admin/deadletters/"+url.PathEscape(ids[0]), nil, &dl); err != nil {
+				return err
+			}
+			if args.output == outputJSON {
+				return args.print(cmd.OutOrStdout(), &dl, nil)
+			}
+			printDeadLetter(cmd.OutOrStdout(), &dl)
+			return nil
+		},
+	}
+}
+
+func printDeadLetter(w io.Writer, dl *tunnel.DeadLetter) {
+	fmt.Fprintf(w, "ID:        %s\n", dl.ID)                     //nolint: errcheck
+	fmt.Fprintf(w, "Channel:   %s\n", dl.ChannelID)              //nolint: errcheck
+	fmt.Fprintf(w, "Reason:    %s\n", dl.Reason)                 //nolint: errcheck
+	fmt.Fprintf(w, "Status:    %d\n", dl.Status)                 //nolint: errcheck
+	fmt.Fprintf(w, "Error:     %s\n", dl.Error)                  //nolint: errcheck
+	fmt.Fprintf(w, "Attempts:  %d\n", dl.Attempts)               //nolint: errcheck
+	fmt.Fprintf(w, "Created:   %s\n", formatTime(&dl.CreatedAt)) //nolint: errcheck
+	fmt.Fprintf(w, "Updated:   %s\n", formatTime(&dl.UpdatedAt)) //nolint: errcheck
+	fmt.Fprintln(w)                                              //nolint: errcheck
+	target := dl.Path
+	if dl.RawQuery != "" {
+		target += "?" + dl.RawQuery
+	}
+	fmt.Fprintf(w, "%s %s\n", dl.Method, target) //nolint: errcheck
+	fmt.Fprintf(w, "Host: %s\n", dl.Host)        //nolint: errcheck
+	_ = dl.Header.Write(w)                       //nolint: errcheck
+	fmt.Fprintln(w)                              //nolint: errcheck
+	_, _ = w.Write(dl.Body)                      //nolint: errcheck
+	if len(dl.Body) > 0 && dl.Body[len(dl.Body)-1] != '\n' {
+		fmt.Fprintln(w) //nolint: errcheck
+	}
+}
+
+func deadLettersRedeliverCommand(args *adminArgs) *cobra.Command {
+	var (
+		all       bool
+		channelID string
+		to        string
+	)
+	cmd := &cobra.Command{
+		Use:   "redeliver [<id>...]",
+		Short: "Redeliver dead letters to their channel, or to the channel given by --to",
+		RunE: func(cmd *cobra.Command, ids []string) error {
+			if all == (len(ids) > 0) {
+				return errors.New("specify dead letter ids or --all")
+			}
+			client, err := newAdminClient(args)
+			if err != nil {
+				return err
+			}
+			results, err := redeliverDeadLetters(cmd.Context(), client, ids, channelID, to)
+			if err != nil {
+				return err
+			}
+			failed := 0
+			for _, result := range results {
+				if result.Error != "" {
+					failed++
+				}
+			}
+			err = args.print(cmd.OutOrStdout(), results, func(tw *tabwriter.Writer) {
+				fmt.Fprintln(tw, "ID\tRESULT\tSTATUS\tERROR") //nolint: errcheck
+				for _, result := range results {
+					state := "delivered"
+					if result.Error != "" {
+						state = "failed"
+					}
+					fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", result.ID, state, result.Status, result.Error) //nolint: errcheck
+				}
+			})
+			if err != nil {
+				return err
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d dead letters could not be redelivered", failed, len(results))
+			}
+			return nil
+		},
+	}
+	flag := cmd.Flags()
+	flag.BoolVar(&all, "all", false, "redeliver every dead letter (of --channel-id if given)")
+	flag.StringVar(&channelID, "channel-id", "", "with --all, only redeliver the dead letters of the channel")
+	flag.StringVar(&to, "to", "", "channel to redeliver to, e.g. the channel issued after the client reconnected")
+	return cmd
+}
+
+func redeliverDeadLetters(ctx context.Context, client *adminClient, ids []string, channelID, to string) ([]tunnel.RedeliveryResult, error) {
+	query := url.Values{}
+	if to != "" {
+		query.Set("to", to)
+	}
+	if len(ids) == 0 {
+		if channelID != "" {
+			query.Set("channel_id", channelID)
+		}
+		var results []tunnel.RedeliveryResult
+		err := client.do(ctx, http.MethodPost, "/admin/deadletters/redeliver", query, &results)
+		return results, err
+	}
+	results := make([]tunnel.RedeliveryResult, 0, len(ids))
+	for _, id := range ids {
+		var result tunnel.RedeliveryResult
+		path := "/admin/deadletters/" + url.PathEscape(id) + "/redeliver"
+		// 502 carries the result of a failed delivery.
+		if err := client.do(ctx, http.MethodPost, path, query, &result, http.StatusBadGateway); err != nil {
+			result = tunnel.RedeliveryResult{ID: id, Error: err.Error()}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func deadLettersDeleteCommand(args *adminArgs) *cobra.Command {
+	return &cobra.Command{
+		Use:   "delete <id>...",
+		Short: "Delete dead letters",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, ids []string) error {
+			client, err := newAdminClient(args)
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				if err := client.do(cmd.Context(), http.MethodDelete, "/admin/deadletters/"+url.PathEscape(id), nil, nil); err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%s\tdeleted\n", id) //nolint: errcheck
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/goccy/go-yaml"
+)
+
+const (
+	// profileEnv selects the profile when --profile is not given.
+	profileEnv             = "WEBHOOK_PROFILE"
+	defaultProfileName     = "default"
+	defaultProfileFileHint = "$XDG_CONFIG_HOME/webhook-over-websocket/profiles.yaml"
+)
+
+// profile holds the connection settings of a server for the admin commands.
+type profile struct {
+	ServerURL  string `yaml:"server_url"`
+	AdminToken string `yaml:"admin_token"`
+	CACert     string `yaml:"ca_cert"`
+	Insecure   bool   `yaml:"insecure"`
+}
+
+// profileFile is a YAML file of named profiles, e.g.
+//
+//	default: production
+//	profiles:
+//	  production:
+//	    server_url: https://webhook.example.com
+//	    admin_token: change-me
+type profileFile struct {
+	Default  string             `yaml:"default"`
+	Profiles map[string]profile `yaml:"profiles"`
+}
+
+func defaultProfilePath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "webhook-over-websocket", "profiles.yaml"), nil
+}
+
+// loadProfile returns the profile name from path. Without an explicit path or name, a missing file yields an empty profile.
+func loadProfile(path, name string) (profile, error) {
+	explicit := path != "" || name != "" || os.Getenv(profileEnv) != ""
+	if path == "" {
+		var err error
+		if path, err = defaultProfilePath(); err != nil {
+			if explicit {
+				return profile{}, err
+			}
+			return profile{}, nil
+		}
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) && !explicit {
+			return profile{}, nil
+		}
+		return profile{}, fmt.Errorf("failed to read profile file: %w", err)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0o077 != 0 {
+		slog.Warn("The profile file is accessible by other users; restrict it with chmod 600", slog.String("path", path))
+	}
+	var file profileFile
+	if err := yaml.UnmarshalWithOptions(buf, &file, yaml.Strict()); err != nil {
+		return profile{}, fmt.Errorf("invalid profile file %s: %w", path, err)
+	}
+	name = cmp.Or(name, os.Getenv(profileEnv), file.Default, defaultProfileName)
+	p, ok := file.Profiles[name]
+	if !ok {
+		if !explicit && name == defaultProfileName {
+			return profile{}, nil
+		}
+		return profile{}, fmt.Errorf("profile %q not found in %s", name, path)
+	}
+	return p, nil
+}
@@ -12,5 +12,9 @@ func rootCommand() *cobra.Command {
 	cmd.AddCommand(serverCommand())
 	cmd.AddCommand(clientCommand())
 	cmd.AddCommand(echoCommand())
+	cmd.AddCommand(deadLettersCommand())
+	cmd.AddCommand(channelsCommand())
+	cmd.AddCommand(statusCommand())
+	cmd.AddCommand(clusterCommand())
 	return cmd
 }
@@ -1,55 +1,87 @@
 package cmd
 
 import (
-	"bufio"
-	"bytes"
+	"cmp"
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"os"
 	"os/signal"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
-	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
+	"github.com/hashicorp/memberlist"
 	"github.com/nonchan7720/webhook-over-websocket/pkg/cluster"
+	"github.com/nonchan7720/webhook-over-websocket/pkg/expr"
+	"github.com/nonchan7720/webhook-over-websocket/pkg/ipfilter"
 	"github.com/nonchan7720/webhook-over-websocket/pkg/middlewares"
-	"github.com/nonchan7720/webhook-over-websocket/pkg/traefik"
+	"github.com/nonchan7720/webhook-over-websocket/pkg/tlsconfig"
+	"github.com/nonchan7720/webhook-over-websocket/pkg/tunnel"
 	"github.com/nonchan7720/webhook-over-websocket/pkg/utils"
 	"github.com/spf13/cobra"
 )
 
-var (
-	activeChannels   map[string]*ClientConn
-	activeChannelsMu sync.RWMutex
-
-	pendingRequests map[string]chan []byte
-	pendingMu       sync.RWMutex
-
-	upgrader websocket.Upgrader
-
-	myIP string
+const (
+	// clusterSecretEnv and gossipKeyEnv are read when the flags are not given, so that the secrets do not show up in the process list.
+	clusterSecretEnv = "WEBHOOK_CLUSTER_SECRET"
+	gossipKeyEnv     = "WEBHOOK_GOSSIP_KEY"
 )
 
 type serverArgs struct {
-	port       int
-	peerDomain string
+	port         int
+	peerDomain   string
+	peerSRV      string
+	joinAddrs    []string
+	peersFile    string
+	peersReload  time.Duration
+	k8sEndpoints string
 
 	cleanupDuration        time.Duration
+	drainTimeout           time.Duration
 	memberListPort         int
 	memberlistSyncDuration time.Duration
 
+	gossipKeys          []string
+	gossipKeyringFile   string
+	gossipKeyringReload time.Duration
+	clusterSecret       string
+	peerCert            string
+	peerKey             string
+	peerCACert          string
+	peerIdentities      []string
+	internalPort        int
+
 	logLevel  string
 	logFormat string
+
+	allowCIDRs     []string
+	trustedProxies []string
+	ipPresetsFile  string
+
+	dedupKey string
+	dedupTTL time.Duration
+
+	filters      []string
+	filterExprs  []string
+	filterStatus int
+	filterBody   string
+
+	maxDeadLetters int
+	adminToken     string
+
+	tlsCert           string
+	tlsKey            string
+	clientCACert      string
+	clientAuth        string
+	clientAuthSet     bool
+	requireClientCert bool
+	tlsReloadInterval time.Duration
+	disableHTTP2      bool
 }
 
 func serverCommand() *cobra.Command {
@@ -57,12 +89,6 @@ func serverCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use: "server",
 		PreRunE: func(cmd *cobra.Command, _ []string) error {
-			myIP = getLocalIP()
-			activeChannels = make(map[string]*ClientConn)
-			pendingRequests = make(map[string]chan []byte)
-			upgrader = websocket.Upgrader{
-				CheckOrigin: func(r *http.Request) bool { return true },
-			}
 			level, err := utils.ParseLevel(args.logLevel)
 			if err != nil {
 				return err
@@ -96,17 +122,101 @@ func serverCommand() *cobra.Command {
 			return nil
 		},
 		RunE: func(cmd *cobra.Command, _ []string) error {
+			args.clientAuthSet = cmd.Flags().Changed("client-auth")
 			return executeServer(cmd.Context(), &args)
 		},
 	}
 	flag := cmd.Flags()
 	flag.IntVarP(&args.port, "port", "p", 8080, "server port")
 	flag.StringVar(&args.peerDomain, "peer-domain", "", "peer domain name")
+	flag.StringVar(&args.peerSRV, "peer-srv", "", "DNS SRV name that lists the memberlist address and port of the peers")
+	flag.StringSliceVar(&args.joinAddrs, "join", nil, "memberlist addresses of the peers to join (host or host:port)")
+	flag.StringVar(&args.peersFile, "peers-file", "", "file of memberlist addresses of the peers, one per line; reloaded on change")
+	flag.DurationVar(&args.peersReload, "peers-file-reload-interval", 5*time.Second, "interval to check the peers file for changes")
+	flag.StringVar(
+		&args.k8sEndpoints,
+		"k8s-endpoints",
+		"",
+		"Kubernetes Endpoints ([namespace/]name) watched for peers with the service account of the pod",
+	)
 	flag.DurationVar(&args.cleanupDuration, "cleanup-duration", 5*time.Minute, "channel_id cleanup duration")
+	flag.DurationVar(
+		&args.drainTimeout,
+		"drain-timeout",
+		30*time.Second,
+		"on shutdown, how long clients get to move to other servers and webhooks in flight get to complete",
+	)
 	flag.IntVar(&args.memberListPort, "memberlist-port", 7946, "memberlist port(gossip protocol)")
 	flag.DurationVar(&args.memberlistSyncDuration, "memberlist-sync-duration", 5*time.Second, "channel_id cleanup duration")
+	flag.StringArrayVar(
+		&args.gossipKeys,
+		"gossip-key",
+		nil,
+		"base64 key of 16, 24 or 32 bytes that encrypts the gossip (default $"+gossipKeyEnv+"); repeatable, the first one encrypts",
+	)
+	flag.StringVar(&args.gossipKeyringFile, "gossip-keyring-file", "", "file of gossip keys, one per line with the encrypting key first; reloaded on change")
+	flag.DurationVar(&args.gossipKeyringReload, "gossip-keyring-reload-interval", 10*time.Second, "interval to check the gossip keyring file for changes")
+	flag.StringVar(
+		&args.clusterSecret,
+		"cluster-secret",
+		"",
+		"secret shared by the servers to authenticate requests between them (default $"+clusterSecretEnv+"); requires --gossip-key, and --peer-ca-cert with TLS",
+	)
+	flag.StringVar(&args.peerCert, "peer-cert", "", "client certificate file presented to peers")
+	flag.StringVar(&args.peerKey, "peer-key", "", "client private key file presented to peers")
+	flag.StringVar(&args.peerCACert, "peer-ca-cert", "", "CA certificate file used to verify the serving certificates of peers")
+	flag.StringSliceVar(
+		&args.peerIdentities,
+		"peer-identity",
+		nil,
+		"identities of the client certificates accepted from peers; requires --client-ca-cert and --gossip-key",
+	)
+	flag.IntVar(&args.internalPort, "internal-port", 0, "serve /traefik-config and /internal/channels on this port instead of --port")
 	flag.StringVar(&args.logLevel, "log-level", "INFO", "log level")
 	flag.StringVar(&args.logFormat, "log-format", "text", "log format")
+	flag.StringSliceVar(
+		&args.allowCIDRs,
+		"allow-cidr",
+		nil,
+		"default source IP allowlist for /webhook (CIDR, IP or preset:<name>). Used when a channel has no allowlist of its own",
+	)
+	flag.StringSliceVar(&args.trustedProxies, "trusted-proxies", nil, "CIDRs of proxies (e.g. Traefik) whose X-Forwarded-For is trusted")
+	flag.StringVar(&args.ipPresetsFile, "ip-presets-file", "", "YAML file of IP range presets that overrides the built-in ones (github, stripe)")
+	flag.StringVar(&args.dedupKey, "dedup-key", "", "default idempotency key to deduplicate webhooks (header:<name> or json:<field>)")
+	flag.DurationVar(&args.dedupTTL, "dedup-ttl", time.Hour, "how long the response of the first delivery is replayed to duplicates")
+	flag.StringArrayVar(
+		&args.filters,
+		"filter",
+		nil,
+		"default rule for channels without their own filter, e.g. header:X-GitHub-Event=push (repeatable, all must match)",
+	)
+	flag.StringArrayVar(
+		&args.filterExprs,
+		"filter-expr",
+		nil,
+		`default CEL expression for channels without their own filter, e.g. headers["x-github-event"] == "push" (repeatable)`,
+	)
+	flag.IntVar(&args.filterStatus, "filter-status", http.StatusAccepted, "status returned for filtered webhooks")
+	flag.StringVar(&args.filterBody, "filter-body", "", "body returned for filtered webhooks")
+	flag.IntVar(
+		&args.maxDeadLetters,
+		"max-dead-letters",
+		tunnel.DefaultMaxDeadLetters,
+		"webhooks that failed delivery kept for inspection and redelivery; the oldest are dropped first (0 disables)",
+	)
+	flag.StringVar(&args.adminToken, "admin-token", "", "bearer token for the /admin API (default $"+adminTokenEnv+"); the API is disabled without it")
+	flag.StringVar(&args.tlsCert, "tls-cert", "", "TLS certificate file. Serves HTTPS when set together with --tls-key")
+	flag.StringVar(&args.tlsKey, "tls-key", "", "TLS private key file")
+	flag.StringVar(&args.clientCACert, "client-ca-cert", "", "CA certificate file used to verify client certificates")
+	flag.StringVar(
+		&args.clientAuth,
+		"client-auth",
+		"verify-if-given",
+		"client certificate policy (none|verify-if-given|require-and-verify); requires --client-ca-cert",
+	)
+	flag.BoolVar(&args.requireClientCert, "require-client-cert", false, "require a verified client certificate on /new and /ws")
+	flag.DurationVar(&args.tlsReloadInterval, "tls-reload-interval", 10*time.Second, "interval to check the TLS certificate files for changes")
+	flag.BoolVar(&args.disableHTTP2, "disable-http2", false, "serve HTTP/1.1 only")
 	return cmd
 }
 
@@ -114,38 +224,115 @@ func executeServer(ctx context.Context, args *serverArgs) error {
 	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGTERM, syscall.SIGINT)
 	defer cancel()
 
-	mlist, err := cluster.SetUp(args.memberListPort, myIP)
+	presets, err := ipfilter.LoadPresets(args.ipPresetsFile)
+	if err != nil {
+		return err
+	}
+	// Validate the default allowlist at startup instead of on the first /new call.
+	if _, err := ipfilter.NewAllowlist(args.allowCIDRs, presets); err != nil {
+		return err
+	}
+	ipResolver, err := ipfilter.NewClientIPResolver(args.trustedProxies)
+	if err != nil {
+		return err
+	}
+	var dedupKey *tunnel.DedupKey
+	if args.dedupKey != "" {
+		if dedupKey, err = tunnel.ParseDedupKey(args.dedupKey); err != nil {
+			return err
+		}
+	}
+	filters := make([]*tunnel.FilterRule, 0, len(args.filters))
+	for _, v := range args.filters {
+		rule, err := tunnel.ParseFilterRule(v)
+		if err != nil {
+			return err
+		}
+		filters = append(filters, rule)
+	}
+	filterExprs := make([]*expr.Program, 0, len(args.filterExprs))
+	for _, v := range args.filterExprs {
+		p, err := expr.Compile(v)
+		if err != nil {
+			return err
+		}
+		filterExprs = append(filterExprs, p)
+	}
+	tlsConfig, certReloader, err := newServerTLSConfig(args)
+	if err != nil {
+		return err
+	}
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+		go certReloader.Watch(ctx, args.tlsReloadInterval)
+	}
+
+	keyring, keyringReloader, err := newGossipKeyring(args)
+	if err != nil {
+		return err
+	}
+	if keyringReloader != nil {
+		go keyringReloader.Watch(ctx, args.gossipKeyringReload)
+	}
+	peerClient, err := newPeerClient(tlsConfig, args)
 	if err != nil {
 		return err
 	}
-	mlist.Start(ctx, args.peerDomain, args.memberlistSyncDuration)
+	if len(args.peerIdentities) > 0 && args.clientCACert == "" {
+		return errors.New("--peer-identity requires --client-ca-cert")
+	}
+	clusterSecret := cmp.Or(args.clusterSecret, os.Getenv(clusterSecretEnv))
+	// Peer URLs are taken from the gossip, so anyone who can join an unencrypted one could pose as a peer
+	// and be sent the secret, forwarded webhooks and admin requests.
+	if (clusterSecret != "" || len(args.peerIdentities) > 0) && keyring == nil {
+		return errors.New("--cluster-secret and --peer-identity require --gossip-key or --gossip-keyring-file")
+	}
+	if clusterSecret != "" && tlsConfig != nil && args.peerCACert == "" {
+		return errors.New("--cluster-secret requires --peer-ca-cert with TLS, so that the secret is only sent to verified peers")
+	}
 
-	handler := &serverHandle{
-		peerDomain:  args.peerDomain,
-		myServerURL: fmt.Sprintf("http://%s:%d", myIP, args.port),
-		port:        args.port,
-		mlist:       mlist,
+	myIP := getLocalIP()
+	serverURL := fmt.Sprintf("%s://%s:%d", scheme, myIP, args.port)
+	mlist, err := cluster.SetUp(args.memberListPort, myIP, serverURL, keyring)
+	if err != nil {
+		return err
+	}
+	discoverers, err := newDiscoverers(args)
+	if err != nil {
+		return err
 	}
+	mlist.Start(ctx, args.memberlistSyncDuration, discoverers...)
+
+	adminToken := args.adminToken
+	if adminToken == "" {
+		adminToken = os.Getenv(adminTokenEnv)
+	}
+	var deadLetters tunnel.DeadLetterStore
+	if args.maxDeadLetters > 0 {
+		deadLetters = tunnel.NewMemoryDeadLetterStore(args.maxDeadLetters)
+	}
+
+	server := tunnel.NewServer(
+		tunnel.WithServerURL(serverURL),
+		tunnel.WithVersion(Version),
+		tunnel.WithCluster(mlist, scheme, args.port, peerClient),
+		tunnel.WithClusterSecret(clusterSecret),
+		tunnel.WithPeerIdentities(args.peerIdentities...),
+		tunnel.WithSeparateInternalEndpoints(args.internalPort > 0),
+		tunnel.WithIPAllowlist(presets, args.allowCIDRs),
+		tunnel.WithClientIPResolver(ipResolver),
+		tunnel.WithRequireClientCert(args.requireClientCert),
+		tunnel.WithDefaultDedup(dedupKey, args.dedupTTL),
+		tunnel.WithDefaultFilter(filters, filterExprs, args.filterStatus, args.filterBody),
+		tunnel.WithDeadLetters(deadLetters),
+		tunnel.WithAdminToken(adminToken),
+	)
 
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", args.port))
 	if err != nil {
 		return err
 	}
-	mux := http.NewServeMux()
-	// Endpoint for clients to generate channelId upon startup
-	mux.HandleFunc("/new", handler.handleNewChannel)
-	// The HTTP Provider in Traefik periodically checks the configuration output endpoint.
-	mux.HandleFunc("/traefik-config", handler.handleTraefikConfig)
-	// Internal endpoint for peers to share information (additional)
-	mux.HandleFunc("/internal/channels", handler.handleInternalChannels)
-	// Waiting for WebSocket connections from clients
-	mux.HandleFunc("/ws/{channelId}", handler.handleWebSocket)
-	// External webhook reception point via Traefik
-	mux.HandleFunc("/webhook/", handler.handleWebhook)
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte(`{"status":"OK"}`)) //nolint:errcheck
-	})
 	skipper := func(r *http.Request) bool {
 		switch r.URL.Path {
 		case "/healthz":
@@ -159,359 +346,171 @@ func executeServer(ctx context.Context, args *serverArgs) error {
 		}
 	}
 	srv := http.Server{
-		Handler:           middlewares.Logging(skipper)(mux),
+		Handler:           middlewares.Logging(skipper)(server),
 		ReadHeaderTimeout: 20 * time.Second,
+		TLSConfig:         tlsConfig,
+		Protocols:         serverProtocols(tlsConfig != nil && !args.disableHTTP2),
 	}
-	slog.Info(fmt.Sprintf("Server listening on :%d", args.port))
-	go func() {
-		if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			slog.Warn("failed to run server", slog.String("error", err.Error()))
+	var internalSrv *http.Server
+	if args.internalPort > 0 {
+		internalLis, err := net.Listen("tcp", fmt.Sprintf(":%d", args.internalPort))
+		if err != nil {
+			return err
 		}
-	}()
-	go func() {
-		ticker := time.NewTicker(args.cleanupDuration)
-		select {
-		case <-ticker.C:
-			cleanNonActiveSession()
-		case <-ctx.Done():
-			return
+		internalSrv = &http.Server{
+			Handler:           middlewares.Logging(skipper)(server.InternalHandler()),
+			ReadHeaderTimeout: 20 * time.Second,
+			TLSConfig:         tlsConfig,
 		}
-	}()
+		slog.Info(fmt.Sprintf("Internal endpoints listening on :%d (%s)", args.internalPort, scheme))
+		go serve(internalSrv, internalLis)
+	}
+	slog.Info(fmt.Sprintf("Server listening on :%d (%s)", args.port, scheme))
+	go serve(&srv, lis)
+	go server.RunCleanup(ctx, args.cleanupDuration)
 
 	<-ctx.Done()
+	// Hijacked WebSockets are not closed by Shutdown, so the clients are moved away first.
+	dCtx, cancelDrain := context.WithTimeout(context.Background(), args.drainTimeout)
+	server.Drain(dCtx)
+	cancelDrain()
+	defer mlist.Shutdown() //nolint: errcheck
 	tCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	slog.InfoContext(tCtx, "Stop server")
 	defer cancel()
+	if internalSrv != nil {
+		_ = internalSrv.Shutdown(tCtx) //nolint: errcheck
+	}
 	return srv.Shutdown(tCtx)
 }
 
-type TunnelMessage struct {
-	ReqID   string `json:"req_id"`
-	Payload []byte `json:"payload"`
-}
-
-type ClientConn struct {
-	wsConn *websocket.Conn
-	mu     sync.Mutex // WebSocketの同時書き込みを防ぐため
-}
-
-func (c *ClientConn) isActive() bool {
-	return c.wsConn != nil
-}
-
-func (h *serverHandle) handleNewChannel(w http.ResponseWriter, r *http.Request) {
-	channelID := uuid.New().String()
-	clientConn := &ClientConn{wsConn: nil}
-	activeChannelsMu.Lock()
-	activeChannels[channelID] = clientConn
-	activeChannelsMu.Unlock()
-	resp := map[string]string{"channel_id": channelID}
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(resp) //nolint: errcheck,errchkjson
-	slog.Info("new Channel ID has been issued", slog.String("channel-id", channelID))
-}
-
-type InternalChannelsResp struct {
-	WsChannels      []string `json:"ws_channels"`
-	WebhookChannels []string `json:"webhook_channels"`
-	ServerURL       string   `json:"server_url"`
-}
-
-type serverHandle struct {
-	myServerURL string
-	peerDomain  string
-	port        int
-
-	mlist *cluster.Memberlist
-}
-
-func (h *serverHandle) handleInternalChannels(w http.ResponseWriter, r *http.Request) {
-	var wsChannels []string
-	var webhookChannels []string
-
-	activeChannelsMu.RLock()
-	for id, client := range activeChannels {
-		// WS用のルーターは未接続（発行済み）でも作成する
-		wsChannels = append(wsChannels, id)
-		// Webhook用のルーターは実際に接続済み（isActive）の時のみ作成する
-		if client.isActive() {
-			webhookChannels = append(webhookChannels, id)
-		}
+// serve runs srv on lis, with TLS when srv has a TLS configuration, until it is shut down.
+func serve(srv *http.Server, lis net.Listener) {
+	serve := srv.Serve
+	if srv.TLSConfig != nil {
+		serve = func(l net.Listener) error { return srv.ServeTLS(l, "", "") }
+	}
+	if err := serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Warn("failed to run server", slog.String("error", err.Error()))
 	}
-	activeChannelsMu.RUnlock()
-
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(&InternalChannelsResp{ //nolint: errcheck,errchkjson
-		WsChannels:      wsChannels,
-		WebhookChannels: webhookChannels,
-		ServerURL:       h.myServerURL,
-	})
 }
 
-func (h *serverHandle) handleTraefikConfig(w http.ResponseWriter, r *http.Request) { //nolint: gocognit
-	config := traefik.Config{
-		HTTP: traefik.HTTPConfig{
-			Routers:  make(map[string]traefik.RouterConfig),
-			Services: make(map[string]traefik.ServiceConfig),
-		},
+func newServerTLSConfig(args *serverArgs) (*tls.Config, *tlsconfig.CertReloader, error) {
+	if args.tlsCert == "" && args.tlsKey == "" {
+		if args.clientCACert != "" || args.requireClientCert {
+			return nil, nil, errors.New("client certificate verification requires --tls-cert and --tls-key")
+		}
+		return nil, nil, nil
 	}
-
-	allChannels := make(map[string]InternalChannelsResp) // key: ServerURL
-
-	// First, obtain your own information.
-	var myWsChannels []string
-	var myWebhookChannels []string
-
-	activeChannelsMu.RLock()
-	for id, client := range activeChannels {
-		myWsChannels = append(myWsChannels, id) // All WS items are added.
-		if client.isActive() {
-			myWebhookChannels = append(myWebhookChannels, id) // For webhooks, add only while connected
+	clientAuth := tls.NoClientCert
+	if args.clientCACert != "" {
+		var err error
+		if clientAuth, err = tlsconfig.ParseClientAuth(args.clientAuth); err != nil {
+			return nil, nil, err
 		}
+	} else if args.requireClientCert {
+		return nil, nil, errors.New("--require-client-cert requires --client-ca-cert")
+	} else if args.clientAuthSet {
+		return nil, nil, errors.New("--client-auth requires --client-ca-cert")
 	}
-	activeChannelsMu.RUnlock()
-
-	allChannels[h.myServerURL] = InternalChannelsResp{
-		WsChannels:      myWsChannels,
-		WebhookChannels: myWebhookChannels,
-		ServerURL:       h.myServerURL,
+	// Without verified certificates there are no identities, so every client or peer would be refused.
+	if clientAuth == tls.NoClientCert && (args.requireClientCert || len(args.peerIdentities) > 0) {
+		return nil, nil, errors.New("--require-client-cert and --peer-identity require --client-auth verify-if-given or require-and-verify")
 	}
-
-	// Gather information on "active peers" detected by memberlist
-	if nodes := h.mlist.ActiveNodesWithoutSelf(); len(nodes) > 0 { //nolint: nestif
-		var wg sync.WaitGroup
-		infoCh := make(chan InternalChannelsResp, len(nodes))
-
-		for _, node := range nodes {
-			wg.Add(1)
-			go fetchPeerChannels(
-				net.JoinHostPort(node.Addr.String(), fmt.Sprintf("%d", h.port)),
-				infoCh,
-				&wg,
-			)
-		}
-
-		wg.Wait()
-		close(infoCh)
-
-		for info := range infoCh {
-			// Since my information is the latest in memory, I won't overwrite it.
-			if info.ServerURL != h.myServerURL {
-				allChannels[info.ServerURL] = info
-			}
-		}
+	certReloader, err := tlsconfig.NewCertReloader(args.tlsCert, args.tlsKey)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	// Merge information from all nodes to create JSON for Traefik
-	for serverURL, info := range allChannels {
-		// First, create the required service definitions uniquely.
-		channelSet := make(map[string]bool)
-		for _, id := range info.WsChannels {
-			channelSet[id] = true
-		}
-		for _, id := range info.WebhookChannels {
-			channelSet[id] = true
-		}
-
-		for channelID := range channelSet {
-			serviceName := "service-" + channelID
-			config.HTTP.Services[serviceName] = traefik.ServiceConfig{
-				LoadBalancer: traefik.LoadBalancerConfig{
-					Servers: []traefik.ServerConfig{{URL: serverURL}},
-				},
-			}
-		}
-		// Webhook connection router (only for connected clients)
-		for _, channelID := range info.WebhookChannels {
-			webhookRouterName := "webhook-" + channelID
-			serviceName := "service-" + channelID
-
-			config.HTTP.Routers[webhookRouterName] = traefik.RouterConfig{
-				Rule:    fmt.Sprintf("PathPrefix(`/webhook/%s`)", channelID),
-				Service: serviceName,
-			}
-		}
-		// Router for WebSocket connections (all channels, including unconnected ones)
-		for _, channelID := range info.WsChannels {
-			wsRouterName := "ws-" + channelID
-			serviceName := "service-" + channelID
-
-			config.HTTP.Routers[wsRouterName] = traefik.RouterConfig{
-				Rule:    fmt.Sprintf("PathPrefix(`/ws/%s`)", channelID),
-				Service: serviceName,
-			}
-		}
+	tlsConfig, err := tlsconfig.NewServerConfig(certReloader, args.clientCACert, clientAuth)
+	if err != nil {
+		return nil, nil, err
 	}
+	return tlsConfig, certReloader, nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	_ = config.ToJSON(w) //nolint: errcheck,errchkjson
+// serverProtocols enables HTTP/2 for webhook senders. WebSocket clients keep using HTTP/1.1 by offering only "http/1.1" via ALPN.
+func serverProtocols(enableHTTP2 bool) *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(enableHTTP2)
+	return protocols
 }
 
-func fetchPeerChannels(hostPort string, ch chan<- InternalChannelsResp, wg *sync.WaitGroup) {
-	defer wg.Done()
-	client := http.Client{Timeout: 2 * time.Second} // Keep it brief to avoid making them wait for a response.
-	url := fmt.Sprintf("http://%s/internal/channels", hostPort)
-	resp, err := client.Get(url)
-	if err != nil {
-		// Ghost containers and similar cannot be communicated with, so they are ignored.
-		return
+func newPeerClient(tlsConfig *tls.Config, args *serverArgs) (*http.Client, error) {
+	client := &http.Client{Timeout: 2 * time.Second} // Keep it brief to avoid making them wait for a response.
+	if tlsConfig == nil {
+		if args.peerCert != "" || args.peerKey != "" || args.peerCACert != "" {
+			return nil, errors.New("peer certificates require --tls-cert and --tls-key")
+		}
+		return client, nil
 	}
-	defer resp.Body.Close() //nolint: errcheck
-
-	var info InternalChannelsResp
-	if err := json.NewDecoder(resp.Body).Decode(&info); err == nil {
-		ch <- info
+	peerTLSConfig, err := tlsconfig.NewPeerClientConfig(args.peerCACert, args.peerCert, args.peerKey)
+	if err != nil {
+		return nil, err
 	}
+	transport := http.DefaultTransport.(*http.Transport).Clone() // nolint: errcheck,forcetypeassert
+	transport.TLSClientConfig = peerTLSConfig
+	client.Transport = transport
+	return client, nil
 }
 
-func (h *serverHandle) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	channelID := r.PathValue("channelId")
-	if channelID == "" {
-		http.Error(w, "Missing channel_id", http.StatusBadRequest)
-		return
-	}
-	activeChannelsMu.RLock()
-	clientConn, exists := activeChannels[channelID]
-	activeChannelsMu.RUnlock()
-	if !exists {
-		http.Error(w, "Forbidden or invalid channel_id", http.StatusForbidden)
-		return
-	}
-
-	clientConn.mu.Lock()
-	if clientConn.isActive() {
-		clientConn.mu.Unlock()
-		http.Error(w, "Channel is already in use", http.StatusConflict)
-		return
-	}
-	// The upgrade process causes network I/O waits, so unlock it.
-	clientConn.mu.Unlock()
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		slog.ErrorContext(r.Context(), "Upgrade error", slog.String("error", err.Error()))
-		return
-	}
-	// After the upgrade succeeds, unlock it again and store it
-	// final confirmation that it hasn't been intercepted in the meantime.
-	clientConn.mu.Lock()
-	if clientConn.isActive() {
-		clientConn.mu.Unlock()
-		_ = conn.WriteMessage( //nolint: errcheck
-			websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Channel is already in use"),
-		)
-		_ = conn.Close() //nolint: errcheck
-		return
-	}
-	clientConn.wsConn = conn
-	clientConn.mu.Unlock()
-
-	slog.Info(fmt.Sprintf("Client connected: %s", channelID))
-
-	defer func() {
-		activeChannelsMu.Lock()
-		delete(activeChannels, channelID)
-		activeChannelsMu.Unlock()
-		_ = conn.Close() //nolint: errcheck
-		slog.Info(fmt.Sprintf("Client disconnected: %s", channelID))
-	}()
-
-	// Loop to receive client responses from WebSocket
-	for {
-		msgType, payload, err := conn.ReadMessage()
-		if err != nil {
-			break
+// newGossipKeyring returns the keyring of --gossip-keyring-file, with a reloader for it, or of --gossip-key.
+// It returns a nil keyring when the gossip is not encrypted.
+func newGossipKeyring(args *serverArgs) (*memberlist.Keyring, *cluster.KeyringReloader, error) {
+	gossipKeys := args.gossipKeys
+	if len(gossipKeys) == 0 {
+		if key := os.Getenv(gossipKeyEnv); key != "" {
+			gossipKeys = []string{key}
 		}
-
-		if msgType != websocket.TextMessage && msgType != websocket.BinaryMessage {
-			continue
+	}
+	if args.gossipKeyringFile != "" {
+		if len(args.gossipKeys) > 0 {
+			return nil, nil, errors.New("--gossip-key and --gossip-keyring-file are mutually exclusive")
 		}
-
-		var msg TunnelMessage
-		if err := json.Unmarshal(payload, &msg); err != nil {
-			slog.Warn("Failed to unmarshal tunnel message", slog.String("error", err.Error()))
-			continue
+		reloader, err := cluster.NewKeyringReloader(args.gossipKeyringFile)
+		if err != nil {
+			return nil, nil, err
 		}
-
-		// Pass the response to the handler waiting for the corresponding ReqID
-		pendingMu.RLock()
-		respCh, exists := pendingRequests[msg.ReqID]
-		pendingMu.RUnlock()
-
-		if exists {
-			respCh <- msg.Payload
+		return reloader.Keyring(), reloader, nil
+	}
+	keys := make([][]byte, 0, len(gossipKeys))
+	for _, v := range gossipKeys {
+		key, err := cluster.ParseKey(v)
+		if err != nil {
+			return nil, nil, err
 		}
+		keys = append(keys, key)
 	}
+	keyring, err := cluster.NewKeyring(keys)
+	return keyring, nil, err
 }
 
-func (h *serverHandle) handleWebhook(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/webhook/"), "/")
-	channelID := parts[0]
-
-	activeChannelsMu.RLock()
-	client, exists := activeChannels[channelID]
-	activeChannelsMu.RUnlock()
+const localhost = "127.0.0.1"
 
-	if !exists || client.wsConn == nil {
-		http.Error(w, "Client not connected", http.StatusNotFound)
-		return
+func newDiscoverers(args *serverArgs) ([]cluster.Discoverer, error) {
+	var discoverers []cluster.Discoverer
+	if len(args.joinAddrs) > 0 {
+		discoverers = append(discoverers, cluster.StaticDiscoverer(args.joinAddrs))
 	}
-
-	// Convert HTTP requests directly into raw byte sequences (equivalent to TCP dumps)
-	rawReqBytes, err := httputil.DumpRequest(r, true)
-	if err != nil {
-		http.Error(w, "Error dumping request", http.StatusInternalServerError)
-		return
+	if args.peerDomain != "" {
+		discoverers = append(discoverers, cluster.DNSDiscoverer{Domain: args.peerDomain})
 	}
-
-	reqID := uuid.New().String()
-	respCh := make(chan []byte)
-
-	pendingMu.Lock()
-	pendingRequests[reqID] = respCh
-	pendingMu.Unlock()
-
-	defer func() {
-		pendingMu.Lock()
-		delete(pendingRequests, reqID)
-		pendingMu.Unlock()
-	}()
-
-	msg := TunnelMessage{ReqID: reqID, Payload: rawReqBytes}
-	client.mu.Lock()
-	err = client.wsConn.WriteJSON(msg)
-	client.mu.Unlock()
-
-	if err != nil {
-		http.Error(w, "Failed to send to client", http.StatusBadGateway)
-		return
+	if args.peerSRV != "" {
+		discoverers = append(discoverers, cluster.SRVDiscoverer{Name: args.peerSRV})
 	}
-
-	// Waiting for a response from the client
-	select {
-	case rawRespBytes := <-respCh:
-		// Restore the raw byte array to an http.Response object
-		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(rawRespBytes)), r)
+	if args.peersFile != "" {
+		discoverers = append(discoverers, cluster.NewFileDiscoverer(args.peersFile, args.peersReload))
+	}
+	if args.k8sEndpoints != "" {
+		d, err := cluster.InClusterKubernetesDiscoverer(args.k8sEndpoints, args.memberListPort)
 		if err != nil {
-			http.Error(w, "Bad gateway response from client", http.StatusBadGateway)
-			return
+			return nil, fmt.Errorf("--k8s-endpoints: %w", err)
 		}
-		defer resp.Body.Close() //nolint: errcheck,errchkjson
-		for k, vv := range resp.Header {
-			for _, v := range vv {
-				w.Header().Add(k, v)
-			}
-		}
-		w.WriteHeader(resp.StatusCode)
-		_, _ = io.Copy(w, resp.Body) //nolint: errcheck
-
-	case <-time.After(30 * time.Second):
-		http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+		discoverers = append(discoverers, d)
 	}
+	return discoverers, nil
 }
 
-const localhost = "127.0.0.1"
-
 func getLocalIP() string {
 	// K8s環境: 環境変数からPod IPを取得
 	if podIP := getLocalIPFromPOD_IPEnv(); podIP != "" {
@@ -582,22 +581,3 @@ func getCandidateIP() string { //nolint: gocognit
 
 	return ""
 }
-
-func cleanNonActiveSession() {
-	activeChannelsMu.RLock() // 【修正】並行アクセス(panic)を防ぐため RLock を追加
-	nonActiveSession := make([]string, 0, len(activeChannels))
-	for id, client := range activeChannels {
-		if !client.isActive() {
-			nonActiveSession = append(nonActiveSession, id)
-		}
-	}
-	activeChannelsMu.RUnlock() // 読み取り完了後にロック解除
-	if len(nonActiveSession) == 0 {
-		return
-	}
-	activeChannelsMu.Lock()
-	defer activeChannelsMu.Unlock()
-	for _, id := range nonActiveSession {
-		delete(activeChannels, id)
-	}
-}
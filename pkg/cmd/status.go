@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"text/tabwriter"
+
+	"github.com/nonchan7720/webhook-over-websocket/pkg/tunnel"
+	"github.com/spf13/cobra"
+)
+
+func statusCommand() *cobra.Command {
+	var args adminArgs
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the status of every server in the cluster",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			client, err := newAdminClient(&args)
+			if err != nil {
+				return err
+			}
+			var statuses []tunnel.NodeStatus
+			if err := client.do(cmd.Context(), http.MethodGet, "/admin/status", nil, &statuses); err != nil {
+				return err
+			}
+			return args.print(cmd.OutOrStdout(), statuses, func(tw *tabwriter.Writer) {
+				fmt.Fprintln(tw, "NODE\tVERSION\tSTARTED\tCHANNELS\tCONNECTED\tPENDING\tDEAD LETTERS\tPEERS") //nolint: errcheck
+				for _, s := range statuses {
+					fmt.Fprintf( //nolint: errcheck
+						tw, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\n",
+						s.Node, orDash(s.Version), formatTime(&s.StartedAt), s.Channels, s.ConnectedChannels, s.PendingRequests, s.DeadLetters, len(s.Peers),
+					)
+				}
+			})
+		},
+	}
+	args.addFlags(cmd)
+	return cmd
+}
@@ -0,0 +1,116 @@
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// Payloads are sealed with an ephemeral X25519 key per message (ECIES):
+//
+//	ephemeral public key (32 bytes) || nonce (12 bytes) || AES-256-GCM ciphertext
+//
+// Only the holder of the recipient private key, i.e. the client, can open them.
+const (
+	hkdfInfo = "webhook-over-websocket e2e v1"
+	keySize  = 32
+)
+
+var (
+	ErrInvalidPayload = errors.New("invalid encrypted payload")
+)
+
+func GenerateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+func EncodePublicKey(pub *ecdh.PublicKey) string {
+	return base64.RawURLEncoding.EncodeToString(pub.Bytes())
+}
+
+func ParsePublicKey(s string) (*ecdh.PublicKey, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key encoding: %w", err)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	return pub, nil
+}
+
+// Seal encrypts plaintext for the owner of pub.
+func Seal(pub *ecdh.PublicKey, plaintext []byte) ([]byte, error) {
+	ephemeral, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(shared, ephemeral.PublicKey().Bytes(), pub.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	epk := ephemeral.PublicKey().Bytes()
+	out := make([]byte, 0, len(epk)+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	out = append(out, epk...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, epk), nil
+}
+
+// Open decrypts a payload produced by Seal.
+func Open(priv *ecdh.PrivateKey, sealed []byte) ([]byte, error) {
+	if len(sealed) < keySize {
+		return nil, ErrInvalidPayload
+	}
+	epk, rest := sealed[:keySize], sealed[keySize:]
+	ephemeral, err := ecdh.X25519().NewPublicKey(epk)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPayload, err)
+	}
+	shared, err := priv.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(shared, epk, priv.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, ErrInvalidPayload
+	}
+	nonce, ciphertext := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, epk)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPayload, err)
+	}
+	return plaintext, nil
+}
+
+func newAEAD(shared, ephemeralPub, recipientPub []byte) (cipher.AEAD, error) {
+	salt := make([]byte, 0, len(ephemeralPub)+len(recipientPub))
+	salt = append(salt, ephemeralPub...)
+	salt = append(salt, recipientPub...)
+	key, err := hkdf.Key(sha256.New, shared, salt, hkdfInfo, keySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
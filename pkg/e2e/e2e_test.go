@@ -0,0 +1,52 @@
+package e2e
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealOpen(t *testing.T) {
+	priv, err := GenerateKey()
+	require.NoError(t, err)
+	pub, err := ParsePublicKey(EncodePublicKey(priv.PublicKey()))
+	require.NoError(t, err)
+
+	plaintext := []byte("POST /webhook HTTP/1.1\r\nHost: example.com\r\n\r\n{\"secret\":true}")
+	sealed, err := Seal(pub, plaintext)
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed), "secret", "The payload should not be readable.")
+
+	opened, err := Open(priv, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, opened)
+}
+
+func TestOpen_WrongKey(t *testing.T) {
+	priv, err := GenerateKey()
+	require.NoError(t, err)
+	other, err := GenerateKey()
+	require.NoError(t, err)
+
+	sealed, err := Seal(priv.PublicKey(), []byte("payload"))
+	require.NoError(t, err)
+
+	_, err = Open(other, sealed)
+	assert.ErrorIs(t, err, ErrInvalidPayload, "Another key should not be able to open the payload.")
+}
+
+func TestOpen_Tampered(t *testing.T) {
+	priv, err := GenerateKey()
+	require.NoError(t, err)
+
+	sealed, err := Seal(priv.PublicKey(), []byte("payload"))
+	require.NoError(t, err)
+	sealed[len(sealed)-1] ^= 0xff
+
+	_, err = Open(priv, sealed)
+	assert.ErrorIs(t, err, ErrInvalidPayload, "Tampered payloads should be rejected.")
+
+	_, err = Open(priv, sealed[:10])
+	assert.ErrorIs(t, err, ErrInvalidPayload, "Truncated payloads should be rejected.")
+}
@@ -0,0 +1,149 @@
+// Package expr evaluates CEL (https://cel.dev) expressions against webhook requests.
+//
+// Expressions see the following variables:
+//
+//	method   string               the HTTP method, e.g. "POST"
+//	path     string               the path relative to the channel, e.g. "/github/events"
+//	host     string               the Host header
+//	headers  map(string, string)  headers by lower-case name; multiple values are joined with ", "
+//	query    map(string, string)  query parameters; the first value of each
+//	body     dyn                  the JSON-decoded body, or null when it is not JSON
+//
+// For example:
+//
+//	headers["x-github-event"] in ["push", "pull_request"] && body.action != "deleted"
+package expr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+)
+
+// costLimit bounds the evaluation cost of an expression, so that a single webhook cannot stall the caller.
+const costLimit = 1_000_000
+
+var (
+	ErrInvalidExpression = errors.New("invalid expression")
+
+	env = mustNewEnv()
+)
+
+func mustNewEnv() *cel.Env {
+	e, err := cel.NewEnv(
+		cel.Variable("method", cel.StringType),
+		cel.Variable("path", cel.StringType),
+		cel.Variable("host", cel.StringType),
+		cel.Variable("headers", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("query", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("body", cel.DynType),
+	)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// Program is a compiled boolean expression.
+type Program struct {
+	src string
+	prg cel.Program
+}
+
+// Compile parses and type-checks src, which must evaluate to a bool.
+func Compile(src string) (*Program, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, fmt.Errorf("%w: empty expression", ErrInvalidExpression)
+	}
+	ast, iss := env.Compile(src)
+	if iss.Err() != nil {
+		return nil, fmt.Errorf("%w %q:\n%s", ErrInvalidExpression, src, iss.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("%w %q: must evaluate to bool, got %s", ErrInvalidExpression, src, ast.OutputType())
+	}
+	prg, err := env.Program(ast, cel.CostLimit(costLimit))
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %w", ErrInvalidExpression, src, err)
+	}
+	return &Program{src: src, prg: prg}, nil
+}
+
+func (p *Program) String() string {
+	return p.src
+}
+
+// Match evaluates p against req. Evaluation errors, such as accessing a missing body field
+// without has(), are returned with a false result.
+func (p *Program) Match(req *Request) (bool, error) {
+	out, _, err := p.prg.Eval(req.activation())
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate %q: %w", p.src, err)
+	}
+	matched, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("failed to evaluate %q: not a bool: %v", p.src, out.Value())
+	}
+	return matched, nil
+}
+
+// Request is the model expressions are evaluated against.
+type Request struct {
+	Method string
+	Path   string
+	Host   string
+	Header http.Header
+	Query  url.Values
+	Body   []byte
+
+	vars map[string]any
+}
+
+// NewRequest returns the model of r. path is the path relative to the channel, and body is the buffered body of r.
+func NewRequest(r *http.Request, path string, body []byte) *Request {
+	return &Request{
+		Method: r.Method,
+		Path:   path,
+		Host:   r.Host,
+		Header: r.Header,
+		Query:  r.URL.Query(),
+		Body:   body,
+	}
+}
+
+// activation builds the variables once, so that several expressions can share the decoded body.
+func (req *Request) activation() map[string]any {
+	if req.vars != nil {
+		return req.vars
+	}
+	headers := make(map[string]string, len(req.Header))
+	for k, vv := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(vv, ", ")
+	}
+	query := make(map[string]string, len(req.Query))
+	for k, vv := range req.Query {
+		if len(vv) > 0 {
+			query[k] = vv[0]
+		}
+	}
+	var body any
+	if len(req.Body) > 0 {
+		if err := json.Unmarshal(req.Body, &body); err != nil {
+			body = nil
+		}
+	}
+	req.vars = map[string]any{
+		"method":  req.Method,
+		"path":    req.Path,
+		"host":    req.Host,
+		"headers": headers,
+		"query":   query,
+		"body":    body,
+	}
+	return req.vars
+}
@@ -0,0 +1,67 @@
+package expr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRequest(t *testing.T, body string) *Request {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/webhook/ch/github/events?delivery=1", strings.NewReader(body))
+	r.Header.Set("X-GitHub-Event", "pull_request")
+	return NewRequest(r, "/github/events", []byte(body))
+}
+
+func TestProgram_Match(t *testing.T) {
+	req := newRequest(t, `{"action":"opened","number":42,"pull_request":{"draft":false,"labels":["bug"]}}`)
+
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{src: `method == "POST"`, want: true},
+		{src: `path.startsWith("/github/")`, want: true},
+		{src: `host == "example.com"`, want: true},
+		{src: `headers["x-github-event"] in ["push", "pull_request"]`, want: true},
+		{src: `query["delivery"] == "1"`, want: true},
+		{src: `body.action == "opened" && body.number == 42`, want: true},
+		{src: `!body.pull_request.draft && "bug" in body.pull_request.labels`, want: true},
+		{src: `has(body.sender) && body.sender.login == "octocat"`, want: false},
+		{src: `body.action.matches("^(closed|deleted)$")`, want: false},
+	}
+	for _, tt := range tests {
+		p, err := Compile(tt.src)
+		require.NoError(t, err, tt.src)
+		got, err := p.Match(req)
+		require.NoError(t, err, tt.src)
+		assert.Equal(t, tt.want, got, tt.src)
+	}
+}
+
+func TestProgram_NonJSONBody(t *testing.T) {
+	p, err := Compile(`body == null`)
+	require.NoError(t, err)
+	got, err := p.Match(newRequest(t, "payload=1"))
+	require.NoError(t, err)
+	assert.True(t, got, "A body that is not JSON should be null.")
+}
+
+func TestCompile_Errors(t *testing.T) {
+	for _, src := range []string{``, `method ==`, `method`, `unknown == "x"`, `path + 1`} {
+		_, err := Compile(src)
+		assert.ErrorIs(t, err, ErrInvalidExpression, "%q should be rejected at compile time.", src)
+	}
+}
+
+func TestProgram_EvaluationError(t *testing.T) {
+	p, err := Compile(`body.missing == "x"`)
+	require.NoError(t, err)
+	got, err := p.Match(newRequest(t, `{}`))
+	assert.Error(t, err, "Accessing a missing field should fail.")
+	assert.False(t, got)
+}
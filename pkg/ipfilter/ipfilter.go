@@ -0,0 +1,164 @@
+package ipfilter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const presetPrefix = "preset:"
+
+var (
+	ErrInvalidClientIP = errors.New("invalid client ip")
+)
+
+// Allowlist is a set of CIDR ranges that are permitted to call a webhook endpoint.
+// A nil or empty Allowlist allows every address.
+type Allowlist struct {
+	entries  []string
+	prefixes []netip.Prefix
+}
+
+// NewAllowlist builds an Allowlist from CIDRs, single IP addresses or preset references ("preset:github").
+func NewAllowlist(entries []string, presets Presets) (*Allowlist, error) {
+	a := &Allowlist{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if name, ok := strings.CutPrefix(entry, presetPrefix); ok {
+			ranges, exists := presets[name]
+			if !exists {
+				return nil, fmt.Errorf("unknown ip preset: %s", name)
+			}
+			prefixes, err := ParsePrefixes(ranges)
+			if err != nil {
+				return nil, fmt.Errorf("preset %s: %w", name, err)
+			}
+			a.prefixes = append(a.prefixes, prefixes...)
+		} else {
+			prefix, err := parsePrefix(entry)
+			if err != nil {
+				return nil, err
+			}
+			a.prefixes = append(a.prefixes, prefix)
+		}
+		a.entries = append(a.entries, entry)
+	}
+	return a, nil
+}
+
+// Entries returns the entries the Allowlist was built from.
+func (a *Allowlist) Entries() []string {
+	if a == nil {
+		return nil
+	}
+	return a.entries
+}
+
+func (a *Allowlist) IsEmpty() bool {
+	return a == nil || len(a.prefixes) == 0
+}
+
+func (a *Allowlist) Allowed(addr netip.Addr) bool {
+	if a.IsEmpty() {
+		return true
+	}
+	return containsAddr(a.prefixes, addr)
+}
+
+// ParsePrefixes parses CIDRs or single IP addresses.
+func ParsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+func parsePrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid cidr %q: %w", value, err)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid ip address %q: %w", value, err)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIPResolver determines the original caller address of a request.
+// X-Forwarded-For is only honored when the request arrives from a trusted proxy (e.g. Traefik).
+type ClientIPResolver struct {
+	trustedProxies []netip.Prefix
+}
+
+func NewClientIPResolver(trustedProxies []string) (*ClientIPResolver, error) {
+	prefixes, err := ParsePrefixes(trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxies: %w", err)
+	}
+	return &ClientIPResolver{trustedProxies: prefixes}, nil
+}
+
+// ClientIP walks X-Forwarded-For from right to left and returns the first hop that is not a trusted proxy.
+func (c *ClientIPResolver) ClientIP(r *http.Request) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("%w: %s", ErrInvalidClientIP, r.RemoteAddr)
+	}
+	remote = remote.Unmap()
+	if !containsAddr(c.trustedProxies, remote) {
+		return remote, nil
+	}
+
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	clientIP := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		addr, err := netip.ParseAddr(hop)
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("%w: X-Forwarded-For %q", ErrInvalidClientIP, hop)
+		}
+		clientIP = addr.Unmap()
+		if !containsAddr(c.trustedProxies, clientIP) {
+			return clientIP, nil
+		}
+	}
+	// Every hop is a trusted proxy, so the left-most address is the best we know.
+	return clientIP, nil
+}
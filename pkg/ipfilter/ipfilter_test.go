@@ -0,0 +1,78 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowlist_Allowed(t *testing.T) {
+	presets, err := DefaultPresets()
+	require.NoError(t, err)
+
+	allowlist, err := NewAllowlist([]string{"10.0.0.0/8", "192.168.1.10", "preset:github"}, presets)
+	require.NoError(t, err)
+
+	assert.True(t, allowlist.Allowed(netip.MustParseAddr("10.1.2.3")), "Addresses within the CIDR should be allowed.")
+	assert.True(t, allowlist.Allowed(netip.MustParseAddr("192.168.1.10")), "A single IP entry should be allowed.")
+	assert.True(t, allowlist.Allowed(netip.MustParseAddr("140.82.115.1")), "GitHub hook addresses should be allowed.")
+	assert.True(t, allowlist.Allowed(netip.MustParseAddr("::ffff:10.1.2.3")), "IPv4-mapped addresses should be unmapped.")
+	assert.False(t, allowlist.Allowed(netip.MustParseAddr("192.168.1.11")), "Other addresses should be blocked.")
+}
+
+func TestAllowlist_Empty(t *testing.T) {
+	allowlist, err := NewAllowlist(nil, nil)
+	require.NoError(t, err)
+	assert.True(t, allowlist.Allowed(netip.MustParseAddr("203.0.113.1")), "An empty allowlist should allow everything.")
+
+	var nilAllowlist *Allowlist
+	assert.True(t, nilAllowlist.Allowed(netip.MustParseAddr("203.0.113.1")), "A nil allowlist should allow everything.")
+}
+
+func TestNewAllowlist_Error(t *testing.T) {
+	_, err := NewAllowlist([]string{"preset:unknown"}, Presets{})
+	assert.Error(t, err, "Unknown presets should be rejected.")
+
+	_, err = NewAllowlist([]string{"10.0.0.0/33"}, nil)
+	assert.Error(t, err, "Invalid CIDRs should be rejected.")
+}
+
+func TestClientIPResolver_ClientIP(t *testing.T) {
+	resolver, err := NewClientIPResolver([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		want       string
+	}{
+		{name: "untrusted remote ignores header", remoteAddr: "203.0.113.5:1234", xff: []string{"140.82.115.1"}, want: "203.0.113.5"},
+		{name: "trusted proxy uses header", remoteAddr: "10.0.0.2:1234", xff: []string{"140.82.115.1"}, want: "140.82.115.1"},
+		{name: "spoofed left-most entry is ignored", remoteAddr: "10.0.0.2:1234", xff: []string{"1.1.1.1, 198.51.100.7, 10.0.0.3"}, want: "198.51.100.7"},
+		{name: "multiple headers are joined", remoteAddr: "10.0.0.2:1234", xff: []string{"1.1.1.1", "198.51.100.7"}, want: "198.51.100.7"},
+		{name: "no header", remoteAddr: "10.0.0.2:1234", want: "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodPost, "http://example.com/webhook/x", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			got, err := resolver.ClientIP(r)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.String())
+		})
+	}
+}
+
+func TestLoadPresets_Default(t *testing.T) {
+	presets, err := LoadPresets("")
+	require.NoError(t, err)
+	assert.NotEmpty(t, presets["github"], "The github preset should be built in.")
+	assert.NotEmpty(t, presets["stripe"], "The stripe preset should be built in.")
+}
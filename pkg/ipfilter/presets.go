@@ -0,0 +1,56 @@
+package ipfilter
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+
+	"github.com/goccy/go-yaml"
+)
+
+//go:embed presets.yaml
+var defaultPresets []byte
+
+// Presets maps a preset name (e.g. "github") to its CIDR ranges.
+type Presets map[string][]string
+
+func DefaultPresets() (Presets, error) {
+	return parsePresets(defaultPresets)
+}
+
+// LoadPresets reads presets from a local YAML file so provider ranges can be updated offline.
+// Presets in the file take precedence over the built-in ones.
+func LoadPresets(path string) (Presets, error) {
+	presets, err := DefaultPresets()
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return presets, nil
+	}
+	buf, err := os.ReadFile(path) //nolint: gosec
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ip presets file: %w", err)
+	}
+	fromFile, err := parsePresets(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ip presets file: %w", err)
+	}
+	for name, ranges := range fromFile {
+		presets[name] = ranges
+	}
+	return presets, nil
+}
+
+func parsePresets(buf []byte) (Presets, error) {
+	presets := Presets{}
+	if err := yaml.Unmarshal(buf, &presets); err != nil {
+		return nil, err
+	}
+	for name, ranges := range presets {
+		if _, err := ParsePrefixes(ranges); err != nil {
+			return nil, fmt.Errorf("preset %s: %w", name, err)
+		}
+	}
+	return presets, nil
+}
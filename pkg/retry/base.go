@@ -17,6 +17,8 @@ func retryFunc[T any](
 		fn.apply(&opt)
 	}
 	var def T
+	start := time.Now()
+	var prev time.Duration
 	for i := range opt.maxRetries {
 		select {
 		case <-ctx.Done():
@@ -31,10 +33,41 @@ func retryFunc[T any](
 					return def, skipErr.Err
 				}
 			}
-			backoff := backoff(i)
-			slog.Debug(fmt.Sprintf("Retrying in %v", backoff))
-			time.Sleep(backoff)
+			if i == opt.maxRetries-1 {
+				continue // No attempt follows.
+			}
+			var delay time.Duration
+			var retryAfterErr *retryAfter
+			if errors.As(err, &retryAfterErr) {
+				// The delay requested by the callee takes precedence over the backoff.
+				delay = retryAfterErr.Delay
+			} else {
+				delay = opt.jitter.apply(backoff(i), backoff(0), prev)
+			}
+			prev = delay
+			if opt.maxElapsedTime > 0 && time.Since(start)+delay > opt.maxElapsedTime {
+				return def, ErrMaxElapsedTime
+			}
+			slog.Debug(fmt.Sprintf("Retrying in %v", delay))
+			if err := Sleep(ctx, delay); err != nil {
+				return def, err
+			}
 		}
 	}
 	return def, ErrMaxRetry
 }
+
+// Sleep waits for d or until ctx is done, whichever comes first.
+func Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,193 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+)
+
+type CircuitState int
+
+const (
+	// StateClosed lets every call through.
+	StateClosed CircuitState = iota
+	// StateOpen fails every call with ErrCircuitOpen until the cooldown has passed.
+	StateOpen
+	// StateHalfOpen lets a single probe through; its result closes or reopens the circuit.
+	StateHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreaker fails fast after consecutive failures, so that callers do not wait for a dependency that is down.
+type CircuitBreaker struct {
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+
+	opt circuitBreakerOption
+}
+
+type circuitBreakerOption struct {
+	failureThreshold int
+	cooldown         time.Duration
+	onStateChange    func(from, to CircuitState)
+	now              func() time.Time
+}
+
+var (
+	defaultCircuitBreakerOption = circuitBreakerOption{
+		failureThreshold: 5,
+		cooldown:         30 * time.Second,
+		now:              time.Now,
+	}
+)
+
+type CircuitBreakerOption interface {
+	apply(opt *circuitBreakerOption)
+}
+
+type circuitBreakerOptionFn func(opt *circuitBreakerOption)
+
+func (fn circuitBreakerOptionFn) apply(opt *circuitBreakerOption) {
+	fn(opt)
+}
+
+// WithFailureThreshold opens the circuit after n consecutive failures.
+func WithFailureThreshold(n int) CircuitBreakerOption {
+	return circuitBreakerOptionFn(func(opt *circuitBreakerOption) {
+		opt.failureThreshold = n
+	})
+}
+
+// WithCooldown sets how long the circuit stays open before a probe is let through.
+func WithCooldown(cooldown time.Duration) CircuitBreakerOption {
+	return circuitBreakerOptionFn(func(opt *circuitBreakerOption) {
+		opt.cooldown = cooldown
+	})
+}
+
+// WithOnStateChange is called after every state transition, outside the breaker's lock.
+func WithOnStateChange(fn func(from, to CircuitState)) CircuitBreakerOption {
+	return circuitBreakerOptionFn(func(opt *circuitBreakerOption) {
+		opt.onStateChange = fn
+	})
+}
+
+func NewCircuitBreaker(optionFnc ...CircuitBreakerOption) *CircuitBreaker {
+	opt := defaultCircuitBreakerOption
+	for _, fn := range optionFnc {
+		fn.apply(&opt)
+	}
+	opt.failureThreshold = max(opt.failureThreshold, 1)
+	return &CircuitBreaker{opt: opt}
+}
+
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// Allow reports whether a call may proceed. Every allowed call must be followed by Success, Failure or Release.
+func (cb *CircuitBreaker) Allow() error {
+	cb.mu.Lock()
+	from := cb.state
+	var err error
+	switch cb.state {
+	case StateOpen:
+		if cb.opt.now().Sub(cb.openedAt) < cb.opt.cooldown {
+			err = ErrCircuitOpen
+			break
+		}
+		cb.state = StateHalfOpen
+		cb.probing = true
+	case StateHalfOpen:
+		if cb.probing {
+			err = ErrCircuitOpen
+			break
+		}
+		cb.probing = true
+	}
+	to := cb.state
+	cb.mu.Unlock()
+	cb.notify(from, to)
+	return err
+}
+
+// Success records a successful call and closes the circuit.
+func (cb *CircuitBreaker) Success() {
+	cb.mu.Lock()
+	from := cb.state
+	cb.state = StateClosed
+	cb.failures = 0
+	cb.probing = false
+	cb.mu.Unlock()
+	cb.notify(from, StateClosed)
+}
+
+// Failure records a failed call and opens the circuit once the threshold is reached or a probe fails.
+func (cb *CircuitBreaker) Failure() {
+	cb.mu.Lock()
+	from := cb.state
+	cb.failures++
+	cb.probing = false
+	if cb.state == StateHalfOpen || cb.failures >= cb.opt.failureThreshold {
+		cb.state = StateOpen
+		cb.openedAt = cb.opt.now()
+	}
+	to := cb.state
+	cb.mu.Unlock()
+	cb.notify(from, to)
+}
+
+// Release records a call that says nothing about the dependency, e.g. one canceled by its caller.
+// It frees the probe slot without changing the state or the failure count.
+func (cb *CircuitBreaker) Release() {
+	cb.mu.Lock()
+	cb.probing = false
+	cb.mu.Unlock()
+}
+
+func (cb *CircuitBreaker) notify(from, to CircuitState) {
+	if from != to && cb.opt.onStateChange != nil {
+		cb.opt.onStateChange(from, to)
+	}
+}
+
+// CircuitBreak calls fn through cb. Errors for which isFailure returns false count as success;
+// a nil isFailure counts every error as a failure. A call canceled by its caller counts as neither.
+func CircuitBreak[T any](cb *CircuitBreaker, fn func() (T, error), isFailure func(error) bool) (T, error) {
+	var def T
+	if err := cb.Allow(); err != nil {
+		return def, err
+	}
+	result, err := fn()
+	switch {
+	case errors.Is(err, context.Canceled):
+		cb.Release()
+	case err != nil && (isFailure == nil || isFailure(err)):
+		cb.Failure()
+	default:
+		cb.Success()
+	}
+	return result, err
+}
@@ -0,0 +1,76 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	var transitions []string
+	cb := NewCircuitBreaker(
+		WithFailureThreshold(2),
+		WithCooldown(time.Minute),
+		WithOnStateChange(func(from, to CircuitState) { transitions = append(transitions, from.String()+"->"+to.String()) }),
+	)
+	cb.opt.now = func() time.Time { return now }
+	failing := func() (int, error) { return 0, errors.New("Connection refused") }
+
+	for range 2 {
+		_, err := CircuitBreak(cb, failing, nil)
+		assert.EqualError(t, err, "Connection refused", "Calls should go through while the circuit is closed.")
+	}
+	assert.Equal(t, StateOpen, cb.State(), "The circuit should open once the threshold is reached.")
+
+	_, err := CircuitBreak(cb, failing, nil)
+	assert.ErrorIs(t, err, ErrCircuitOpen, "Calls should fail fast while the circuit is open.")
+
+	now = now.Add(time.Minute)
+	assert.NoError(t, cb.Allow(), "A probe should be allowed after the cooldown.")
+	assert.ErrorIs(t, cb.Allow(), ErrCircuitOpen, "Only a single probe should be allowed while half-open.")
+	cb.Failure()
+	assert.Equal(t, StateOpen, cb.State(), "A failed probe should reopen the circuit.")
+
+	now = now.Add(time.Minute)
+	result, err := CircuitBreak(cb, func() (int, error) { return 1, nil }, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result)
+	assert.Equal(t, StateClosed, cb.State(), "A successful probe should close the circuit.")
+
+	assert.Equal(t, []string{"closed->open", "open->half-open", "half-open->open", "open->half-open", "half-open->closed"}, transitions)
+}
+
+func TestCircuitBreaker_IsFailure(t *testing.T) {
+	cb := NewCircuitBreaker(WithFailureThreshold(1))
+	notFound := errors.New("Not found")
+
+	_, err := CircuitBreak(cb, func() (int, error) { return 0, notFound }, func(err error) bool { return !errors.Is(err, notFound) })
+	assert.Equal(t, notFound, err)
+	assert.Equal(t, StateClosed, cb.State(), "Errors that are not failures should not open the circuit.")
+}
+
+func TestCircuitBreaker_Canceled(t *testing.T) {
+	now := time.Now()
+	cb := NewCircuitBreaker(WithFailureThreshold(2), WithCooldown(time.Minute))
+	cb.opt.now = func() time.Time { return now }
+	failing := func() (int, error) { return 0, errors.New("Connection refused") }
+	canceled := func() (int, error) { return 0, fmt.Errorf("request: %w", context.Canceled) }
+
+	_, _ = CircuitBreak(cb, failing, nil)
+	_, _ = CircuitBreak(cb, canceled, nil)
+	_, _ = CircuitBreak(cb, failing, nil)
+	assert.Equal(t, StateOpen, cb.State(), "A cancellation should not reset the consecutive failures.")
+
+	now = now.Add(time.Minute)
+	_, err := CircuitBreak(cb, canceled, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, StateHalfOpen, cb.State(), "A canceled probe should not close the circuit.")
+	assert.NoError(t, cb.Allow(), "A canceled probe should free the slot for the next probe.")
+	cb.Failure()
+	assert.Equal(t, StateOpen, cb.State())
+}
@@ -1,9 +1,13 @@
 package retry
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 var (
-	ErrMaxRetry = errors.New("failed max retries")
+	ErrMaxRetry       = errors.New("failed max retries")
+	ErrMaxElapsedTime = errors.New("failed max elapsed time")
 )
 
 type skip struct {
@@ -21,3 +25,25 @@ func (s *skip) Error() string {
 func NewSkip(err error) error {
 	return &skip{Err: err}
 }
+
+type retryAfter struct {
+	Err   error
+	Delay time.Duration
+}
+
+var (
+	_ error = (*retryAfter)(nil) //nolint: errcheck
+)
+
+func (r *retryAfter) Error() string {
+	return r.Err.Error()
+}
+
+func (r *retryAfter) Unwrap() error {
+	return r.Err
+}
+
+// NewRetryAfter retries after delay instead of the backoff, e.g. the delay of an HTTP Retry-After header.
+func NewRetryAfter(err error, delay time.Duration) error {
+	return &retryAfter{Err: err, Delay: delay}
+}
@@ -27,6 +27,8 @@ type CalculateExponentialBackoffFn func(retryCount int) time.Duration
 type retryOption struct {
 	maxRetries                  int
 	calculateExponentialBackoff CalculateExponentialBackoffFn
+	jitter                      Jitter
+	maxElapsedTime              time.Duration
 }
 
 var (
@@ -59,3 +61,16 @@ func WithCalExponentialBackoff(fn CalculateExponentialBackoffFn) RetryOption {
 		opt.calculateExponentialBackoff = fn
 	})
 }
+
+func WithJitter(jitter Jitter) RetryOption {
+	return retryOptionFn(func(opt *retryOption) {
+		opt.jitter = jitter
+	})
+}
+
+// WithMaxElapsedTime gives up with ErrMaxElapsedTime instead of sleeping past maxElapsedTime since the first attempt.
+func WithMaxElapsedTime(maxElapsedTime time.Duration) RetryOption {
+	return retryOptionFn(func(opt *retryOption) {
+		opt.maxElapsedTime = maxElapsedTime
+	})
+}
@@ -1,7 +1,9 @@
 package retry
 
 import (
+	"context"
 	"errors"
+	"net/http"
 	"testing"
 	"time"
 
@@ -145,3 +147,80 @@ func TestSkipError(t *testing.T) {
 	assert.True(t, errors.As(skipErr, &s), "The error type should be correctly parsed.")
 	assert.Equal(t, originalErr, s.Err, "An internal error should be retained.")
 }
+
+func TestExponentialBackoff_ContextCanceledDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	counter := &retryCounter{count: 0, maxFailure: 10, err: errors.New("Temporary error")}
+
+	start := time.Now()
+	_, err := ExponentialBackoff(ctx, counter.call, WithCalExponentialBackoff(func(retryCount int) time.Duration { return time.Hour }))
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "The context error should be returned.")
+	assert.Less(t, time.Since(start), time.Second, "The backoff should be interrupted by the context.")
+	assert.Equal(t, 1, counter.count, "The function should be called only once.")
+}
+
+func TestExponentialBackoff_WithMaxElapsedTime(t *testing.T) {
+	ctx := t.Context()
+	counter := &retryCounter{count: 0, maxFailure: 10, err: errors.New("Temporary error")}
+
+	_, err := ExponentialBackoff(ctx, counter.call,
+		WithCalExponentialBackoff(func(retryCount int) time.Duration { return 20 * time.Millisecond }),
+		WithMaxElapsedTime(50*time.Millisecond),
+	)
+
+	assert.Equal(t, ErrMaxElapsedTime, err, "The maximum elapsed time error should be returned.")
+	assert.Equal(t, 3, counter.count, "The function should not be called once the next backoff exceeds the maximum elapsed time.")
+}
+
+func TestExponentialBackoff_RetryAfter(t *testing.T) {
+	ctx := t.Context()
+	count := 0
+	var delays []time.Duration
+	last := time.Now()
+	result, err := ExponentialBackoff(ctx, func() (int, error) {
+		delays = append(delays, time.Since(last))
+		last = time.Now()
+		count++
+		if count == 1 {
+			return 0, NewRetryAfter(errors.New("Too many requests"), 30*time.Millisecond)
+		}
+		return count, nil
+	}, WithCalExponentialBackoff(func(retryCount int) time.Duration { return time.Hour }))
+
+	assert.NoError(t, err, "No errors should occur.")
+	assert.Equal(t, 2, result, "It should succeed on the second call.")
+	assert.GreaterOrEqual(t, delays[1], 30*time.Millisecond, "The requested delay should be used instead of the backoff.")
+}
+
+func TestJitter(t *testing.T) {
+	backoff := 100 * time.Millisecond
+	for range 100 {
+		assert.Equal(t, backoff, NoJitter.apply(backoff, 0, 0))
+
+		full := FullJitter.apply(backoff, 0, 0)
+		assert.True(t, full >= 0 && full < backoff, "Full jitter should be within [0, backoff).")
+
+		equal := EqualJitter.apply(backoff, 0, 0)
+		assert.True(t, equal >= backoff/2 && equal < backoff, "Equal jitter should be within [backoff/2, backoff).")
+
+		decorrelated := DecorrelatedJitter.apply(backoff, 10*time.Millisecond, 20*time.Millisecond)
+		assert.True(t, decorrelated >= 10*time.Millisecond && decorrelated < 60*time.Millisecond, "Decorrelated jitter should be within [base, prev*3).")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	d, ok := ParseRetryAfter("120", now)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, d, "Seconds should be parsed.")
+
+	d, ok = ParseRetryAfter(now.Add(30*time.Second).Format(http.TimeFormat), now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, d, "An HTTP date should be parsed.")
+
+	_, ok = ParseRetryAfter("soon", now)
+	assert.False(t, ok, "An invalid value should be rejected.")
+}
@@ -0,0 +1,47 @@
+package retry
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Jitter randomizes the backoff so that clients failing at the same time do not retry in lockstep.
+// See https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+type Jitter int
+
+const (
+	// NoJitter sleeps for the backoff as-is.
+	NoJitter Jitter = iota
+	// FullJitter sleeps for a random duration in [0, backoff).
+	FullJitter
+	// EqualJitter sleeps for half of the backoff plus a random duration in [0, backoff/2).
+	EqualJitter
+	// DecorrelatedJitter sleeps for a random duration in [base, previous sleep * 3), capped by the backoff.
+	DecorrelatedJitter
+)
+
+func (j Jitter) apply(backoff, base, prev time.Duration) time.Duration {
+	if backoff <= 0 {
+		return backoff
+	}
+	switch j {
+	case FullJitter:
+		return randDuration(backoff)
+	case EqualJitter:
+		half := backoff / 2
+		return half + randDuration(backoff-half)
+	case DecorrelatedJitter:
+		base = max(base, time.Millisecond)
+		upper := max(prev*3, base+1)
+		return min(base+randDuration(upper-base), backoff)
+	default:
+		return backoff
+	}
+}
+
+func randDuration(n time.Duration) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	return rand.N(n) //nolint: gosec
+}
@@ -0,0 +1,58 @@
+package tlsconfig
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	write := func(certPEM, keyPEM []byte) {
+		require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+		require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+		// Make the change visible on file systems with a coarse mtime.
+		later := time.Now().Add(time.Second)
+		require.NoError(t, os.Chtimes(certFile, later, later))
+		require.NoError(t, os.Chtimes(keyFile, later, later))
+	}
+	serving := func(r *CertReloader) string {
+		cert, err := r.GetCertificate(nil)
+		require.NoError(t, err)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		return leaf.Subject.CommonName
+	}
+
+	_, certPEM, keyPEM := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "old"}})
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+	r, err := NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, "old", serving(r))
+	go r.Watch(t.Context(), 10*time.Millisecond)
+
+	t.Run("replaced", func(t *testing.T) {
+		_, certPEM, keyPEM := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "new"}})
+		write(certPEM, keyPEM)
+		assert.Eventually(t, func() bool { return serving(r) == "new" }, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("broken rewrite", func(t *testing.T) {
+		_, _, otherKeyPEM := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "mismatch"}})
+		// A key that does not match the certificate, as while a rotation has written only one of the files.
+		_, certPEM, _ := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "broken"}})
+		write(certPEM, otherKeyPEM)
+		// Give the watcher time to notice the change and fail to load it.
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, "new", serving(r), "The previous certificate should be kept.")
+	})
+}
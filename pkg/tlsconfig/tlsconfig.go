@@ -0,0 +1,151 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	ErrNoCertificate = errors.New("no certificate found")
+)
+
+// NewClientConfig builds the TLS configuration used for connections from the client to the server.
+// It returns nil when no TLS option is set so that the Go defaults are used.
+func NewClientConfig(caCertFile, clientCertFile, clientKeyFile string, insecure bool) (*tls.Config, error) {
+	if caCertFile == "" && clientCertFile == "" && clientKeyFile == "" && !insecure {
+		return nil, nil //nolint: nilnil
+	}
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecure, //nolint: gosec
+	}
+	if caCertFile != "" {
+		pool, err := LoadCertPool(caCertFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if clientCertFile != "" || clientKeyFile != "" {
+		if clientCertFile == "" || clientKeyFile == "" {
+			return nil, errors.New("both client certificate and client key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// NewPeerClientConfig builds the TLS configuration for requests between servers of a cluster.
+// Peers are addressed by IP, which serving certificates rarely cover, so the chain is verified against caCertFile
+// without checking the host name. Without caCertFile the peer is not verified. The client certificate
+// authenticates this server to its peers.
+func NewPeerClientConfig(caCertFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true, //nolint: gosec
+	}
+	if caCertFile != "" {
+		pool, err := LoadCertPool(caCertFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return ErrNoCertificate
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range state.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{Roots: pool, Intermediates: intermediates})
+			return err
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("both peer certificate and peer key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load peer certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// NewServerConfig builds the TLS configuration for serving. clientCAFile enables client certificate verification.
+func NewServerConfig(reloader *CertReloader, clientCAFile string, clientAuth tls.ClientAuthType) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+		ClientAuth:     clientAuth,
+	}
+	if clientCAFile != "" {
+		pool, err := LoadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+	}
+	return cfg, nil
+}
+
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	buf, err := os.ReadFile(path) //nolint: gosec
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ca certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("%w: %s", ErrNoCertificate, path)
+	}
+	return pool, nil
+}
+
+// ParseClientAuth converts a flag value into tls.ClientAuthType. Only the policies that verify the certificates
+// are accepted, since an unverified certificate has no identity.
+func ParseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request", "require":
+		return tls.NoClientCert, fmt.Errorf("client auth type %s does not verify certificates, use verify-if-given or require-and-verify", s)
+	case "verify-if-given":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require-and-verify":
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("unknown client auth type: %s", s)
+	}
+}
+
+// PeerIdentity returns the identity of a verified client certificate.
+// The subject common name is preferred, followed by the first URI, DNS and email SAN.
+// It returns an empty string when the peer did not present a verified certificate.
+func PeerIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	default:
+		return ""
+	}
+}
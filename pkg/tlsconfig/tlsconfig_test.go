@@ -0,0 +1,170 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue signs a leaf certificate for template and returns it with its PEM encoded certificate and key.
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) (*x509.Certificate, []byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) writeCert(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.crt")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600))
+	return path
+}
+
+func TestParseClientAuth(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    tls.ClientAuthType
+		wantErr bool
+	}{
+		{value: "", want: tls.NoClientCert},
+		{value: "none", want: tls.NoClientCert},
+		{value: "verify-if-given", want: tls.VerifyClientCertIfGiven},
+		{value: "Require-And-Verify", want: tls.RequireAndVerifyClientCert},
+		{value: "request", wantErr: true},
+		{value: "require", wantErr: true},
+		{value: "unknown", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseClientAuth(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPeerIdentity(t *testing.T) {
+	ca := newTestCA(t)
+	spiffe, err := url.Parse("spiffe://example.com/client")
+	require.NoError(t, err)
+	tests := []struct {
+		name     string
+		template *x509.Certificate
+		want     string
+	}{
+		{
+			name:     "common name first",
+			template: &x509.Certificate{Subject: pkix.Name{CommonName: "client"}, URIs: []*url.URL{spiffe}, DNSNames: []string{"client.example.com"}},
+			want:     "client",
+		},
+		{
+			name:     "uri",
+			template: &x509.Certificate{URIs: []*url.URL{spiffe}, DNSNames: []string{"client.example.com"}},
+			want:     "spiffe://example.com/client",
+		},
+		{
+			name:     "dns",
+			template: &x509.Certificate{DNSNames: []string{"client.example.com"}, EmailAddresses: []string{"client@example.com"}},
+			want:     "client.example.com",
+		},
+		{
+			name:     "email",
+			template: &x509.Certificate{EmailAddresses: []string{"client@example.com"}},
+			want:     "client@example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, _, _ := ca.issue(t, tt.template)
+			state := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert, ca.cert}}}
+			assert.Equal(t, tt.want, PeerIdentity(state))
+			state.VerifiedChains = nil
+			assert.Empty(t, PeerIdentity(state), "An unverified certificate has no identity.")
+		})
+	}
+	assert.Empty(t, PeerIdentity(nil))
+}
+
+func TestNewPeerClientConfig(t *testing.T) {
+	ca := newTestCA(t)
+	// Peers are addressed by IP, which the certificate does not cover.
+	_, certPEM, keyPEM := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "peer"}, DNSNames: []string{"peer.example.com"}})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	peer := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	peer.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	peer.StartTLS()
+	t.Cleanup(peer.Close)
+
+	get := func(caCertFile string) error {
+		cfg, err := NewPeerClientConfig(caCertFile, "", "")
+		require.NoError(t, err)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		resp, err := client.Get(peer.URL)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+	assert.NoError(t, get(ca.writeCert(t)))
+	assert.Error(t, get(newTestCA(t).writeCert(t)), "A peer signed by another CA should be refused.")
+	assert.NoError(t, get(""), "Without a CA the peer is not verified.")
+}
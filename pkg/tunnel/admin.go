@@ -0,0 +1,626 @@
+package tunnel
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nonchan7720/webhook-over-websocket/pkg/cluster"
+)
+
+// scopeLocal limits an admin request to the channels of the server that receives it.
+// Servers set it when they ask their peers.
+const scopeLocal = "local"
+
+// RedeliveryResult is the outcome of redelivering a dead letter through the admin API.
+type RedeliveryResult struct {
+	ID        string `json:"id"`
+	ChannelID string `json:"channel_id,omitempty"`
+	Status    int    `json:"status,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (s *Server) registerAdminHandlers(mux *http.ServeMux) {
+	mux.Handle("GET /admin/deadletters", s.adminOnly(s.handleListDeadLetters))
+	mux.Handle("GET /admin/deadletters/{id}", s.adminOnly(s.withAdminDeadLetter(s.handleGetDeadLetter)))
+	mux.Handle("DELETE /admin/deadletters/{id}", s.adminOnly(s.withAdminDeadLetter(s.handleDeleteDeadLetter)))
+	mux.Handle("POST /admin/deadletters/{id}/redeliver", s.adminOnly(s.withAdminDeadLetter(s.handleRedeliverDeadLetter)))
+	mux.Handle("POST /admin/deadletters/redeliver", s.adminOnly(s.handleRedeliverDeadLetters))
+	s.registerAdminChannelHandlers(mux)
+	mux.Handle("GET /admin/status", s.adminOnly(s.handleStatus))
+	mux.Handle("GET /cluster/status", s.adminOnly(s.handleClusterStatus))
+}
+
+// adminOnly requires the admin token as a bearer token. A server fanning an admin request out to its peers
+// is authenticated as a peer instead, and only for its own channels.
+func (s *Server) adminOnly(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.isAdminPeerCall(r) {
+			next(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// handleListDeadLetters lists the dead letters of the whole cluster, or of this server with scope=local.
+// Peers that do not answer are left out.
+func (s *Server) handleListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	list := []*DeadLetter{}
+	if s.deadLetters != nil {
+		var err error
+		if list, err = s.deadLetters.List(r.URL.Query().Get("channel_id")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Bodies can be large, so the list only has the metadata.
+		for i, dl := range list {
+			list[i] = dl.summary()
+		}
+	}
+	if r.URL.Query().Get("scope") != scopeLocal {
+		list = append(list, fanOut[*DeadLetter](s, r)...)
+		slices.SortFunc(list, func(a, b *DeadLetter) int {
+			return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), strings.Compare(a.ID, b.ID))
+		})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// withAdminDeadLetter runs next for a dead letter of this server, or forwards the request to the peer that keeps it.
+func (s *Server) withAdminDeadLetter(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.deadLetters != nil {
+			if _, err := s.deadLetters.Get(r.PathValue("id")); err == nil {
+				next(w, r)
+				return
+			}
+		}
+		if r.URL.Query().Get("scope") != scopeLocal && s.forwardToOwner(w, r) {
+			return
+		}
+		http.Error(w, ErrDeadLetterNotFound.Error(), http.StatusNotFound)
+	}
+}
+
+func (s *Server) handleGetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if s.deadLetters == nil {
+		http.Error(w, ErrDeadLetterNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	dl, err := s.deadLetters.Get(r.PathValue("id"))
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, dl)
+}
+
+func (s *Server) handleDeleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if s.deadLetters == nil {
+		http.Error(w, ErrDeadLetterNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err := s.deadLetters.Delete(r.PathValue("id")); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRedeliverDeadLetter redelivers one dead letter, to the channel in the "to" query parameter if given.
+func (s *Server) handleRedeliverDeadLetter(w http.ResponseWriter, r *http.Request) {
+	result, err := s.redeliverResult(r, r.PathValue("id"))
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, result)
+	case !errors.Is(err, ErrRedeliveryFailed):
+		writeAdminError(w, err)
+	default:
+		writeJSON(w, http.StatusBadGateway, result)
+	}
+}
+
+// handleRedeliverDeadLetters redelivers every dead letter, or those of the channel_id query parameter,
+// one after another on each server of the cluster. Failures are reported per dead letter and do not stop the others.
+func (s *Server) handleRedeliverDeadLetters(w http.ResponseWriter, r *http.Request) {
+	results := []RedeliveryResult{}
+	if s.deadLetters != nil {
+		list, err := s.deadLetters.List(r.URL.Query().Get("channel_id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, dl := range list {
+			if r.Context().Err() != nil {
+				break
+			}
+			result, _ := s.redeliverResult(r, dl.ID) //nolint: errcheck
+			results = append(results, result)
+		}
+	}
+	if r.URL.Query().Get("scope") != scopeLocal {
+		results = append(results, fanOut[RedeliveryResult](s, r)...)
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// fanOut sends r to every peer and returns the items of their answers. Peers that do not answer are left out.
+func fanOut[T any](s *Server, r *http.Request) []T {
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		items []T
+	)
+	for _, peerURL := range s.adminPeerURLs() {
+		wg.Go(func() {
+			resp, err := s.callPeer(r, peerURL, nil)
+			if err != nil {
+				slog.Debug("Failed to call peer", slog.String("peer", peerURL), slog.String("path", r.URL.Path), slog.String("error", err.Error()))
+				return
+			}
+			defer resp.Body.Close() //nolint: errcheck
+			var peerItems []T
+			if resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&peerItems) == nil {
+				mu.Lock()
+				items = append(items, peerItems...)
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	return items
+}
+
+func (s *Server) redeliverResult(r *http.Request, id string) (RedeliveryResult, error) {
+	to := r.URL.Query().Get("to")
+	status, err := s.Redeliver(r.Context(), id, to)
+	result := RedeliveryResult{ID: id, ChannelID: to, Status: status}
+	if err != nil {
+		result.Error = err.Error()
+		slog.Warn("Failed to redeliver dead letter", slog.String("dead-letter-id", id), slog.String("error", err.Error()))
+	}
+	return result, err
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrDeadLetterNotFound), errors.Is(err, ErrClientNotConnected):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v) //nolint: errcheck,errchkjson
+}
+
+// ChannelInfo describes a channel in the admin API.
+type ChannelInfo struct {
+	ID string `json:"id"`
+	// Node is the URL of the server that holds the channel.
+	Node          string     `json:"node"`
+	Owner         string     `json:"owner,omitempty"`
+	Connected     bool       `json:"connected"`
+	Encrypted     bool       `json:"encrypted"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ConnectedAt   *time.Time `json:"connected_at,omitempty"`
+	LastRequestAt *time.Time `json:"last_request_at,omitempty"`
+
+	Requests int64 `json:"requests"`
+	Failures int64 `json:"failures"`
+	Filtered int64 `json:"filtered"`
+	Blocked  int64 `json:"blocked"`
+
+	Policy ChannelPolicy `json:"policy"`
+	// RecentErrors is only returned for a single channel, newest first.
+	RecentErrors []ChannelError `json:"recent_errors,omitempty"`
+}
+
+// ChannelPolicy is the effective policy of a channel, named after the query parameters of /new.
+type ChannelPolicy struct {
+	Allow        []string `json:"allow"`
+	DedupKey     string   `json:"dedup_key,omitempty"`
+	DedupTTL     string   `json:"dedup_ttl,omitempty"`
+	Filter       []string `json:"filter,omitempty"`
+	FilterExpr   []string `json:"filter_expr,omitempty"`
+	FilterStatus int      `json:"filter_status,omitempty"`
+	FilterBody   string   `json:"filter_body,omitempty"`
+}
+
+// ChannelPolicyUpdate changes the fields of a channel policy that are set. An empty allow list
+// restores the server default, and empty filter lists remove the filter.
+type ChannelPolicyUpdate struct {
+	Allow        *[]string `json:"allow,omitempty"`
+	DedupKey     *string   `json:"dedup_key,omitempty"`
+	DedupTTL     *string   `json:"dedup_ttl,omitempty"`
+	Filter       *[]string `json:"filter,omitempty"`
+	FilterExpr   *[]string `json:"filter_expr,omitempty"`
+	FilterStatus *int      `json:"filter_status,omitempty"`
+	FilterBody   *string   `json:"filter_body,omitempty"`
+}
+
+func (p *channelPolicy) describe() ChannelPolicy {
+	d := ChannelPolicy{Allow: p.allowlist.Entries()}
+	if d.Allow == nil {
+		d.Allow = []string{}
+	}
+	if p.dedup != nil {
+		d.DedupKey = p.dedup.key.String()
+		d.DedupTTL = p.dedup.ttl.String()
+	}
+	if p.filter != nil {
+		for _, rule := range p.filter.rules {
+			d.Filter = append(d.Filter, rule.String())
+		}
+		for _, e := range p.filter.exprs {
+			d.FilterExpr = append(d.FilterExpr, e.String())
+		}
+		d.FilterStatus = p.filter.status
+		d.FilterBody = p.filter.body
+	}
+	return d
+}
+
+// values returns the query parameters of /new that apply u to current. Settings that are read together,
+// such as the dedup key and ttl, are completed from current.
+func (u *ChannelPolicyUpdate) values(current ChannelPolicy) url.Values {
+	query := url.Values{}
+	if u.Allow != nil {
+		query["allow"] = *u.Allow
+	}
+	if u.DedupKey != nil || u.DedupTTL != nil {
+		query.Set("dedup_key", valueOr(u.DedupKey, current.DedupKey))
+		query.Set("dedup_ttl", valueOr(u.DedupTTL, current.DedupTTL))
+	}
+	if u.Filter != nil || u.FilterExpr != nil || u.FilterStatus != nil || u.FilterBody != nil {
+		query["filter"] = valueOr(u.Filter, current.Filter)
+		query["filter_expr"] = valueOr(u.FilterExpr, current.FilterExpr)
+		if status := valueOr(u.FilterStatus, current.FilterStatus); status != 0 {
+			query.Set("filter_status", strconv.Itoa(status))
+		}
+		query.Set("filter_body", valueOr(u.FilterBody, current.FilterBody))
+	}
+	return query
+}
+
+func valueOr[T any](v *T, def T) T {
+	if v == nil {
+		return def
+	}
+	return *v
+}
+
+func (s *Server) registerAdminChannelHandlers(mux *http.ServeMux) {
+	mux.Handle("GET /admin/channels", s.adminOnly(s.handleListChannels))
+	mux.Handle("GET /admin/channels/{id}", s.adminOnly(s.withAdminChannel(s.handleGetChannel)))
+	mux.Handle("DELETE /admin/channels/{id}", s.adminOnly(s.withAdminChannel(s.handleRevokeChannel)))
+	mux.Handle("POST /admin/channels/{id}/disconnect", s.adminOnly(s.withAdminChannel(s.handleDisconnectChannel)))
+	mux.Handle("PATCH /admin/channels/{id}/policy", s.adminOnly(s.withAdminChannel(s.handleUpdateChannelPolicy)))
+	mux.Handle("POST /admin/channels/{id}/deliver", s.adminOnly(s.withAdminChannel(s.handleDeliverDeadLetter)))
+}
+
+// info describes the channel. It must be called with the server's channel lock held.
+func (c *channel) info(id, node string, withErrors bool) ChannelInfo {
+	c.mu.Lock()
+	connected := c.isActive()
+	connectedAt := c.connectedAt
+	c.mu.Unlock()
+	info := ChannelInfo{
+		ID:        id,
+		Node:      node,
+		Owner:     c.owner,
+		Connected: connected,
+		Encrypted: c.publicKey != nil,
+		CreatedAt: c.createdAt,
+		Requests:  c.stats.requests.Load(),
+		Failures:  c.stats.failures.Load(),
+		Filtered:  c.stats.filtered.Load(),
+		Blocked:   c.stats.blocked.Load(),
+		Policy:    c.policy.Load().describe(),
+	}
+	if connected {
+		info.ConnectedAt = &connectedAt
+	}
+	if last := c.stats.lastRequestAt.Load(); last != 0 {
+		t := time.Unix(0, last)
+		info.LastRequestAt = &t
+	}
+	if withErrors {
+		info.RecentErrors = c.stats.recentErrors()
+	}
+	return info
+}
+
+func (s *Server) localChannelInfos() []ChannelInfo {
+	s.channelsMu.RLock()
+	defer s.channelsMu.RUnlock()
+	infos := make([]ChannelInfo, 0, len(s.channels))
+	for id, ch := range s.channels {
+		infos = append(infos, ch.info(id, s.serverURL, false))
+	}
+	return infos
+}
+
+// handleListChannels lists the channels of the whole cluster, or of this server with scope=local.
+// Peers that do not answer are left out.
+func (s *Server) handleListChannels(w http.ResponseWriter, r *http.Request) {
+	infos := s.localChannelInfos()
+	if r.URL.Query().Get("scope") != scopeLocal {
+		infos = append(infos, fanOut[ChannelInfo](s, r)...)
+	}
+	slices.SortFunc(infos, func(a, b ChannelInfo) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), strings.Compare(a.ID, b.ID))
+	})
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// withAdminChannel runs next for a channel of this server, or forwards the request to the peer that holds it.
+func (s *Server) withAdminChannel(next func(w http.ResponseWriter, r *http.Request, id string, ch *channel)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		s.channelsMu.RLock()
+		ch, exists := s.channels[id]
+		s.channelsMu.RUnlock()
+		if exists {
+			next(w, r, id, ch)
+			return
+		}
+		if r.URL.Query().Get("scope") != scopeLocal && s.forwardToOwner(w, r) {
+			return
+		}
+		http.Error(w, "Channel not found", http.StatusNotFound)
+	}
+}
+
+func (s *Server) handleGetChannel(w http.ResponseWriter, r *http.Request, id string, ch *channel) {
+	s.channelsMu.RLock()
+	info := ch.info(id, s.serverURL, true)
+	s.channelsMu.RUnlock()
+	writeJSON(w, http.StatusOK, info)
+}
+
+// handleRevokeChannel deletes the channel and closes its connection, so that neither webhooks nor the client can use it again.
+func (s *Server) handleRevokeChannel(w http.ResponseWriter, r *http.Request, id string, ch *channel) {
+	s.channelsMu.Lock()
+	// Nothing sent to a revoked channel is kept, including after its connection has been closed below.
+	ch.revoked.Store(true)
+	ch.reconnectable.Store(false)
+	delete(s.channels, id)
+	delete(s.closedChannels, id)
+	s.channelsMu.Unlock()
+	s.retractChannel(id)
+	disconnected := ch.disconnect(websocket.ClosePolicyViolation, "Channel revoked")
+	slog.Info("Channel revoked", slog.String("channel-id", id), slog.Bool("disconnected", disconnected))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDisconnectChannel closes the client's connection but keeps the channel, so that the client can connect to it again
+// until the cleanup removes it.
+func (s *Server) handleDisconnectChannel(w http.ResponseWriter, r *http.Request, id string, ch *channel) {
+	ch.reconnectable.Store(true)
+	if !ch.disconnect(websocket.CloseGoingAway, "Disconnected by admin") {
+		ch.reconnectable.Store(false)
+		http.Error(w, "Client not connected", http.StatusConflict)
+		return
+	}
+	slog.Info("Channel disconnected", slog.String("channel-id", id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDeliverDeadLetter delivers a dead letter that a peer keeps to a channel of this server.
+// The peer records the outcome, so a failure is only reported back.
+func (s *Server) handleDeliverDeadLetter(w http.ResponseWriter, r *http.Request, id string, ch *channel) {
+	if !ch.isActive() {
+		writeAdminError(w, fmt.Errorf("%w: %s", ErrClientNotConnected, id))
+		return
+	}
+	var dl DeadLetter
+	if err := json.NewDecoder(r.Body).Decode(&dl); err != nil {
+		http.Error(w, "Invalid dead letter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ch.inflight.Add(1)
+	status, err := s.redeliver(r.Context(), ch, &dl, id)
+	ch.inflight.Add(-1)
+	result := RedeliveryResult{ID: dl.ID, ChannelID: id, Status: status}
+	if err != nil {
+		result.Error = err.Error()
+		writeJSON(w, http.StatusBadGateway, result)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleUpdateChannelPolicy applies a ChannelPolicyUpdate and returns the channel with its new policy.
+// Changing the dedup settings starts over with an empty cache.
+func (s *Server) handleUpdateChannelPolicy(w http.ResponseWriter, r *http.Request, id string, ch *channel) {
+	var update ChannelPolicyUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid policy: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	current := ch.policy.Load()
+	policy, err := s.newChannelPolicy(update.values(current.describe()), current)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !ch.policy.CompareAndSwap(current, policy) {
+		http.Error(w, "Policy was updated concurrently", http.StatusConflict)
+		return
+	}
+	slog.Info(
+		"Channel policy updated",
+		slog.String("channel-id", id),
+		slog.Any("allowlist", policy.allowlist.Entries()),
+		slog.String("dedup-key", policy.dedup.keyString()),
+		slog.Any("filter", policy.filter.ruleStrings()),
+	)
+	s.channelsMu.RLock()
+	info := ch.info(id, s.serverURL, false)
+	s.channelsMu.RUnlock()
+	writeJSON(w, http.StatusOK, info)
+}
+
+// peerURLs returns the base URLs of the active peers.
+func (s *Server) peerURLs() []string {
+	if s.mlist == nil {
+		return nil
+	}
+	nodes := s.mlist.ActiveNodesWithoutSelf()
+	urls := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		// Nodes advertise their server URL; older ones are assumed to listen on the same port as this one.
+		peerURL := cluster.ServerURL(node)
+		if peerURL == "" {
+			peerURL = fmt.Sprintf("%s://%s", s.peerScheme, net.JoinHostPort(node.Addr.String(), strconv.Itoa(s.peerPort)))
+		}
+		urls = append(urls, peerURL)
+	}
+	return urls
+}
+
+// adminPeerURLs returns the peers that admin requests fan out to. Without a cluster secret or peer identities
+// a peer could not tell a server from anyone else, so admin requests stay on this server.
+func (s *Server) adminPeerURLs() []string {
+	if !s.requiresPeerAuth() {
+		return nil
+	}
+	return s.peerURLs()
+}
+
+// isAdminPeerCall reports whether r was sent by callPeer from an authenticated peer.
+func (s *Server) isAdminPeerCall(r *http.Request) bool {
+	return s.requiresPeerAuth() && peerRequestFrom(r) != nil && r.URL.Query().Get("scope") == scopeLocal
+}
+
+// callPeer sends r to the same admin endpoint of a peer, limited to the peer's own channels.
+// The peer client authenticates the request; the caller's token is never sent to peers.
+func (s *Server) callPeer(r *http.Request, peerURL string, body []byte) (*http.Response, error) {
+	query := r.URL.Query()
+	query.Set("scope", scopeLocal)
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, peerURL+r.URL.Path+"?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+	return s.peerClient.Do(req)
+}
+
+// forwardToOwner relays r to the first peer that knows the channel or dead letter and reports whether one did.
+func (s *Server) forwardToOwner(w http.ResponseWriter, r *http.Request) bool {
+	peers := s.adminPeerURLs()
+	if len(peers) == 0 {
+		return false
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request", http.StatusBadRequest)
+		return true
+	}
+	for _, peerURL := range peers {
+		resp, err := s.callPeer(r, peerURL, body)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			_ = resp.Body.Close() //nolint: errcheck
+			continue
+		}
+		defer resp.Body.Close() //nolint: errcheck
+		for k, vv := range resp.Header {
+			for _, v := range vv {
+				w.Header().Add(k, v)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body) //nolint: errcheck
+		return true
+	}
+	return false
+}
+
+// NodeStatus is the state of one server reported by the admin API.
+type NodeStatus struct {
+	Node              string    `json:"node"`
+	Version           string    `json:"version,omitempty"`
+	StartedAt         time.Time `json:"started_at"`
+	Channels          int       `json:"channels"`
+	ConnectedChannels int       `json:"connected_channels"`
+	PendingRequests   int       `json:"pending_requests"`
+	DeadLetters       int       `json:"dead_letters"`
+	// Peers are the other servers this one sees in the cluster.
+	Peers []string `json:"peers"`
+}
+
+func (s *Server) localStatus() NodeStatus {
+	status := NodeStatus{
+		Node:      s.serverURL,
+		Version:   s.version,
+		StartedAt: s.startedAt,
+		Peers:     s.peerURLs(),
+	}
+	s.channelsMu.RLock()
+	status.Channels = len(s.channels)
+	for _, ch := range s.channels {
+		if ch.isActive() {
+			status.ConnectedChannels++
+		}
+	}
+	s.channelsMu.RUnlock()
+	s.pendingMu.RLock()
+	status.PendingRequests = len(s.pendingRequests)
+	s.pendingMu.RUnlock()
+	if s.deadLetters != nil {
+		if list, err := s.deadLetters.List(""); err == nil {
+			status.DeadLetters = len(list)
+		}
+	}
+	return status
+}
+
+// handleStatus returns the status of every server in the cluster, this one first, or only of this one with scope=local.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	statuses := []NodeStatus{s.localStatus()}
+	if r.URL.Query().Get("scope") != scopeLocal {
+		for _, peerURL := range s.adminPeerURLs() {
+			resp, err := s.callPeer(r, peerURL, nil)
+			if err != nil {
+				slog.Debug("Failed to get peer status", slog.String("peer", peerURL), slog.String("error", err.Error()))
+				continue
+			}
+			var peerStatuses []NodeStatus
+			if resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&peerStatuses) == nil {
+				statuses = append(statuses, peerStatuses...)
+			}
+			_ = resp.Body.Close() //nolint: errcheck
+		}
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
@@ -0,0 +1,164 @@
+package tunnel
+
+import (
+	"crypto/ecdh"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nonchan7720/webhook-over-websocket/pkg/ipfilter"
+)
+
+const (
+	// maxRecentErrors is the number of delivery errors kept per channel for the admin API.
+	maxRecentErrors = 20
+	// closedChannelTTL is how long the webhooks of a deleted channel are still recorded as dead letters.
+	closedChannelTTL = 24 * time.Hour
+)
+
+var errChannelClosed = errors.New("channel is not connected")
+
+type channel struct {
+	// wsConn is read without mu, e.g. by isActive, and replaced with mu held.
+	wsConn atomic.Pointer[websocket.Conn]
+	mu     sync.Mutex // WebSocketの同時書き込みを防ぐため
+
+	// policy is replaced as a whole when an operator updates it, so a webhook sees either the old or the new one.
+	policy atomic.Pointer[channelPolicy]
+	// owner is the identity of the client certificate that issued the channel.
+	owner string
+	// publicKey enables end-to-end encryption of the request payloads.
+	publicKey *ecdh.PublicKey
+
+	createdAt time.Time
+	// connectedAt is guarded by mu. disconnectedAt is set, under the server's channel lock, when an operator
+	// disconnected the client but kept the channel for it to reconnect.
+	connectedAt    time.Time
+	disconnectedAt time.Time
+	// reconnectable keeps the channel when its connection is closed.
+	reconnectable atomic.Bool
+	// revoked is set when an operator deleted the channel, whose webhooks must then not be recorded.
+	revoked atomic.Bool
+	// overloadedUntil (unix nano) is set when the client reports that it cannot accept more requests.
+	overloadedUntil atomic.Int64
+	// inflight counts the webhooks being handled, and migrating is set once the client has been asked to move.
+	inflight  atomic.Int64
+	migrating atomic.Bool
+
+	stats channelStats
+}
+
+// closedChannel remembers a deleted channel, so that the webhooks still sent to it are recorded as dead letters
+// only from its allowed sources, and never when it was end-to-end encrypted.
+type closedChannel struct {
+	allowlist *ipfilter.Allowlist
+	encrypted bool
+	closedAt  time.Time
+}
+
+// channelPolicy holds the settings of a channel that an operator can change while it is connected.
+type channelPolicy struct {
+	allowlist *ipfilter.Allowlist
+	// dedup replays the first response to duplicate deliveries. nil disables deduplication.
+	dedup *dedupCache
+	// filter drops unwanted webhooks before they are tunneled. nil lets every webhook through.
+	filter *channelFilter
+}
+
+func (c *channel) isActive() bool {
+	return c.wsConn.Load() != nil
+}
+
+func (c *channel) send(msg TunnelMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn := c.wsConn.Load()
+	if conn == nil {
+		return errChannelClosed
+	}
+	return conn.WriteJSON(msg)
+}
+
+// disconnect closes the client's connection with a close frame. It reports false when no client is connected.
+func (c *channel) disconnect(code int, text string) bool {
+	conn := c.wsConn.Load()
+	if conn == nil {
+		return false
+	}
+	_ = conn.WriteControl( //nolint: errcheck
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, text),
+		time.Now().Add(time.Second),
+	)
+	_ = conn.Close() //nolint: errcheck
+	return true
+}
+
+// idleSince returns when the channel started waiting for a client.
+func (c *channel) idleSince() time.Time {
+	if c.disconnectedAt.After(c.createdAt) {
+		return c.disconnectedAt
+	}
+	return c.createdAt
+}
+
+func (c *channel) setOverloaded(d time.Duration) {
+	c.overloadedUntil.Store(time.Now().Add(d).UnixNano())
+}
+
+// overloaded returns how long the client asked to hold off new requests.
+func (c *channel) overloaded() time.Duration {
+	return time.Until(time.Unix(0, c.overloadedUntil.Load()))
+}
+
+// channelStats counts the webhooks of a channel and keeps its latest delivery errors.
+type channelStats struct {
+	requests      atomic.Int64
+	failures      atomic.Int64
+	filtered      atomic.Int64
+	blocked       atomic.Int64
+	lastRequestAt atomic.Int64
+
+	mu     sync.Mutex
+	errors []ChannelError
+}
+
+// ChannelError is a delivery error of a channel reported by the admin API.
+type ChannelError struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+	Status int       `json:"status"`
+	Error  string    `json:"error,omitempty"`
+}
+
+func (s *channelStats) request() {
+	s.requests.Add(1)
+	s.lastRequestAt.Store(time.Now().UnixNano())
+}
+
+func (s *channelStats) failure(reason string, status int, cause error) {
+	s.failures.Add(1)
+	e := ChannelError{Time: time.Now(), Reason: reason, Status: status}
+	if cause != nil {
+		e.Error = cause.Error()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors = append(s.errors, e)
+	if len(s.errors) > maxRecentErrors {
+		s.errors = s.errors[len(s.errors)-maxRecentErrors:]
+	}
+}
+
+// recentErrors returns the latest errors, newest first.
+func (s *channelStats) recentErrors() []ChannelError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errs := make([]ChannelError, len(s.errors))
+	for i, e := range s.errors {
+		errs[len(s.errors)-1-i] = e
+	}
+	return errs
+}
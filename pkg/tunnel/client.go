@@ -0,0 +1,710 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nonchan7720/webhook-over-websocket/pkg/e2e"
+	"github.com/nonchan7720/webhook-over-websocket/pkg/expr"
+	"github.com/nonchan7720/webhook-over-websocket/pkg/retry"
+)
+
+const (
+	defaultTargetURL        = "http://localhost:3000"
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+	// overloadRetryAfter is how long the server is asked to hold off requests once the queue is full.
+	overloadRetryAfter = time.Second
+)
+
+var (
+	ErrE2EUnsupported = errors.New("the server does not support end-to-end encryption")
+	ErrOverloaded     = errors.New("too many requests in flight")
+)
+
+// Client connects to a Server over WebSocket and forwards tunneled webhooks to a local target.
+type Client struct {
+	serverURL *url.URL
+	targetURL string
+	target    *url.URL
+	tlsConfig *tls.Config
+	handler   http.Handler
+	routes    []Route
+	fallback  *Fallback
+	spool     *spool
+	retry     *RetryPolicy
+
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	breakersMu       sync.Mutex
+	breakers         map[string]*retry.CircuitBreaker
+
+	allowlist       []string
+	e2eEncryption   bool
+	transferTimeout time.Duration
+	maxInFlight     int
+	queueSize       int
+	dedupKey        string
+	dedupTTL        time.Duration
+	filters         []string
+	filterExprs     []string
+	filterStatus    int
+	filterBody      *string
+
+	onChannel  func(channelID, webhookURL string)
+	onRequest  func(reqID string, r *http.Request)
+	onResponse func(reqID string, resp *http.Response)
+	onError    func(reqID string, err error)
+}
+
+func NewClient(serverURL string, opts ...ClientOption) (*Client, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse server url: %w", err) //nolint:staticcheck
+	}
+	c := &Client{
+		serverURL:        u,
+		targetURL:        defaultTargetURL,
+		breakerThreshold: defaultBreakerThreshold,
+		breakerCooldown:  defaultBreakerCooldown,
+		breakers:         make(map[string]*retry.CircuitBreaker),
+	}
+	for _, opt := range opts {
+		opt.apply(c)
+	}
+	if c.target, err = url.Parse(c.targetURL); err != nil {
+		return nil, fmt.Errorf("Failed to parse target url: %w", err) //nolint:staticcheck
+	}
+	for i := range c.routes {
+		if err := c.routes[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	if c.dedupKey != "" {
+		if _, err := ParseDedupKey(c.dedupKey); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range c.filters {
+		if _, err := ParseFilterRule(f); err != nil {
+			return nil, err
+		}
+	}
+	// Expressions are evaluated by the server, but invalid ones are reported before connecting.
+	for _, f := range c.filterExprs {
+		if _, err := expr.Compile(f); err != nil {
+			return nil, err
+		}
+	}
+	if c.retry != nil {
+		if err := c.retry.compile(); err != nil {
+			return nil, err
+		}
+	}
+	if c.fallback != nil {
+		if err := c.fallback.compile(); err != nil {
+			return nil, err
+		}
+		c.spool = &spool{dir: c.fallback.SpoolDir}
+	}
+	return c, nil
+}
+
+// session is a single WebSocket connection to the server.
+type session struct {
+	channelID  string
+	conn       *websocket.Conn
+	mu         sync.Mutex
+	privateKey *ecdh.PrivateKey
+}
+
+func (s *session) send(msg TunnelMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn.WriteJSON(msg)
+}
+
+// Run issues a channel, connects to the server and forwards tunneled requests until ctx is canceled
+// or the connection is lost. When a draining server asks, the channel is moved to another server behind
+// the same URL without interruption. Run must not be called concurrently on the same Client.
+func (c *Client) Run(ctx context.Context) error {
+	httpClient := c.serverHTTPClient()
+
+	query := url.Values{}
+	for _, cidr := range c.allowlist {
+		query.Add("allow", cidr)
+	}
+	if c.dedupKey != "" {
+		query.Set("dedup_key", c.dedupKey)
+		if c.dedupTTL > 0 {
+			query.Set("dedup_ttl", c.dedupTTL.String())
+		}
+	}
+	for _, f := range c.filters {
+		query.Add("filter", f)
+	}
+	for _, f := range c.filterExprs {
+		query.Add("filter_expr", f)
+	}
+	if c.filterStatus != 0 {
+		query.Set("filter_status", strconv.Itoa(c.filterStatus))
+	}
+	if c.filterBody != nil {
+		query.Set("filter_body", *c.filterBody)
+	}
+	var privateKey *ecdh.PrivateKey
+	if c.e2eEncryption {
+		// A fresh key pair per session; the private key never leaves this process.
+		var err error
+		if privateKey, err = e2e.GenerateKey(); err != nil {
+			return err
+		}
+		query.Set("public_key", e2e.EncodePublicKey(privateKey.PublicKey()))
+	}
+	// Have the server generate a channel_id
+	newChannel, err := c.getNewChannel(httpClient, query)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve channel_id: %w", err)
+	}
+	channelID := newChannel["channel_id"]
+	if privateKey != nil && newChannel["encryption"] == "" {
+		return ErrE2EUnsupported
+	}
+	if c.onChannel != nil {
+		c.onChannel(channelID, fmt.Sprintf("%s/webhook/%s", strings.TrimSuffix(c.serverURL.String(), "/"), channelID))
+	}
+
+	conn, err := c.dial(ctx, channelID)
+	if err != nil {
+		return err
+	}
+	slog.Info("A tunnel to the server has been established.")
+
+	sess := &session{channelID: channelID, conn: conn, privateKey: privateKey}
+
+	if c.spool != nil {
+		redeliverCtx, stopRedeliver := context.WithCancel(ctx)
+		defer stopRedeliver()
+		go c.redeliverLoop(redeliverCtx)
+	}
+
+	// A draining server asks the client to move the channel to another server. The new session is served
+	// alongside the old one, which the server closes once it no longer tunnels requests to it.
+	resumes := make(chan string)
+	resumed := make(chan *session)
+	resumeFailed := make(chan error)
+	ended := make(chan error)
+	serve := func(sess *session) {
+		go func() { ended <- c.serve(ctx, sess, resumes) }()
+	}
+	serve(sess)
+	serving, resuming := 1, 0
+	for {
+		select {
+		case token := <-resumes:
+			resuming++
+			go func() {
+				sess, err := c.resume(ctx, httpClient, query, privateKey, token)
+				if err != nil {
+					resumeFailed <- err
+					return
+				}
+				resumed <- sess
+			}()
+		case sess := <-resumed:
+			resuming--
+			serving++
+			slog.Info("The tunnel has moved to another server.")
+			serve(sess)
+		case err := <-resumeFailed:
+			resuming--
+			if ctx.Err() == nil {
+				slog.Error(fmt.Sprintf("Failed to move the tunnel to another server: %v", err))
+			}
+			if serving == 0 && resuming == 0 {
+				return err
+			}
+		case err := <-ended:
+			serving--
+			if serving == 0 && resuming == 0 {
+				return err
+			}
+		}
+	}
+}
+
+// dial connects to the WebSocket of channelID, retrying while the server is unreachable.
+func (c *Client) dial(ctx context.Context, channelID string) (*websocket.Conn, error) {
+	websocketScheme := "ws"
+	if c.serverURL.Scheme == "https" {
+		websocketScheme = "wss"
+	}
+	dialer := *websocket.DefaultDialer
+	if c.tlsConfig != nil {
+		wsTLSConfig := c.tlsConfig.Clone()
+		wsTLSConfig.NextProtos = []string{"http/1.1"} // Do not include h2
+		dialer.TLSClientConfig = wsTLSConfig
+	}
+	wsURL := fmt.Sprintf("%s://%s/ws/%s", websocketScheme, c.serverURL.Host, channelID)
+	return retry.Retry(ctx, func() (*websocket.Conn, error) {
+		conn, _, err := dialer.DialContext(ctx, wsURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("WebSocket connection failed: %w", err)
+		}
+		return conn, nil
+	})
+}
+
+// resume moves the channel to another server with the token a draining server sent.
+// The load balancer in front of the servers chooses the new server.
+func (c *Client) resume(
+	ctx context.Context,
+	httpClient *http.Client,
+	query url.Values,
+	privateKey *ecdh.PrivateKey,
+	token string,
+) (*session, error) {
+	query = maps.Clone(query)
+	query.Set("resume", token)
+	// The draining server refuses the request, and the others accept it once they have heard of the token.
+	newChannel, err := retry.Retry(ctx, func() (map[string]string, error) {
+		return c.getNewChannel(httpClient, query)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to resume the channel: %w", err)
+	}
+	channelID := newChannel["channel_id"]
+	conn, err := c.dial(ctx, channelID)
+	if err != nil {
+		return nil, err
+	}
+	return &session{channelID: channelID, conn: conn, privateKey: privateKey}, nil
+}
+
+// serve forwards the requests tunneled over sess until its connection is closed or ctx is canceled.
+// The token of a reconnect message is passed to resumes.
+func (c *Client) serve(ctx context.Context, sess *session, resumes chan<- string) error {
+	conn := sess.conn
+	defer conn.Close() //nolint: errcheck
+
+	// Close the WebSocket when canceling the context
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			slog.Info("Shutting down client...")
+			_ = conn.Close() //nolint: errcheck
+		case <-done:
+		}
+	}()
+
+	workerCtx, stopWorkers := context.WithCancel(ctx)
+	defer stopWorkers()
+	dispatch := c.newDispatcher(workerCtx, sess)
+
+	moving := false
+	// Message Receive Loop
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Context cancelled, exiting...")
+			return ctx.Err()
+		default:
+		}
+
+		var msg TunnelMessage
+		err := conn.ReadJSON(&msg)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				slog.Info("Context cancelled during read")
+				return ctx.Err()
+			default:
+				if moving {
+					slog.Info("The previous tunnel has been closed.")
+				} else {
+					slog.Error(fmt.Sprintf("WebSocket Disconnection: %v", err))
+				}
+				return err
+			}
+		}
+
+		if msg.Type == messageTypeReconnect {
+			if !moving && msg.ResumeToken != "" {
+				moving = true
+				slog.Info("The server is draining. Moving the tunnel to another server...")
+				resumes <- msg.ResumeToken
+			}
+			continue
+		}
+		dispatch(msg)
+	}
+}
+
+// newDispatcher returns a function that forwards each request to the local server in parallel.
+// With a max in-flight limit, requests wait in a bounded queue for a worker, and requests that do not fit
+// are rejected as overloaded. The workers stop when ctx is done.
+func (c *Client) newDispatcher(ctx context.Context, sess *session) func(msg TunnelMessage) {
+	if c.maxInFlight <= 0 {
+		return func(msg TunnelMessage) {
+			go c.handleHTTPRequest(ctx, sess, msg)
+		}
+	}
+	queue := make(chan TunnelMessage, c.queueSize)
+	for range c.maxInFlight {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg := <-queue:
+					c.handleHTTPRequest(ctx, sess, msg)
+				}
+			}
+		}()
+	}
+	return func(msg TunnelMessage) {
+		select {
+		case queue <- msg:
+		default:
+			slog.Warn(fmt.Sprintf("[ReqID: %s] Too many requests in flight. The request was rejected as overloaded.", msg.ReqID),
+				slog.Int("max-in-flight", c.maxInFlight), slog.Int("queue-size", c.queueSize))
+			c.notifyError(msg.ReqID, ErrOverloaded)
+			_ = sess.send(TunnelMessage{ //nolint: errcheck
+				ReqID:      msg.ReqID,
+				Type:       messageTypeOverloaded,
+				RetryAfter: int(overloadRetryAfter.Seconds()),
+			})
+		}
+	}
+}
+
+func (c *Client) serverHTTPClient() *http.Client {
+	httpClient := &http.Client{}
+	if c.tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone() // nolint: errcheck,forcetypeassert
+		transport.TLSClientConfig = c.tlsConfig
+		httpClient.Transport = transport
+	}
+	return httpClient
+}
+
+// getNewChannel hits the server's /new endpoint to retrieve the channel_id.
+func (c *Client) getNewChannel(httpClient *http.Client, query url.Values) (map[string]string, error) {
+	newURL := strings.TrimSuffix(c.serverURL.String(), "/") + "/new"
+	if len(query) > 0 {
+		newURL += "?" + query.Encode()
+	}
+	resp, err := httpClient.Get(newURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body) //nolint: errcheck
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var result map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// handleHTTPRequest reconstructs the received byte stream, sends it locally, and returns the result.
+func (c *Client) handleHTTPRequest(ctx context.Context, sess *session, msg TunnelMessage) {
+	slog.Info(fmt.Sprintf("[ReqID: %s] Receive webhooks and forward them locally....", msg.ReqID))
+
+	payload := msg.Payload
+	if sess.privateKey != nil {
+		if !msg.Encrypted {
+			c.fail(sess, msg.ReqID, "Refusing an unencrypted payload while end-to-end encryption is enabled", errors.New("unencrypted payload"))
+			return
+		}
+		var err error
+		if payload, err = e2e.Open(sess.privateKey, msg.Payload); err != nil {
+			c.fail(sess, msg.ReqID, "Payload Decryption Error", err)
+			return
+		}
+	}
+
+	req, route, err := c.prepareRequest(ctx, sess.channelID, msg.ReqID, payload)
+	if err != nil {
+		c.fail(sess, msg.ReqID, "Request Restore Error", err)
+		return
+	}
+	if c.onRequest != nil {
+		c.onRequest(msg.ReqID, req)
+	}
+
+	// Send to local server
+	resp, err := c.doLocalWithRetry(ctx, msg.ReqID, req, route)
+	if err != nil {
+		if c.fallback != nil && isUnreachable(err) {
+			c.spoolRequest(sess, msg.ReqID, payload, err)
+			return
+		}
+		c.fail(sess, msg.ReqID, "Error sending to local server", err)
+		return
+	}
+	defer resp.Body.Close() //nolint: errcheck
+	if route != nil {
+		if err := route.Response.applyResponse(resp); err != nil {
+			c.fail(sess, msg.ReqID, "Response Transform Error", err)
+			return
+		}
+	}
+	if c.onResponse != nil {
+		c.onResponse(msg.ReqID, resp)
+	}
+
+	// Dump the received response as a raw byte stream
+	rawRespBytes, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		slog.Error(fmt.Sprintf("[ReqID: %s] Response Dump Error: %v", msg.ReqID, err))
+		c.notifyError(msg.ReqID, err)
+		return
+	}
+
+	respMsg := TunnelMessage{
+		ReqID:   msg.ReqID,
+		Payload: rawRespBytes,
+	}
+	_ = sess.send(respMsg) //nolint: errcheck
+
+	slog.Info(fmt.Sprintf("[ReqID: %s] The local response has been returned to the server. (Status: %d)", msg.ReqID, resp.StatusCode))
+}
+
+// prepareRequest restores the raw request and rewrites it for the local target.
+func (c *Client) prepareRequest(ctx context.Context, channelID, reqID string, payload []byte) (*http.Request, *Route, error) {
+	// Restore the raw byte array to an HTTP request
+	reqReader := bufio.NewReader(bytes.NewReader(payload))
+	req, err := http.ReadRequest(reqReader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Rewrite request information for the local server
+	req.RequestURI = "" // NOTE: When sending as a client, it must be left blank.
+	target := c.target
+	route, relPath := c.matchRoute(channelID, req)
+	if route != nil {
+		target = route.target
+		req.URL.Path = route.forwardPath(relPath)
+		req.URL.RawPath = ""
+		slog.Info(fmt.Sprintf("[ReqID: %s] Matched route %q: forwarding to %s%s", reqID, route.Name, target.Host, req.URL.Path))
+	}
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	if c.handler == nil {
+		req.Host = target.Host
+	}
+	if route != nil {
+		if err := route.Request.applyRequest(req); err != nil {
+			return nil, nil, err
+		}
+	}
+	return req.WithContext(ctx), route, nil
+}
+
+// matchRoute returns the first route matching req together with the path relative to the channel.
+func (c *Client) matchRoute(channelID string, req *http.Request) (*Route, string) {
+	if len(c.routes) == 0 {
+		return nil, ""
+	}
+	relPath := strings.TrimPrefix(req.URL.Path, "/webhook/"+channelID)
+	if relPath == "" {
+		relPath = "/"
+	}
+	var m *expr.Request
+	model := func() *expr.Request {
+		if m == nil {
+			// Buffer the body for expressions and restore it for forwarding.
+			var body []byte
+			if req.Body != nil {
+				body, _ = io.ReadAll(req.Body) //nolint: errcheck
+				_ = req.Body.Close()           //nolint: errcheck
+				req.Body = io.NopCloser(bytes.NewReader(body))
+			}
+			m = expr.NewRequest(req, relPath, body)
+		}
+		return m
+	}
+	for i := range c.routes {
+		if c.routes[i].match(req, relPath, model) {
+			return &c.routes[i], relPath
+		}
+	}
+	return nil, ""
+}
+
+// doLocal sends req to the local target, or serves it in-process when a handler is set.
+// While the circuit breaker of the target is open, it fails fast with retry.ErrCircuitOpen.
+func (c *Client) doLocal(ctx context.Context, req *http.Request) (*http.Response, error) {
+	breaker := c.breakerFor(req)
+	if breaker == nil {
+		return c.send(ctx, req)
+	}
+	return retry.CircuitBreak(breaker, func() (*http.Response, error) {
+		return c.send(ctx, req)
+	}, nil)
+}
+
+func (c *Client) send(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if c.handler != nil {
+		if c.transferTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.transferTimeout)
+			defer cancel()
+		}
+		return serveHandler(ctx, c.handler, req)
+	}
+	client := &http.Client{}
+	if c.transferTimeout > 0 {
+		client.Timeout = c.transferTimeout
+	}
+	return client.Do(req)
+}
+
+// breakerFor returns the circuit breaker of the local target of req, or nil when it is disabled.
+func (c *Client) breakerFor(req *http.Request) *retry.CircuitBreaker {
+	if c.breakerThreshold <= 0 {
+		return nil
+	}
+	target := req.URL.Host
+	if c.handler != nil {
+		target = "handler"
+	}
+	c.breakersMu.Lock()
+	defer c.breakersMu.Unlock()
+	breaker, ok := c.breakers[target]
+	if !ok {
+		breaker = retry.NewCircuitBreaker(
+			retry.WithFailureThreshold(c.breakerThreshold),
+			retry.WithCooldown(c.breakerCooldown),
+			retry.WithOnStateChange(func(from, to retry.CircuitState) {
+				msg := fmt.Sprintf("The circuit breaker for the local server %s changed from %s to %s.", target, from, to)
+				if to == retry.StateOpen {
+					slog.Warn(msg, slog.Duration("cooldown", c.breakerCooldown))
+				} else {
+					slog.Info(msg)
+				}
+			}),
+		)
+		c.breakers[target] = breaker
+	}
+	return breaker
+}
+
+// spoolRequest stores a request the local target could not receive and returns the fallback response.
+func (c *Client) spoolRequest(sess *session, reqID string, payload []byte, cause error) {
+	err := c.spool.put(spooledRequest{
+		ReqID:      reqID,
+		ChannelID:  sess.channelID,
+		Payload:    payload,
+		ReceivedAt: time.Now(),
+	})
+	if err != nil {
+		c.fail(sess, reqID, "Failed to spool the request", errors.Join(cause, err))
+		return
+	}
+	slog.Warn(fmt.Sprintf("[ReqID: %s] The local server is unreachable. The request was spooled and the fallback response was returned: %v", reqID, cause))
+	c.notifyError(reqID, cause)
+	_ = sess.send(TunnelMessage{ReqID: reqID, Payload: c.fallback.response()}) //nolint: errcheck
+}
+
+// redeliverLoop forwards spooled requests to the local target until ctx is canceled.
+func (c *Client) redeliverLoop(ctx context.Context) {
+	ticker := time.NewTicker(c.fallback.RedeliverInterval)
+	defer ticker.Stop()
+	for {
+		c.redeliver(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// redeliver forwards spooled requests in arrival order and stops at the first one the target cannot receive.
+// A request that reached the target is removed from the spool whatever its response status was.
+func (c *Client) redeliver(ctx context.Context) {
+	files, err := c.spool.list()
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to list spooled requests: %v", err))
+		return
+	}
+	for _, path := range files {
+		if ctx.Err() != nil {
+			return
+		}
+		spooled, err := c.spool.read(path)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Discarding an unreadable spooled request %s: %v", path, err))
+			_ = os.Remove(path) //nolint: errcheck
+			continue
+		}
+		req, _, err := c.prepareRequest(ctx, spooled.ChannelID, spooled.ReqID, spooled.Payload)
+		if err != nil {
+			slog.Error(fmt.Sprintf("[ReqID: %s] Discarding a spooled request: %v", spooled.ReqID, err))
+			_ = os.Remove(path) //nolint: errcheck
+			continue
+		}
+		resp, err := c.doLocal(ctx, req)
+		if err != nil {
+			if isUnreachable(err) {
+				return
+			}
+			slog.Error(fmt.Sprintf("[ReqID: %s] Failed to redeliver a spooled request: %v", spooled.ReqID, err))
+		} else {
+			drainBody(resp.Body)
+			slog.Info(fmt.Sprintf("[ReqID: %s] A spooled request has been redelivered. (Status: %d, Delay: %s)",
+				spooled.ReqID, resp.StatusCode, time.Since(spooled.ReceivedAt).Round(time.Second)))
+		}
+		_ = os.Remove(path) //nolint: errcheck
+	}
+}
+
+// fail logs err, notifies the error callback and returns 502 to the server.
+func (c *Client) fail(sess *session, reqID, message string, err error) {
+	slog.Error(fmt.Sprintf("[ReqID: %s] %s: %v", reqID, message, err))
+	c.notifyError(reqID, err)
+	sendErrorResponse(reqID, sess)
+}
+
+func (c *Client) notifyError(reqID string, err error) {
+	if c.onError != nil {
+		c.onError(reqID, err)
+	}
+}
+
+// sendErrorResponse returns a 502 Bad Gateway error when it cannot connect locally.
+func sendErrorResponse(reqID string, sess *session) {
+	badGatewayResp := "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+	msg := TunnelMessage{
+		ReqID:   reqID,
+		Payload: []byte(badGatewayResp),
+	}
+	_ = sess.send(msg) //nolint: errcheck
+}
@@ -0,0 +1,164 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+)
+
+type ClientOption interface {
+	apply(c *Client)
+}
+
+type clientOptionFn func(c *Client)
+
+func (fn clientOptionFn) apply(c *Client) {
+	fn(c)
+}
+
+// WithTargetURL sets the local server URL to forward webhook requests to.
+func WithTargetURL(targetURL string) ClientOption {
+	return clientOptionFn(func(c *Client) {
+		c.targetURL = targetURL
+	})
+}
+
+// WithHandler serves tunneled requests directly into h instead of forwarding them over HTTP,
+// so that webhook handlers can be exercised in-process (e.g. from go test) without a local port.
+// The target URL is ignored when a handler is set.
+func WithHandler(h http.Handler) ClientOption {
+	return clientOptionFn(func(c *Client) {
+		c.handler = h
+	})
+}
+
+// WithRoutes forwards requests matching a route to its own target. Routes are evaluated in order.
+func WithRoutes(routes ...Route) ClientOption {
+	return clientOptionFn(func(c *Client) {
+		c.routes = append(c.routes, routes...)
+	})
+}
+
+// WithFallback returns a canned response instead of 502 while the local target is unreachable,
+// and redelivers the spooled requests once it is reachable again.
+func WithFallback(f Fallback) ClientOption {
+	return clientOptionFn(func(c *Client) {
+		c.fallback = &f
+	})
+}
+
+// WithRetry retries deliveries to the local target according to p.
+func WithRetry(p RetryPolicy) ClientOption {
+	return clientOptionFn(func(c *Client) {
+		c.retry = &p
+	})
+}
+
+// WithCircuitBreaker fails requests fast for cooldown once a local target has failed threshold times in a row.
+// A threshold of zero disables the circuit breaker.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) ClientOption {
+	return clientOptionFn(func(c *Client) {
+		c.breakerThreshold = threshold
+		c.breakerCooldown = cooldown
+	})
+}
+
+// WithTLSConfig sets the TLS configuration for connections to the server.
+func WithTLSConfig(tlsConfig *tls.Config) ClientOption {
+	return clientOptionFn(func(c *Client) {
+		c.tlsConfig = tlsConfig
+	})
+}
+
+// WithAllowlist requests a source IP allowlist (CIDR, IP or preset:<name>) for the channel.
+func WithAllowlist(entries []string) ClientOption {
+	return clientOptionFn(func(c *Client) {
+		c.allowlist = entries
+	})
+}
+
+// WithDedup asks the server to replay the first response to webhooks with the same idempotency key within ttl,
+// e.g. "header:X-GitHub-Delivery" or "json:id". A ttl of zero uses the server default.
+func WithDedup(key string, ttl time.Duration) ClientOption {
+	return clientOptionFn(func(c *Client) {
+		c.dedupKey = key
+		c.dedupTTL = ttl
+	})
+}
+
+// WithFilter asks the server to tunnel only the webhooks matching every rule (see FilterRule),
+// e.g. "header:X-GitHub-Event=push|pull_request".
+func WithFilter(rules ...string) ClientOption {
+	return clientOptionFn(func(c *Client) {
+		c.filters = append(c.filters, rules...)
+	})
+}
+
+// WithFilterExpr asks the server to tunnel only the webhooks for which every CEL expression is true.
+// See package expr for the variables available to expressions.
+func WithFilterExpr(exprs ...string) ClientOption {
+	return clientOptionFn(func(c *Client) {
+		c.filterExprs = append(c.filterExprs, exprs...)
+	})
+}
+
+// WithFilterResponse sets the response the server returns for filtered webhooks.
+// A zero status keeps the server default.
+func WithFilterResponse(status int, body string) ClientOption {
+	return clientOptionFn(func(c *Client) {
+		c.filterStatus = status
+		c.filterBody = &body
+	})
+}
+
+// WithE2EEncryption encrypts webhook payloads end-to-end so that the server cannot read them.
+func WithE2EEncryption(enabled bool) ClientOption {
+	return clientOptionFn(func(c *Client) {
+		c.e2eEncryption = enabled
+	})
+}
+
+// WithTransferTimeout sets the timeout for transfers to the local server. Zero disables it.
+func WithTransferTimeout(timeout time.Duration) ClientOption {
+	return clientOptionFn(func(c *Client) {
+		c.transferTimeout = timeout
+	})
+}
+
+// WithMaxInFlight limits the requests forwarded to the local target at the same time. Up to queueSize requests
+// wait for a free slot; further requests are answered by the server with 503 and Retry-After.
+// A maxInFlight of zero means no limit.
+func WithMaxInFlight(maxInFlight, queueSize int) ClientOption {
+	return clientOptionFn(func(c *Client) {
+		c.maxInFlight = maxInFlight
+		c.queueSize = queueSize
+	})
+}
+
+// WithOnChannel is called once the server has issued a channel.
+func WithOnChannel(fn func(channelID, webhookURL string)) ClientOption {
+	return clientOptionFn(func(c *Client) {
+		c.onChannel = fn
+	})
+}
+
+// WithOnRequest is called for every tunneled request before it is forwarded locally.
+func WithOnRequest(fn func(reqID string, r *http.Request)) ClientOption {
+	return clientOptionFn(func(c *Client) {
+		c.onRequest = fn
+	})
+}
+
+// WithOnResponse is called with the local response before it is returned to the server.
+func WithOnResponse(fn func(reqID string, resp *http.Response)) ClientOption {
+	return clientOptionFn(func(c *Client) {
+		c.onResponse = fn
+	})
+}
+
+// WithOnError is called when a tunneled request cannot be processed.
+func WithOnError(fn func(reqID string, err error)) ClientOption {
+	return clientOptionFn(func(c *Client) {
+		c.onError = fn
+	})
+}
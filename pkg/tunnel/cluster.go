@@ -0,0 +1,263 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of ClusterIssue.
+const (
+	// IssueChannelConflict is a channel held by more than one node, e.g. after the cluster was partitioned.
+	IssueChannelConflict = "channel-conflict"
+	// IssueMembershipMismatch is a node that one node sees alive and another does not.
+	IssueMembershipMismatch = "membership-mismatch"
+	// IssueIncarnationMismatch is a node name the nodes know with different incarnations,
+	// e.g. two processes with the same name or a restart that has not spread yet.
+	IssueIncarnationMismatch = "incarnation-mismatch"
+	// IssueUnreachable is a node that memberlist sees alive but that did not answer.
+	IssueUnreachable = "unreachable"
+)
+
+// ClusterStatus is the state of the memberlist cluster reported by /cluster/status.
+type ClusterStatus struct {
+	// Node is the memberlist node that answered, whose view Members is.
+	Node    string          `json:"node"`
+	Members []ClusterMember `json:"members"`
+	Issues  []ClusterIssue  `json:"issues"`
+	// Channels are the channels the node holds. Nodes send them to each other to find conflicts.
+	Channels []string `json:"channels,omitempty"`
+}
+
+// ClusterMember is a memberlist node. The channel counts come from the gossip.
+type ClusterMember struct {
+	Name        string `json:"name"`
+	Address     string `json:"address"`
+	ServerURL   string `json:"server_url,omitempty"`
+	State       string `json:"state"`
+	Incarnation uint64 `json:"incarnation,omitempty"`
+	Channels    int    `json:"channels"`
+	// ConnectedClients is the number of channels with a client connected.
+	ConnectedClients int `json:"connected_clients"`
+	// LastSync is when the answering node last exchanged its whole channel map with the member.
+	LastSync *time.Time `json:"last_sync,omitempty"`
+}
+
+// ClusterIssue is a symptom of a split brain or of a node that is out of sync.
+type ClusterIssue struct {
+	Kind    string   `json:"kind"`
+	Channel string   `json:"channel,omitempty"`
+	Nodes   []string `json:"nodes"`
+	Message string   `json:"message"`
+}
+
+// localClusterStatus returns the view of this node and the conflicts it can see by itself.
+func (s *Server) localClusterStatus() ClusterStatus {
+	status := ClusterStatus{Node: s.serverURL, Members: []ClusterMember{}, Issues: []ClusterIssue{}}
+	s.channelsMu.RLock()
+	for id, ch := range s.channels {
+		// A channel being moved by a drain is held by both nodes for a moment.
+		if !ch.migrating.Load() {
+			status.Channels = append(status.Channels, id)
+		}
+	}
+	s.channelsMu.RUnlock()
+	slices.Sort(status.Channels)
+	if s.mlist == nil {
+		return status
+	}
+	status.Node = s.mlist.MyNodeName()
+	for _, m := range s.mlist.Members() {
+		member := ClusterMember{
+			Name:             m.Name,
+			Address:          m.Addr,
+			ServerURL:        m.ServerURL,
+			State:            m.State,
+			Incarnation:      m.Incarnation,
+			Channels:         m.Channels,
+			ConnectedClients: m.Connected,
+		}
+		if !m.LastSync.IsZero() {
+			member.LastSync = &m.LastSync
+		}
+		status.Members = append(status.Members, member)
+	}
+	for _, id := range status.Channels {
+		if c, ok := s.mlist.PeerChannel(id); ok {
+			status.Issues = append(status.Issues, channelConflict(id, []string{status.Node, c.Node}))
+		}
+	}
+	return status
+}
+
+// handleClusterStatus returns the view of this node, with the issues found by comparing it with the views of
+// every peer, or only the view of this node with scope=local or without peer authentication.
+func (s *Server) handleClusterStatus(w http.ResponseWriter, r *http.Request) {
+	status := s.localClusterStatus()
+	if r.URL.Query().Get("scope") == scopeLocal || !s.requiresPeerAuth() {
+		writeJSON(w, http.StatusOK, status)
+		return
+	}
+
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		views = []ClusterStatus{status}
+	)
+	for _, m := range status.Members {
+		if m.Name == status.Node || m.State != "alive" {
+			continue
+		}
+		wg.Go(func() {
+			peerURL := s.memberURL(m)
+			view, err := s.peerClusterStatus(r, peerURL)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				slog.Debug("Failed to get peer cluster status", slog.String("peer", peerURL), slog.String("error", err.Error()))
+				status.Issues = append(status.Issues, ClusterIssue{
+					Kind:    IssueUnreachable,
+					Nodes:   []string{m.Name},
+					Message: fmt.Sprintf("%s is alive in memberlist but did not answer: %v", m.Name, err),
+				})
+				return
+			}
+			views = append(views, view)
+		})
+	}
+	wg.Wait()
+
+	status.Issues = append(status.Issues, compareClusterViews(views)...)
+	status.Issues = dedupIssues(status.Issues)
+	status.Channels = nil
+	writeJSON(w, http.StatusOK, status)
+}
+
+// memberURL returns the server URL of m, like peerURLs.
+func (s *Server) memberURL(m ClusterMember) string {
+	if m.ServerURL != "" {
+		return m.ServerURL
+	}
+	host, _, _ := net.SplitHostPort(m.Address) //nolint: errcheck
+	return fmt.Sprintf("%s://%s", s.peerScheme, net.JoinHostPort(host, strconv.Itoa(s.peerPort)))
+}
+
+func (s *Server) peerClusterStatus(r *http.Request, peerURL string) (ClusterStatus, error) {
+	resp, err := s.callPeer(r, peerURL, nil)
+	if err != nil {
+		return ClusterStatus{}, err
+	}
+	defer resp.Body.Close() //nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		return ClusterStatus{}, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	var view ClusterStatus
+	if err := json.NewDecoder(resp.Body).Decode(&view); err != nil {
+		return ClusterStatus{}, err
+	}
+	return view, nil
+}
+
+// compareClusterViews finds the channels held by several nodes and the nodes whose views disagree.
+func compareClusterViews(views []ClusterStatus) []ClusterIssue {
+	var issues []ClusterIssue
+	holders := make(map[string][]string)
+	for _, v := range views {
+		issues = append(issues, v.Issues...)
+		for _, id := range v.Channels {
+			holders[id] = append(holders[id], v.Node)
+		}
+	}
+	for id, nodes := range holders {
+		if len(nodes) > 1 {
+			issues = append(issues, channelConflict(id, nodes))
+		}
+	}
+
+	type seen struct {
+		alive       bool
+		incarnation uint64
+	}
+	viewsOf := make(map[string]map[string]seen) // viewer -> member -> state
+	names := make(map[string]bool)
+	for _, v := range views {
+		members := make(map[string]seen, len(v.Members))
+		for _, m := range v.Members {
+			members[m.Name] = seen{alive: m.State == "alive", incarnation: m.Incarnation}
+			names[m.Name] = true
+		}
+		viewsOf[v.Node] = members
+	}
+	for name := range names {
+		var alive, notAlive []string
+		incarnations := make(map[uint64][]string)
+		for viewer, members := range viewsOf {
+			m, ok := members[name]
+			if ok && m.alive {
+				alive = append(alive, viewer)
+			} else {
+				notAlive = append(notAlive, viewer)
+			}
+			if ok && m.incarnation != 0 {
+				incarnations[m.incarnation] = append(incarnations[m.incarnation], viewer)
+			}
+		}
+		if len(alive) > 0 && len(notAlive) > 0 {
+			slices.Sort(alive)
+			slices.Sort(notAlive)
+			issues = append(issues, ClusterIssue{
+				Kind:  IssueMembershipMismatch,
+				Nodes: []string{name},
+				Message: fmt.Sprintf("%s is alive for %s but not for %s",
+					name, strings.Join(alive, ", "), strings.Join(notAlive, ", ")),
+			})
+		}
+		if len(incarnations) > 1 {
+			issues = append(issues, ClusterIssue{
+				Kind:    IssueIncarnationMismatch,
+				Nodes:   []string{name},
+				Message: fmt.Sprintf("%s is known with %d different incarnations", name, len(incarnations)),
+			})
+		}
+	}
+	return issues
+}
+
+func channelConflict(channelID string, nodes []string) ClusterIssue {
+	nodes = slices.Clone(nodes)
+	slices.Sort(nodes)
+	nodes = slices.Compact(nodes)
+	return ClusterIssue{
+		Kind:    IssueChannelConflict,
+		Channel: channelID,
+		Nodes:   nodes,
+		Message: fmt.Sprintf("channel %s is held by %s", channelID, strings.Join(nodes, " and ")),
+	}
+}
+
+// dedupIssues drops the issues reported by several nodes, and sorts them.
+func dedupIssues(issues []ClusterIssue) []ClusterIssue {
+	seen := make(map[string]bool, len(issues))
+	deduped := make([]ClusterIssue, 0, len(issues))
+	for _, issue := range issues {
+		key := issue.Kind + "|" + issue.Channel + "|" + strings.Join(issue.Nodes, ",")
+		if issue.Channel == "" {
+			key += "|" + issue.Message
+		}
+		if !seen[key] {
+			seen[key] = true
+			deduped = append(deduped, issue)
+		}
+	}
+	slices.SortFunc(deduped, func(a, b ClusterIssue) int {
+		return strings.Compare(a.Kind+a.Channel+a.Message, b.Kind+b.Channel+b.Message)
+	})
+	return deduped
+}
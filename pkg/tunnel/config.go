@@ -0,0 +1,27 @@
+package tunnel
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/goccy/go-yaml"
+)
+
+// ClientConfig is the file form of the client settings that do not fit into flags.
+type ClientConfig struct {
+	Routes   []Route      `yaml:"routes"`
+	Fallback *Fallback    `yaml:"fallback"`
+	Retry    *RetryPolicy `yaml:"retry"`
+}
+
+func LoadClientConfig(path string) (*ClientConfig, error) {
+	buf, err := os.ReadFile(path) //nolint: gosec
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client config: %w", err)
+	}
+	var cfg ClientConfig
+	if err := yaml.UnmarshalWithOptions(buf, &cfg, yaml.Strict()); err != nil {
+		return nil, fmt.Errorf("failed to parse client config: %w", err)
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,219 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultMaxDeadLetters is the number of dead letters a server keeps by default.
+const DefaultMaxDeadLetters = 1000
+
+// Reasons recorded with a dead letter.
+const (
+	DeadLetterClientNotConnected = "client_not_connected"
+	DeadLetterSendFailed         = "send_failed"
+	DeadLetterTimeout            = "timeout"
+	// DeadLetterUpstreamError is recorded when the client answered with a 5xx, e.g. the local server failed.
+	DeadLetterUpstreamError = "upstream_error"
+)
+
+var (
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+	ErrClientNotConnected = errors.New("client not connected")
+	ErrRedeliveryFailed   = errors.New("redelivery failed")
+)
+
+// DeadLetter is a webhook that could not be delivered to the client.
+// Path is relative to the channel so that the request can be redelivered to another channel.
+type DeadLetter struct {
+	ID        string `json:"id"`
+	ChannelID string `json:"channel_id"`
+	Reason    string `json:"reason"`
+	// Status is the status returned to the webhook sender.
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	Method   string      `json:"method"`
+	Host     string      `json:"host"`
+	Path     string      `json:"path"`
+	RawQuery string      `json:"raw_query,omitempty"`
+	Header   http.Header `json:"header,omitempty"`
+	Body     []byte      `json:"body,omitempty"`
+
+	// Attempts counts the deliveries, including the original one.
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// newDeadLetter records r, leaving its body readable.
+func newDeadLetter(r *http.Request, channelID, reason string, status int, cause error) (*DeadLetter, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+		_ = r.Body.Close() //nolint: errcheck
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	relPath := strings.TrimPrefix(r.URL.Path, "/webhook/"+channelID)
+	if relPath == "" {
+		relPath = "/"
+	}
+	now := time.Now()
+	dl := &DeadLetter{
+		ID:        uuid.New().String(),
+		ChannelID: channelID,
+		Reason:    reason,
+		Status:    status,
+		Method:    r.Method,
+		Host:      r.Host,
+		Path:      relPath,
+		RawQuery:  r.URL.RawQuery,
+		Header:    r.Header.Clone(),
+		Body:      body,
+		Attempts:  1,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if cause != nil {
+		dl.Error = cause.Error()
+	}
+	return dl, nil
+}
+
+// dump returns the raw request addressed to channelID.
+func (dl *DeadLetter) dump(channelID string) ([]byte, error) {
+	target := "/webhook/" + channelID + dl.Path
+	if dl.RawQuery != "" {
+		target += "?" + dl.RawQuery
+	}
+	req, err := http.NewRequest(dl.Method, target, bytes.NewReader(dl.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Host = dl.Host
+	req.Header = dl.Header.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	// The body is complete, so it is always sent with Content-Length.
+	req.Header.Del("Transfer-Encoding")
+	req.Header.Set("Content-Length", strconv.Itoa(len(dl.Body)))
+	return httputil.DumpRequest(req, true)
+}
+
+// summary returns a copy without the header and body.
+func (dl *DeadLetter) summary() *DeadLetter {
+	c := *dl
+	c.Header, c.Body = nil, nil
+	return &c
+}
+
+// DeadLetterStore keeps dead letters until they are redelivered or deleted.
+type DeadLetterStore interface {
+	Add(dl *DeadLetter) error
+	Get(id string) (*DeadLetter, error)
+	// List returns the dead letters of channelID, or all of them when channelID is empty, oldest first.
+	List(channelID string) ([]*DeadLetter, error)
+	Update(dl *DeadLetter) error
+	Delete(id string) error
+}
+
+// MemoryDeadLetterStore is a DeadLetterStore that keeps the latest maxEntries dead letters in memory.
+type MemoryDeadLetterStore struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	order   []string
+	entries map[string]*DeadLetter
+}
+
+var _ DeadLetterStore = (*MemoryDeadLetterStore)(nil)
+
+func NewMemoryDeadLetterStore(maxEntries int) *MemoryDeadLetterStore {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxDeadLetters
+	}
+	return &MemoryDeadLetterStore{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*DeadLetter),
+	}
+}
+
+func (s *MemoryDeadLetterStore) Add(dl *DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := *dl
+	s.entries[dl.ID] = &c
+	s.order = append(s.order, dl.ID)
+	// The oldest ones are dropped first.
+	for len(s.order) > s.maxEntries {
+		delete(s.entries, s.order[0])
+		s.order = s.order[1:]
+	}
+	return nil
+}
+
+func (s *MemoryDeadLetterStore) Get(id string) (*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dl, ok := s.entries[id]
+	if !ok {
+		return nil, ErrDeadLetterNotFound
+	}
+	c := *dl
+	return &c, nil
+}
+
+func (s *MemoryDeadLetterStore) List(channelID string) ([]*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*DeadLetter, 0, len(s.order))
+	for _, id := range s.order {
+		dl := s.entries[id]
+		if channelID != "" && dl.ChannelID != channelID {
+			continue
+		}
+		c := *dl
+		list = append(list, &c)
+	}
+	return list, nil
+}
+
+func (s *MemoryDeadLetterStore) Update(dl *DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[dl.ID]; !ok {
+		return ErrDeadLetterNotFound
+	}
+	c := *dl
+	s.entries[dl.ID] = &c
+	return nil
+}
+
+func (s *MemoryDeadLetterStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[id]; !ok {
+		return ErrDeadLetterNotFound
+	}
+	delete(s.entries, id)
+	for i, v := range s.order {
+		if v == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
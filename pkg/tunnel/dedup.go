@@ -0,0 +1,161 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDedupTTL = time.Hour
+	// maxDedupEntries bounds the memory of a channel; requests beyond it are tunneled without deduplication.
+	maxDedupEntries = 10000
+	// duplicateHeader marks a response replayed from the first delivery.
+	duplicateHeader = "X-Webhook-Duplicate"
+)
+
+var (
+	ErrInvalidDedupKey = errors.New("invalid dedup key: expected header:<name> or json:<field>")
+)
+
+// DedupKey identifies the idempotency key of a webhook, either a header (e.g. header:X-GitHub-Delivery)
+// or a field of a JSON body (e.g. json:id, or json:data.object.id for nested fields).
+type DedupKey struct {
+	raw      string
+	header   string
+	jsonPath []string
+}
+
+func ParseDedupKey(s string) (*DedupKey, error) {
+	kind, name, ok := strings.Cut(s, ":")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidDedupKey, s)
+	}
+	switch kind {
+	case "header":
+		return &DedupKey{raw: s, header: http.CanonicalHeaderKey(name)}, nil
+	case "json":
+		return &DedupKey{raw: s, jsonPath: strings.Split(name, ".")}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidDedupKey, s)
+	}
+}
+
+func (k *DedupKey) String() string {
+	return k.raw
+}
+
+// extract returns the idempotency key of w, or "" when w does not carry one.
+func (k *DedupKey) extract(w *webhookRequest) string {
+	if k.header != "" {
+		return w.r.Header.Get(k.header)
+	}
+	v, _ := w.jsonField(k.jsonPath)
+	return v
+}
+
+// dedupCache remembers the responses of the first deliveries of a channel for ttl.
+type dedupCache struct {
+	key *DedupKey
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+}
+
+type dedupEntry struct {
+	// done is closed once the first delivery has finished.
+	done      chan struct{}
+	resp      *cachedResponse
+	expiresAt time.Time
+}
+
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func newDedupCache(key *DedupKey, ttl time.Duration) *dedupCache {
+	if ttl <= 0 {
+		ttl = defaultDedupTTL
+	}
+	return &dedupCache{key: key, ttl: ttl, entries: make(map[string]*dedupEntry)}
+}
+
+// begin returns the entry for id, and whether the caller is the first delivery that must finish it.
+// It returns nil when the cache is full.
+func (c *dedupCache) begin(id string) (*dedupEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[id]; ok && !e.expired(time.Now()) {
+		return e, false
+	}
+	if len(c.entries) >= maxDedupEntries {
+		c.sweepLocked()
+		if len(c.entries) >= maxDedupEntries {
+			return nil, true
+		}
+	}
+	e := &dedupEntry{done: make(chan struct{})}
+	c.entries[id] = e
+	return e, true
+}
+
+// finish records the response of the first delivery and releases the duplicates waiting for it.
+// A nil resp drops the entry, so that the sender's retry is delivered again.
+func (c *dedupCache) finish(id string, e *dedupEntry, resp *cachedResponse) {
+	c.mu.Lock()
+	if resp == nil {
+		if c.entries[id] == e {
+			delete(c.entries, id)
+		}
+	} else {
+		e.resp = resp
+		e.expiresAt = time.Now().Add(c.ttl)
+	}
+	c.mu.Unlock()
+	close(e.done)
+}
+
+// keyString returns the dedup key for logging, or "" when c is nil.
+func (c *dedupCache) keyString() string {
+	if c == nil {
+		return ""
+	}
+	return c.key.String()
+}
+
+func (c *dedupCache) sweep() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweepLocked()
+}
+
+func (c *dedupCache) sweepLocked() {
+	now := time.Now()
+	for id, e := range c.entries {
+		if e.expired(now) {
+			delete(c.entries, id)
+		}
+	}
+}
+
+// expired reports whether e has outlived its ttl. Entries still in flight never expire.
+func (e *dedupEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && now.After(e.expiresAt)
+}
+
+func (r *cachedResponse) write(w http.ResponseWriter) {
+	for k, vv := range r.header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	w.Header().Set(duplicateHeader, "true")
+	w.WriteHeader(r.status)
+	_, _ = w.Write(r.body) //nolint: errcheck
+}
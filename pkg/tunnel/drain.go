@@ -0,0 +1,157 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// drainPollInterval is how often a draining server checks whether a client has moved.
+	drainPollInterval = 100 * time.Millisecond
+	// leaveTimeout bounds how long a drained server waits for its leave message to be gossiped.
+	leaveTimeout = 5 * time.Second
+)
+
+var (
+	errInvalidResumeToken = errors.New("invalid resume token")
+	// errUnknownResumeToken is returned while the offer of the draining server has not been gossiped here yet.
+	errUnknownResumeToken = errors.New("unknown resume token")
+)
+
+// Drain moves the clients to the other servers of the cluster before the server stops. From the start,
+// new channels and connections are refused and /healthz fails. Each connected client is sent a reconnect
+// message with a resume token and keeps receiving webhooks until it has connected to another server.
+// Its connection is closed once its webhooks in flight have completed. Drain then leaves the cluster and returns.
+// Clients that have not moved when ctx is done are disconnected.
+func (s *Server) Drain(ctx context.Context) {
+	if s.draining.Swap(true) {
+		return
+	}
+	s.channelsMu.RLock()
+	channels := maps.Clone(s.channels)
+	s.channelsMu.RUnlock()
+
+	// Without another server the clients have nowhere to go, so they only finish their requests.
+	migrate := s.mlist != nil && len(s.mlist.ActiveNodesWithoutSelf()) > 0
+	slog.Info("Draining server", slog.Int("channels", len(channels)), slog.Bool("migrate", migrate))
+	var wg sync.WaitGroup
+	for id, ch := range channels {
+		if !ch.isActive() {
+			continue
+		}
+		wg.Go(func() { s.drainChannel(ctx, id, ch, migrate) })
+	}
+	wg.Wait()
+
+	if s.mlist != nil {
+		if err := s.mlist.Leave(leaveTimeout); err != nil {
+			slog.Warn("Failed to leave the cluster", slog.String("error", err.Error()))
+		}
+	}
+	slog.Info("Server has been drained")
+}
+
+// writeDraining tells the client to try another server.
+func writeDraining(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Server is draining", http.StatusServiceUnavailable)
+}
+
+// drainChannel asks the client of ch to move and closes its connection once it has.
+func (s *Server) drainChannel(ctx context.Context, channelID string, ch *channel, migrate bool) {
+	if migrate {
+		migrate = s.offerResume(channelID, ch)
+	}
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		// The owner is read before inflight, so that a webhook counted afterwards sees the new owner as well.
+		moved := migrate && s.movedToPeer(channelID)
+		if (moved || !migrate) && ch.inflight.Load() == 0 {
+			if moved {
+				slog.Info("Client has moved to another server", slog.String("channel-id", channelID))
+				ch.disconnect(websocket.CloseNormalClosure, "Channel has moved")
+			} else {
+				ch.disconnect(websocket.CloseGoingAway, "Server is shutting down")
+			}
+			return
+		}
+		select {
+		case <-ctx.Done():
+			slog.Warn("The client did not finish before the drain timeout", slog.String("channel-id", channelID))
+			ch.disconnect(websocket.CloseGoingAway, "Server is shutting down")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// offerResume shares a resume token of the channel with the cluster and sends it to the client.
+func (s *Server) offerResume(channelID string, ch *channel) bool {
+	token, err := newResumeToken(channelID)
+	if err != nil {
+		slog.Warn("Failed to generate a resume token", slog.String("channel-id", channelID), slog.String("error", err.Error()))
+		return false
+	}
+	ch.migrating.Store(true)
+	// Gossiped before the client hears of the token, which it presents to another server.
+	s.mlist.MigrateChannel(channelID, resumeHash(token), ch.owner)
+	if err := ch.send(TunnelMessage{Type: messageTypeReconnect, ResumeToken: token}); err != nil {
+		slog.Warn("Failed to ask the client to reconnect", slog.String("channel-id", channelID), slog.String("error", err.Error()))
+		return false
+	}
+	return true
+}
+
+// movedToPeer reports whether the client of channelID is connected to another server.
+func (s *Server) movedToPeer(channelID string) bool {
+	if s.mlist == nil {
+		return false
+	}
+	c, ok := s.mlist.PeerChannel(channelID)
+	return ok && c.Connected
+}
+
+// resumeChannel returns the channel that token moves here from a draining server.
+// Only the certificate identity that issued the channel may move it.
+func (s *Server) resumeChannel(token, owner string) (string, error) {
+	channelID, _, ok := strings.Cut(token, ".")
+	if !ok || s.mlist == nil {
+		return "", errInvalidResumeToken
+	}
+	c, ok := s.mlist.PeerChannel(channelID)
+	if !ok || c.ResumeHash == "" {
+		return "", errUnknownResumeToken
+	}
+	if subtle.ConstantTimeCompare([]byte(resumeHash(token)), []byte(c.ResumeHash)) != 1 || c.Owner != owner {
+		return "", errInvalidResumeToken
+	}
+	return channelID, nil
+}
+
+// newResumeToken returns a token of channelID that cannot be guessed. The cluster only learns its hash.
+func newResumeToken(channelID string) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return channelID + "." + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+func resumeHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
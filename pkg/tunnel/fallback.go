@@ -0,0 +1,141 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nonchan7720/webhook-over-websocket/pkg/retry"
+)
+
+const defaultRedeliverInterval = 10 * time.Second
+
+// Fallback is returned to the webhook sender instead of 502 when the local target is unreachable.
+// The request is stored in SpoolDir and forwarded to the target once it is reachable again.
+type Fallback struct {
+	Status  int               `yaml:"status"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+
+	// SpoolDir stores requests waiting for redelivery. Defaults to a directory under the user cache directory.
+	SpoolDir string `yaml:"spool_dir"`
+	// RedeliverInterval is how often the spool is checked while the target is down.
+	RedeliverInterval time.Duration `yaml:"redeliver_interval"`
+}
+
+func (f *Fallback) compile() error {
+	if f.Status == 0 {
+		f.Status = http.StatusAccepted
+	}
+	if f.Status < 100 || f.Status > 999 {
+		return fmt.Errorf("invalid fallback status: %d", f.Status)
+	}
+	if f.RedeliverInterval <= 0 {
+		f.RedeliverInterval = defaultRedeliverInterval
+	}
+	if f.SpoolDir == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			dir = os.TempDir()
+		}
+		f.SpoolDir = filepath.Join(dir, "webhook-over-websocket", "spool")
+	}
+	if err := os.MkdirAll(f.SpoolDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	return nil
+}
+
+// response returns the raw canned response.
+func (f *Fallback) response() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", f.Status, http.StatusText(f.Status))
+	header := make(http.Header, len(f.Headers)+1)
+	for key, value := range f.Headers {
+		header.Set(key, value)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(f.Body)))
+	_ = header.Write(&buf) //nolint: errcheck
+	buf.WriteString("\r\n")
+	buf.WriteString(f.Body)
+	return buf.Bytes()
+}
+
+// spooledRequest is a tunneled request waiting for redelivery.
+// Payload is the plaintext raw request as received from the server.
+type spooledRequest struct {
+	ReqID      string    `json:"req_id"`
+	ChannelID  string    `json:"channel_id"`
+	Payload    []byte    `json:"payload"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// spool persists requests as one JSON file each. File names sort in arrival order.
+type spool struct {
+	dir string
+}
+
+func (s *spool) put(req spooledRequest) error {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%020d-%s.json", req.ReceivedAt.UnixNano(), req.ReqID)
+	tmp := filepath.Join(s.dir, "."+name)
+	if err := os.WriteFile(tmp, buf, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, name))
+}
+
+// list returns the spooled file paths, oldest first.
+func (s *spool) list() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		files = append(files, filepath.Join(s.dir, e.Name()))
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+func (s *spool) read(path string) (spooledRequest, error) {
+	var req spooledRequest
+	buf, err := os.ReadFile(path) //nolint: gosec
+	if err != nil {
+		return req, err
+	}
+	err = json.Unmarshal(buf, &req)
+	return req, err
+}
+
+// isUnreachable reports whether err means the request never reached the local target.
+func isUnreachable(err error) bool {
+	if errors.Is(err, retry.ErrCircuitOpen) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// drainBody reads the body so that the connection can be reused.
+func drainBody(body io.ReadCloser) {
+	_, _ = io.Copy(io.Discard, body) //nolint: errcheck
+	_ = body.Close()                 //nolint: errcheck
+}
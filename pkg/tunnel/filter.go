@@ -0,0 +1,246 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/nonchan7720/webhook-over-websocket/pkg/expr"
+)
+
+const defaultFilterStatus = http.StatusAccepted
+
+var (
+	ErrInvalidFilter = errors.New("invalid filter: expected <field>=<values> or <field>!=<values>")
+)
+
+// FilterRule selects the webhooks that go over the tunnel. A rule has the form <field>=<values> or
+// <field>!=<values>, where values are separated by "|" and field is one of:
+//
+//	method            e.g. method=POST
+//	path              a path.Match pattern against the path relative to the channel, e.g. path=/github/*
+//	header:<name>     e.g. header:X-GitHub-Event=push|pull_request
+//	json:<field>      a field of a JSON body, dot separated for nested fields, e.g. json:action!=deleted
+type FilterRule struct {
+	raw    string
+	field  string
+	name   string
+	values []string
+	negate bool
+}
+
+func ParseFilterRule(s string) (*FilterRule, error) {
+	lhs, rhs, ok := strings.Cut(s, "=")
+	if !ok || lhs == "" {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidFilter, s)
+	}
+	rule := &FilterRule{raw: s, values: strings.Split(rhs, "|")}
+	if lhs, ok = strings.CutSuffix(lhs, "!"); ok {
+		rule.negate = true
+	}
+	field, name, _ := strings.Cut(lhs, ":")
+	switch field {
+	case "method", "path":
+		if name != "" {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidFilter, s)
+		}
+	case "header":
+		if name == "" {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidFilter, s)
+		}
+		name = http.CanonicalHeaderKey(name)
+	case "json":
+		if name == "" {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidFilter, s)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown field %q", ErrInvalidFilter, field)
+	}
+	if field == "path" {
+		for _, v := range rule.values {
+			if _, err := path.Match(v, ""); err != nil {
+				return nil, fmt.Errorf("%w: %q: %w", ErrInvalidFilter, s, err)
+			}
+		}
+	}
+	rule.field, rule.name = field, name
+	return rule, nil
+}
+
+func (f *FilterRule) String() string {
+	return f.raw
+}
+
+// webhookRequest is the view of a webhook that filters are evaluated against.
+type webhookRequest struct {
+	r       *http.Request
+	relPath string
+	body    []byte
+	json    any
+	jsonErr error
+	expr    *expr.Request
+}
+
+// newWebhookRequest buffers the body of r so that it can be inspected and still be tunneled.
+func newWebhookRequest(r *http.Request, channelID string) (*webhookRequest, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	_ = r.Body.Close() //nolint: errcheck
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	relPath := strings.TrimPrefix(r.URL.Path, "/webhook/"+channelID)
+	if relPath == "" {
+		relPath = "/"
+	}
+	req := &webhookRequest{r: r, relPath: relPath, body: body}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	req.jsonErr = dec.Decode(&req.json)
+	return req, nil
+}
+
+// exprRequest returns the model of w for expressions, shared by all expressions of the request.
+func (w *webhookRequest) exprRequest() *expr.Request {
+	if w.expr == nil {
+		w.expr = expr.NewRequest(w.r, w.relPath, w.body)
+	}
+	return w.expr
+}
+
+// jsonField returns the field of the JSON body at the dot separated path as a string.
+func (w *webhookRequest) jsonField(fieldPath []string) (string, bool) {
+	if w.jsonErr != nil {
+		return "", false
+	}
+	v := w.json
+	for _, field := range fieldPath {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return "", false
+		}
+		if v, ok = obj[field]; !ok {
+			return "", false
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
+
+func (f *FilterRule) match(w *webhookRequest) bool {
+	var actual []string
+	switch f.field {
+	case "method":
+		actual = []string{w.r.Method}
+	case "path":
+		actual = []string{w.relPath}
+	case "header":
+		actual = w.r.Header.Values(f.name)
+	case "json":
+		if v, ok := w.jsonField(strings.Split(f.name, ".")); ok {
+			actual = []string{v}
+		}
+	}
+	matched := false
+	for _, a := range actual {
+		for _, v := range f.values {
+			if f.matchValue(v, a) {
+				matched = true
+			}
+		}
+	}
+	return matched != f.negate
+}
+
+func (f *FilterRule) matchValue(pattern, actual string) bool {
+	switch f.field {
+	case "method":
+		return strings.EqualFold(pattern, actual)
+	case "path":
+		ok, _ := path.Match(pattern, actual) //nolint: errcheck // Validated by ParseFilterRule.
+		return ok
+	default:
+		return pattern == actual
+	}
+}
+
+// channelFilter drops the webhooks of a channel that do not match every rule and expression.
+type channelFilter struct {
+	rules  []*FilterRule
+	exprs  []*expr.Program
+	status int
+	body   string
+}
+
+func (f *channelFilter) isEmpty() bool {
+	return len(f.rules) == 0 && len(f.exprs) == 0
+}
+
+// rejects returns the first rule or expression w does not match, or nil when w may go over the tunnel.
+// An expression that fails to evaluate rejects w.
+func (f *channelFilter) rejects(w *webhookRequest) fmt.Stringer {
+	for _, rule := range f.rules {
+		if !rule.match(w) {
+			return rule
+		}
+	}
+	for _, p := range f.exprs {
+		matched, err := p.Match(w.exprRequest())
+		if err != nil {
+			slog.DebugContext(w.r.Context(), "Failed to evaluate filter expression", slog.String("error", err.Error()))
+		}
+		if !matched {
+			return p
+		}
+	}
+	return nil
+}
+
+func (f *channelFilter) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(f.status)
+	_, _ = io.WriteString(w, f.body) //nolint: errcheck
+}
+
+// ruleStrings returns the rules for logging, or nil when f is nil.
+func (f *channelFilter) ruleStrings() []string {
+	if f == nil {
+		return nil
+	}
+	rules := make([]string, 0, len(f.rules)+len(f.exprs))
+	for _, rule := range f.rules {
+		rules = append(rules, rule.String())
+	}
+	for _, p := range f.exprs {
+		rules = append(rules, p.String())
+	}
+	return rules
+}
+
+func logFiltered(r *http.Request, channelID string, rule fmt.Stringer) {
+	slog.InfoContext(
+		r.Context(),
+		"Webhook filtered",
+		slog.Bool("filtered", true),
+		slog.String("channel-id", channelID),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("rule", rule.String()),
+	)
+}
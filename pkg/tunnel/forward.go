@@ -0,0 +1,107 @@
+package tunnel
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+
+	"github.com/nonchan7720/webhook-over-websocket/pkg/tlsconfig"
+)
+
+const (
+	// forwardedByHeader marks a request relayed by a peer, which is never relayed again.
+	forwardedByHeader = "X-Webhook-Forwarded-By"
+	// forwardedClientIPHeader and forwardedIdentityHeader carry the client as seen by the relaying peer.
+	forwardedClientIPHeader = "X-Webhook-Client-Ip"
+	forwardedIdentityHeader = "X-Webhook-Client-Identity"
+)
+
+var errNoForwardedClientIP = errors.New("the relaying peer did not send the client ip")
+
+// channelOwner returns the base URL of the peer that holds channelID.
+func (s *Server) channelOwner(channelID string) (string, bool) {
+	if s.mlist == nil {
+		return "", false
+	}
+	ch, ok := s.mlist.PeerChannel(channelID)
+	return ch.ServerURL, ok
+}
+
+// forwardToPeer relays r, a webhook or a WebSocket upgrade of channelID, to the peer that holds the channel.
+// It reports false when no peer does.
+func (s *Server) forwardToPeer(w http.ResponseWriter, r *http.Request, channelID string) bool {
+	if forwardedFrom(r) != nil {
+		// Relayed once already; the peers disagree about the owner.
+		return false
+	}
+	peerURL, ok := s.channelOwner(channelID)
+	if !ok {
+		return false
+	}
+	target, err := url.Parse(peerURL)
+	if err != nil {
+		return false
+	}
+	clientIP, ipErr := s.clientIP(r)
+	identity := s.clientIdentity(r)
+	transport := s.peerClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			// The owner should see the request as it arrived here.
+			pr.Out.Host = pr.In.Host
+			for _, h := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"} {
+				if v, ok := pr.In.Header[h]; ok {
+					pr.Out.Header[h] = v
+				}
+			}
+			pr.Out.Header.Set(forwardedByHeader, s.serverURL)
+			pr.Out.Header.Del(forwardedClientIPHeader)
+			if ipErr == nil {
+				pr.Out.Header.Set(forwardedClientIPHeader, clientIP.String())
+			}
+			pr.Out.Header.Del(forwardedIdentityHeader)
+			if identity != "" {
+				pr.Out.Header.Set(forwardedIdentityHeader, identity)
+			}
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.WarnContext(
+				r.Context(), "Failed to forward to the channel owner",
+				slog.String("channel-id", channelID),
+				slog.String("peer", peerURL),
+				slog.String("error", err.Error()),
+			)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		},
+	}
+	slog.DebugContext(r.Context(), "Forwarding to the channel owner", slog.String("channel-id", channelID), slog.String("peer", peerURL))
+	proxy.ServeHTTP(w, r)
+	return true
+}
+
+// clientIP returns the address of the webhook sender, as resolved by the peer that relayed r if any.
+func (s *Server) clientIP(r *http.Request) (netip.Addr, error) {
+	if f := forwardedFrom(r); f != nil {
+		if !f.clientIP.IsValid() {
+			return netip.Addr{}, errNoForwardedClientIP
+		}
+		return f.clientIP, nil
+	}
+	return s.ipResolver.ClientIP(r)
+}
+
+// clientIdentity returns the identity of the client certificate, as verified by the peer that relayed r if any.
+func (s *Server) clientIdentity(r *http.Request) string {
+	if f := forwardedFrom(r); f != nil {
+		return f.identity
+	}
+	return tlsconfig.PeerIdentity(r.TLS)
+}
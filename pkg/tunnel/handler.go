@@ -0,0 +1,102 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// inProcessRemoteAddr is reported as RemoteAddr to handlers served in-process.
+const inProcessRemoteAddr = "127.0.0.1:0"
+
+// serveHandler serves req directly into h without a local port and returns the recorded response.
+// When ctx is done before h returns, the request fails with ctx.Err() and h keeps running in the background.
+func serveHandler(ctx context.Context, h http.Handler, req *http.Request) (*http.Response, error) {
+	serverReq := req.WithContext(ctx)
+	serverReq.RequestURI = req.URL.RequestURI()
+	serverReq.RemoteAddr = inProcessRemoteAddr
+	if serverReq.Body == nil {
+		serverReq.Body = http.NoBody
+	}
+
+	rec := newResponseRecorder()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- fmt.Errorf("handler panic: %v", p)
+			}
+		}()
+		h.ServeHTTP(rec, serverReq)
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+		return rec.result(req), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// responseRecorder is a minimal http.ResponseWriter that buffers the whole response.
+type responseRecorder struct {
+	header      http.Header
+	body        bytes.Buffer
+	status      int
+	wroteHeader bool
+}
+
+var (
+	_ http.ResponseWriter = (*responseRecorder)(nil)
+	_ http.Flusher        = (*responseRecorder)(nil)
+)
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: make(http.Header), status: http.StatusOK}
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	if r.wroteHeader {
+		return
+	}
+	r.status = statusCode
+	r.wroteHeader = true
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(p)
+}
+
+// Flush is a no-op; the response is returned once the handler completes.
+func (r *responseRecorder) Flush() {}
+
+func (r *responseRecorder) result(req *http.Request) *http.Response {
+	header := r.header.Clone()
+	if header.Get("Content-Type") == "" && r.body.Len() > 0 {
+		header.Set("Content-Type", http.DetectContentType(r.body.Bytes()))
+	}
+	header.Set("Content-Length", strconv.Itoa(r.body.Len()))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.status, http.StatusText(r.status)),
+		StatusCode:    r.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(r.body.Bytes())),
+		ContentLength: int64(r.body.Len()),
+		Request:       req,
+	}
+}
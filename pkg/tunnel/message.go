@@ -0,0 +1,27 @@
+package tunnel
+
+// TunnelMessage is the frame exchanged over the WebSocket between the server and the client.
+// Payload carries a raw HTTP request (server to client) or a raw HTTP response (client to server).
+type TunnelMessage struct {
+	ReqID   string `json:"req_id"`
+	Payload []byte `json:"payload"`
+	// Encrypted reports that Payload is sealed with the public key the client registered on /new.
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Type is empty for requests and responses. See the messageType constants for control messages.
+	Type string `json:"type,omitempty"`
+	// RetryAfter is the number of seconds the sender of an overloaded message asks to wait.
+	RetryAfter int `json:"retry_after,omitempty"`
+	// ResumeToken moves the channel to another server when passed to /new, see messageTypeReconnect.
+	ResumeToken string `json:"resume_token,omitempty"`
+}
+
+const (
+	// messageTypeOverloaded is sent by the client instead of a response when it cannot accept the request.
+	messageTypeOverloaded = "overloaded"
+	// messageTypeReconnect is sent by a draining server to ask the client to move its channel to another server.
+	// The server keeps tunneling requests until the client has connected elsewhere and its requests in flight are done.
+	messageTypeReconnect = "reconnect"
+)
+
+// e2eEncryption is the scheme reported on /new when end-to-end encryption is enabled for the channel.
+const e2eEncryption = "x25519-aes256gcm"
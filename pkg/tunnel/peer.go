@@ -0,0 +1,134 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+
+	"github.com/nonchan7720/webhook-over-websocket/pkg/tlsconfig"
+)
+
+// clusterSecretHeader carries the shared secret on requests between peers.
+const clusterSecretHeader = "X-Webhook-Cluster-Secret"
+
+// peerRequest marks a request that was authenticated as coming from a peer.
+type peerRequest struct {
+	// forwarded is set when the peer relayed the request for a client.
+	forwarded *forwarded
+}
+
+// forwarded is the client of a request relayed by a peer, as the peer saw it.
+type forwarded struct {
+	clientIP netip.Addr
+	identity string
+}
+
+type peerRequestKey struct{}
+
+func peerRequestFrom(r *http.Request) *peerRequest {
+	p, _ := r.Context().Value(peerRequestKey{}).(*peerRequest)
+	return p
+}
+
+func forwardedFrom(r *http.Request) *forwarded {
+	if p := peerRequestFrom(r); p != nil {
+		return p.forwarded
+	}
+	return nil
+}
+
+// requiresPeerAuth reports whether peers must present the cluster secret or a client certificate.
+func (s *Server) requiresPeerAuth() bool {
+	return s.clusterSecret != "" || len(s.peerIdentities) > 0
+}
+
+// acceptPeer removes the cluster headers from r and, when r comes from a peer, keeps the client they describe.
+// Anyone else could forge them, so they are ignored on requests from outside the cluster.
+func (s *Server) acceptPeer(r *http.Request) *http.Request {
+	secret := r.Header.Get(clusterSecretHeader)
+	isForwarded := len(r.Header.Values(forwardedByHeader)) > 0
+	if secret == "" && !isForwarded && len(s.peerIdentities) == 0 {
+		return r
+	}
+	f := &forwarded{identity: r.Header.Get(forwardedIdentityHeader)}
+	f.clientIP, _ = netip.ParseAddr(r.Header.Get(forwardedClientIPHeader)) //nolint: errcheck
+	for _, h := range []string{clusterSecretHeader, forwardedByHeader, forwardedClientIPHeader, forwardedIdentityHeader} {
+		r.Header.Del(h)
+	}
+	if !s.authenticatePeer(r, secret) {
+		if isForwarded {
+			slog.WarnContext(r.Context(), "Ignoring forwarding headers from outside the cluster", slog.String("remote-addr", r.RemoteAddr))
+		}
+		return r
+	}
+	p := &peerRequest{}
+	if isForwarded {
+		p.forwarded = f
+	}
+	return r.WithContext(context.WithValue(r.Context(), peerRequestKey{}, p))
+}
+
+// authenticatePeer checks the cluster secret and the client certificate of r when they are required.
+// Otherwise a peer is recognized by its address alone.
+func (s *Server) authenticatePeer(r *http.Request, secret string) bool {
+	if !s.requiresPeerAuth() {
+		return s.isPeer(r.RemoteAddr)
+	}
+	if s.clusterSecret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(s.clusterSecret)) != 1 {
+		return false
+	}
+	if len(s.peerIdentities) > 0 && !slices.Contains(s.peerIdentities, tlsconfig.PeerIdentity(r.TLS)) {
+		return false
+	}
+	return true
+}
+
+// isPeer reports whether remoteAddr belongs to one of the active peers.
+func (s *Server) isPeer(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	for _, peerURL := range s.peerURLs() {
+		u, err := url.Parse(peerURL)
+		if err != nil {
+			continue
+		}
+		if peerAddr, err := netip.ParseAddr(u.Hostname()); err == nil && peerAddr.Unmap() == addr.Unmap() {
+			return true
+		}
+	}
+	return false
+}
+
+// peerOnly restricts next to peers once peer authentication is configured.
+func (s *Server) peerOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.requiresPeerAuth() && peerRequestFrom(r) == nil {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// clusterSecretTransport adds the cluster secret to the requests sent to peers.
+type clusterSecretTransport struct {
+	secret string
+	base   http.RoundTripper
+}
+
+func (t *clusterSecretTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(clusterSecretHeader, t.secret)
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,195 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nonchan7720/webhook-over-websocket/pkg/retry"
+)
+
+const (
+	defaultRetryMaxAttempts     = 3
+	defaultRetryInitialInterval = 500 * time.Millisecond
+	defaultRetryMaxInterval     = 5 * time.Second
+	// defaultRetryMaxElapsedTime stays inside the server's default webhook timeout (30s).
+	defaultRetryMaxElapsedTime = 20 * time.Second
+)
+
+// defaultRetryMethods are the idempotent methods retried on any route.
+var defaultRetryMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete}
+
+// RetryPolicy retries deliveries to the local target that were refused, or answered with one of StatusCodes.
+// Only requests with one of Methods, or requests matching a route marked idempotent, are retried.
+type RetryPolicy struct {
+	MaxAttempts int      `yaml:"max_attempts"`
+	StatusCodes []int    `yaml:"status_codes"`
+	Methods     []string `yaml:"methods"`
+
+	InitialInterval time.Duration `yaml:"initial_interval"`
+	MaxInterval     time.Duration `yaml:"max_interval"`
+	// MaxElapsedTime bounds all attempts including backoff. Keep it below the server's webhook timeout.
+	MaxElapsedTime time.Duration `yaml:"max_elapsed_time"`
+}
+
+func (p *RetryPolicy) compile() error {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if p.MaxAttempts < 1 {
+		return fmt.Errorf("invalid retry max_attempts: %d", p.MaxAttempts)
+	}
+	for _, code := range p.StatusCodes {
+		if code < 500 || code > 599 {
+			return fmt.Errorf("invalid retry status code: %d (only 5xx can be retried)", code)
+		}
+	}
+	if len(p.Methods) == 0 {
+		p.Methods = defaultRetryMethods
+	}
+	if p.InitialInterval <= 0 {
+		p.InitialInterval = defaultRetryInitialInterval
+	}
+	if p.MaxInterval <= 0 {
+		p.MaxInterval = defaultRetryMaxInterval
+	}
+	if p.MaxElapsedTime <= 0 {
+		p.MaxElapsedTime = defaultRetryMaxElapsedTime
+	}
+	return nil
+}
+
+// allows reports whether req may be sent more than once.
+func (p *RetryPolicy) allows(req *http.Request, route *Route) bool {
+	if p == nil || p.MaxAttempts <= 1 {
+		return false
+	}
+	if route != nil && route.Idempotent {
+		return true
+	}
+	return slices.ContainsFunc(p.Methods, func(m string) bool { return strings.EqualFold(m, req.Method) })
+}
+
+// backoff returns the exponential backoff before the next attempt.
+func (p *RetryPolicy) backoff(retryCount int) time.Duration {
+	d := p.InitialInterval << retryCount
+	if d <= 0 || d > p.MaxInterval {
+		d = p.MaxInterval
+	}
+	return d
+}
+
+var errRetryableStatus = errors.New("retryable status")
+
+// doLocalWithRetry sends req to the local target according to the retry policy.
+// When all attempts are answered with a retryable status, the last response is returned.
+func (c *Client) doLocalWithRetry(ctx context.Context, reqID string, req *http.Request, route *Route) (*http.Response, error) {
+	if !c.retry.allows(req, route) {
+		return c.doLocal(ctx, req)
+	}
+	// MaxElapsedTime is a deadline, so that the attempt after the last backoff cannot outlive it.
+	// It is released once the response body has been read.
+	ctx, cancel := context.WithTimeout(ctx, c.retry.MaxElapsedTime)
+	resp, err := c.retryLocal(ctx, reqID, req)
+	if resp == nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, err
+}
+
+// cancelOnClose cancels the context of a response when its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+func (c *Client) retryLocal(ctx context.Context, reqID string, req *http.Request) (*http.Response, error) {
+	p := c.retry
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		_ = req.Body.Close() //nolint: errcheck
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		attempt  int
+		lastResp *http.Response
+		lastErr  error
+	)
+	resp, err := retry.ExponentialBackoff(ctx, func() (*http.Response, error) {
+		if attempt > 0 {
+			slog.Info(fmt.Sprintf("[ReqID: %s] Retrying delivery to the local server (attempt %d/%d): %v", reqID, attempt+1, p.MaxAttempts, lastErr))
+			if lastResp != nil {
+				drainBody(lastResp.Body)
+				lastResp = nil
+			}
+		}
+		attempt++
+
+		r := req.Clone(ctx)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		resp, err := c.doLocal(ctx, r)
+		if err != nil {
+			lastErr = err
+			// Retrying is pointless while the circuit is open; fail fast instead.
+			if !isUnreachable(err) || errors.Is(err, retry.ErrCircuitOpen) {
+				return nil, retry.NewSkip(err)
+			}
+			return nil, err
+		}
+		if slices.Contains(p.StatusCodes, resp.StatusCode) {
+			// The body is buffered, as it may be returned after ctx has run out, which would cut it off.
+			buffered, err := io.ReadAll(resp.Body)
+			_ = resp.Body.Close() //nolint: errcheck
+			if err != nil {
+				lastErr = err
+				return nil, err
+			}
+			resp.Body = io.NopCloser(bytes.NewReader(buffered))
+			lastResp = resp
+			lastErr = fmt.Errorf("%w: %d", errRetryableStatus, resp.StatusCode)
+			if delay, ok := retry.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				return nil, retry.NewRetryAfter(lastErr, delay)
+			}
+			return nil, lastErr
+		}
+		return resp, nil
+	},
+		retry.WithMaxRetries(p.MaxAttempts),
+		retry.WithCalExponentialBackoff(p.backoff),
+		retry.WithJitter(retry.EqualJitter),
+		retry.WithMaxElapsedTime(p.MaxElapsedTime),
+	)
+	if err == nil {
+		return resp, nil
+	}
+	exhausted := errors.Is(err, retry.ErrMaxRetry) || errors.Is(err, retry.ErrMaxElapsedTime) || errors.Is(err, context.DeadlineExceeded)
+	if lastResp != nil {
+		if exhausted {
+			return lastResp, nil
+		}
+		drainBody(lastResp.Body)
+	}
+	if exhausted {
+		return nil, lastErr
+	}
+	return nil, err
+}
@@ -0,0 +1,215 @@
+package tunnel
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/nonchan7720/webhook-over-websocket/pkg/expr"
+)
+
+// Route forwards matching requests to a dedicated local target.
+// Routes are evaluated in order and the first match wins; unmatched requests go to the client's target URL.
+//
+// PathPrefix is matched against the path relative to the channel, i.e. without "/webhook/{channel_id}",
+// and matched requests are forwarded with that relative path appended to the path of Target.
+type Route struct {
+	Name       string            `yaml:"name"`
+	PathPrefix string            `yaml:"path_prefix"`
+	Host       string            `yaml:"host"`
+	Method     string            `yaml:"method"`
+	Headers    map[string]string `yaml:"headers"`
+	// When is a CEL expression that must also be true, see package expr.
+	When string `yaml:"when"`
+
+	Target string `yaml:"target"`
+	// StripPrefix removes PathPrefix from the forwarded path.
+	StripPrefix bool `yaml:"strip_prefix"`
+	// RewritePrefix replaces PathPrefix in the forwarded path.
+	RewritePrefix string `yaml:"rewrite_prefix"`
+	// Idempotent marks requests on the route as safe to retry whatever their method is.
+	Idempotent bool `yaml:"idempotent"`
+
+	// Request and Response transform the request forwarded to Target and the response returned from it.
+	Request  *Transform `yaml:"request"`
+	Response *Transform `yaml:"response"`
+
+	target *url.URL
+	when   *expr.Program
+}
+
+func (r *Route) compile() error {
+	if r.Target == "" {
+		return fmt.Errorf("route %s: target is required", r.Name)
+	}
+	target, err := url.Parse(r.Target)
+	if err != nil {
+		return fmt.Errorf("route %s: invalid target: %w", r.Name, err)
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return fmt.Errorf("route %s: target must be an absolute URL: %s", r.Name, r.Target)
+	}
+	if r.StripPrefix && r.RewritePrefix != "" {
+		return fmt.Errorf("route %s: strip_prefix and rewrite_prefix are exclusive", r.Name)
+	}
+	r.target = target
+	if r.Name == "" {
+		r.Name = r.Target
+	}
+	if r.When != "" {
+		if r.when, err = expr.Compile(r.When); err != nil {
+			return fmt.Errorf("route %s: when: %w", r.Name, err)
+		}
+	}
+	if err := r.Request.compile(r.Name + "/request"); err != nil {
+		return fmt.Errorf("route %s: request: %w", r.Name, err)
+	}
+	if err := r.Response.compile(r.Name + "/response"); err != nil {
+		return fmt.Errorf("route %s: response: %w", r.Name, err)
+	}
+	return nil
+}
+
+// match reports whether req, whose path relative to the channel is relPath, matches the route.
+// model returns the request model for the When expression.
+func (r *Route) match(req *http.Request, relPath string, model func() *expr.Request) bool {
+	if r.Method != "" && !strings.EqualFold(r.Method, req.Method) {
+		return false
+	}
+	if r.PathPrefix != "" && !hasPathPrefix(relPath, r.PathPrefix) {
+		return false
+	}
+	if r.Host != "" && !matchHost(r.Host, req.Host) {
+		return false
+	}
+	for key, value := range r.Headers {
+		values := req.Header.Values(key)
+		if len(values) == 0 {
+			return false
+		}
+		// An empty value only requires the header to be present.
+		if value != "" && !containsFold(values, value) {
+			return false
+		}
+	}
+	if r.when != nil {
+		matched, err := r.when.Match(model())
+		if err != nil {
+			slog.Debug(fmt.Sprintf("Route %q: %v", r.Name, err))
+		}
+		return matched
+	}
+	return true
+}
+
+// forwardPath returns the path sent to the route's target.
+func (r *Route) forwardPath(relPath string) string {
+	p := relPath
+	switch {
+	case r.StripPrefix && r.PathPrefix != "":
+		p = strings.TrimPrefix(relPath, strings.TrimSuffix(r.PathPrefix, "/"))
+	case r.RewritePrefix != "" && r.PathPrefix != "":
+		p = r.RewritePrefix + strings.TrimPrefix(relPath, strings.TrimSuffix(r.PathPrefix, "/"))
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	if r.target.Path == "" || r.target.Path == "/" {
+		return p
+	}
+	joined := path.Join(r.target.Path, p)
+	if strings.HasSuffix(p, "/") && !strings.HasSuffix(joined, "/") {
+		joined += "/"
+	}
+	return joined
+}
+
+func hasPathPrefix(p, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return true
+	}
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// matchHost compares hosts without ports. A leading "*." matches any subdomain.
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(strings.ToLower(host), "."+strings.ToLower(suffix))
+	}
+	return strings.EqualFold(pattern, host)
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRoute parses the flag form of a route: comma separated key=value pairs, e.g.
+//
+//	name=github,path=/github,header=X-GitHub-Event:push,target=http://localhost:3000,strip-prefix=true
+//
+// A CEL expression may contain commas, so "when" must be the last key and takes the rest of s.
+func ParseRoute(s string) (Route, error) {
+	var route Route
+	if i := strings.Index(s, "when="); i == 0 || (i > 0 && s[i-1] == ',') {
+		route.When = s[i+len("when="):]
+		s = strings.TrimSuffix(s[:i], ",")
+	}
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" && route.When != "" {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return route, fmt.Errorf("invalid route option %q: expected key=value", pair)
+		}
+		switch key {
+		case "name":
+			route.Name = value
+		case "path", "path-prefix":
+			route.PathPrefix = value
+		case "host":
+			route.Host = value
+		case "method":
+			route.Method = value
+		case "header":
+			name, headerValue, _ := strings.Cut(value, ":")
+			if route.Headers == nil {
+				route.Headers = make(map[string]string)
+			}
+			route.Headers[name] = headerValue
+		case "target":
+			route.Target = value
+		case "strip-prefix":
+			strip, err := strconv.ParseBool(value)
+			if err != nil {
+				return route, fmt.Errorf("invalid strip-prefix %q: %w", value, err)
+			}
+			route.StripPrefix = strip
+		case "rewrite-prefix":
+			route.RewritePrefix = value
+		case "idempotent":
+			idempotent, err := strconv.ParseBool(value)
+			if err != nil {
+				return route, fmt.Errorf("invalid idempotent %q: %w", value, err)
+			}
+			route.Idempotent = idempotent
+		default:
+			return route, fmt.Errorf("unknown route option: %s", key)
+		}
+	}
+	return route, nil
+}
@@ -0,0 +1,1056 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/nonchan7720/webhook-over-websocket/pkg/cluster"
+	"github.com/nonchan7720/webhook-over-websocket/pkg/e2e"
+	"github.com/nonchan7720/webhook-over-websocket/pkg/expr"
+	"github.com/nonchan7720/webhook-over-websocket/pkg/ipfilter"
+	"github.com/nonchan7720/webhook-over-websocket/pkg/traefik"
+)
+
+const defaultWebhookTimeout = 30 * time.Second
+
+var (
+	errSendFailed       = errors.New("failed to send to client")
+	errWebhookTimeout   = errors.New("timed out waiting for the client's response")
+	errEncryptFailed    = errors.New("failed to encrypt request")
+	errClientOverloaded = errors.New("client is overloaded")
+)
+
+// Server accepts webhooks and tunnels them to the clients connected over WebSocket.
+// It is an http.Handler, and every Server owns its own channels so that several can run in one process.
+type Server struct {
+	serverURL string
+	version   string
+	startedAt time.Time
+
+	channels   map[string]*channel
+	channelsMu sync.RWMutex
+	// closedChannels are the channels deleted within closedChannelTTL, guarded by channelsMu.
+	closedChannels map[string]*closedChannel
+
+	pendingRequests map[string]chan TunnelMessage
+	pendingMu       sync.RWMutex
+
+	upgrader websocket.Upgrader
+	mux      *http.ServeMux
+
+	mlist      *cluster.Memberlist
+	peerScheme string
+	peerPort   int
+	peerClient *http.Client
+	// clusterSecret and peerIdentities authenticate the requests between peers.
+	clusterSecret  string
+	peerIdentities []string
+	// internal serves the endpoints for peers and Traefik, which separateInternal keeps off the public handler.
+	internal         http.Handler
+	separateInternal bool
+
+	ipPresets        ipfilter.Presets
+	defaultAllowlist []string
+	ipResolver       *ipfilter.ClientIPResolver
+
+	requireClientCert bool
+	webhookTimeout    time.Duration
+
+	dedupKey *DedupKey
+	dedupTTL time.Duration
+
+	filterRules  []*FilterRule
+	filterExprs  []*expr.Program
+	filterStatus int
+	filterBody   string
+
+	deadLetters DeadLetterStore
+	adminToken  string
+
+	// draining refuses new channels and connections, see Drain.
+	draining atomic.Bool
+}
+
+var (
+	_ http.Handler = (*Server)(nil)
+)
+
+func NewServer(opts ...ServerOption) *Server {
+	s := &Server{
+		channels:        make(map[string]*channel),
+		closedChannels:  make(map[string]*closedChannel),
+		pendingRequests: make(map[string]chan TunnelMessage),
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		peerScheme:     "http",
+		peerClient:     &http.Client{Timeout: 2 * time.Second}, // Keep it brief to avoid making them wait for a response.
+		ipResolver:     &ipfilter.ClientIPResolver{},
+		webhookTimeout: defaultWebhookTimeout,
+		filterStatus:   defaultFilterStatus,
+		startedAt:      time.Now(),
+	}
+	for _, opt := range opts {
+		opt.apply(s)
+	}
+	if s.clusterSecret != "" {
+		client := *s.peerClient
+		base := client.Transport
+		if base == nil {
+			base = http.DefaultTransport
+		}
+		client.Transport = &clusterSecretTransport{secret: s.clusterSecret, base: base}
+		s.peerClient = &client
+	}
+	if s.adminToken != "" && s.mlist != nil && !s.requiresPeerAuth() {
+		slog.Warn("Admin requests only cover this server without a cluster secret or peer identities")
+	}
+
+	internal := http.NewServeMux()
+	// The HTTP Provider in Traefik periodically checks the configuration output endpoint.
+	internal.HandleFunc("/traefik-config", s.peerOnly(s.handleTraefikConfig))
+	// Internal endpoint for peers to share information (additional)
+	internal.HandleFunc("/internal/channels", s.peerOnly(s.handleInternalChannels))
+	s.internal = internal
+
+	mux := http.NewServeMux()
+	// Endpoint for clients to generate channelId upon startup
+	mux.HandleFunc("/new", s.handleNewChannel)
+	if !s.separateInternal {
+		mux.Handle("/traefik-config", internal)
+		mux.Handle("/internal/", internal)
+	}
+	// Waiting for WebSocket connections from clients
+	mux.HandleFunc("/ws/{channelId}", s.handleWebSocket)
+	// External webhook reception point via Traefik
+	mux.HandleFunc("/webhook/", s.handleWebhook)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		// Take the server out of the load balancer while it drains.
+		if s.draining.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`{"status":"draining"}`)) //nolint:errcheck
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"status":"OK"}`)) //nolint:errcheck
+	})
+	// Operator endpoints, only served when an admin token is configured
+	if s.adminToken != "" {
+		s.registerAdminHandlers(mux)
+	}
+	s.mux = mux
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, s.acceptPeer(r))
+}
+
+// InternalHandler serves /traefik-config and /internal/channels, e.g. on a listener that is not exposed publicly.
+func (s *Server) InternalHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.internal.ServeHTTP(w, s.acceptPeer(r))
+	})
+}
+
+// RunCleanup removes channels that were issued but not connected within interval, until ctx is canceled.
+func (s *Server) RunCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.cleanNonActiveSession(interval)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Server) handleNewChannel(w http.ResponseWriter, r *http.Request) { //nolint: cyclop
+	if s.draining.Load() {
+		writeDraining(w)
+		return
+	}
+	owner := s.clientIdentity(r)
+	if s.requireClientCert && owner == "" {
+		http.Error(w, "Client certificate required", http.StatusUnauthorized)
+		return
+	}
+	policy, err := s.newChannelPolicy(r.URL.Query(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var publicKey *ecdh.PublicKey
+	if v := r.URL.Query().Get("public_key"); v != "" {
+		if publicKey, err = e2e.ParsePublicKey(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// A client asked to move by a draining server keeps its channel.
+	channelID := uuid.New().String()
+	token := r.URL.Query().Get("resume")
+	if token != "" {
+		if channelID, err = s.resumeChannel(token, owner); err != nil {
+			status := http.StatusForbidden
+			if errors.Is(err, errUnknownResumeToken) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+	ch := &channel{
+		owner:     owner,
+		publicKey: publicKey,
+		createdAt: time.Now(),
+	}
+	ch.policy.Store(policy)
+	s.channelsMu.Lock()
+	if _, exists := s.channels[channelID]; exists {
+		// The channel has been resumed here already.
+		s.channelsMu.Unlock()
+		http.Error(w, errInvalidResumeToken.Error(), http.StatusForbidden)
+		return
+	}
+	s.channels[channelID] = ch
+	delete(s.closedChannels, channelID)
+	s.channelsMu.Unlock()
+	s.announceChannel(channelID, false)
+	resp := map[string]string{"channel_id": channelID}
+	if publicKey != nil {
+		resp["encryption"] = e2eEncryption
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp) //nolint: errcheck,errchkjson
+	slog.Info(
+		"new Channel ID has been issued",
+		slog.String("channel-id", channelID),
+		slog.String("owner", owner),
+		slog.Bool("resumed", token != ""),
+		slog.Bool("e2e", publicKey != nil),
+		slog.Any("allowlist", policy.allowlist.Entries()),
+		slog.String("dedup-key", policy.dedup.keyString()),
+		slog.Any("filter", policy.filter.ruleStrings()),
+	)
+}
+
+// newChannelPolicy returns the policy requested by the query parameters of /new. When current is given,
+// the settings whose parameters are absent are kept from it.
+func (s *Server) newChannelPolicy(query url.Values, current *channelPolicy) (*channelPolicy, error) {
+	policy := &channelPolicy{}
+	if current != nil {
+		*policy = *current
+	}
+	if entries, ok := query["allow"]; ok || current == nil {
+		if len(entries) == 0 {
+			entries = s.defaultAllowlist
+		}
+		allowlist, err := ipfilter.NewAllowlist(entries, s.ipPresets)
+		if err != nil {
+			return nil, err
+		}
+		policy.allowlist = allowlist
+	}
+	if current == nil || query.Has("dedup_key") || query.Has("dedup_ttl") {
+		dedup, err := s.newChannelDedup(query)
+		if err != nil {
+			return nil, err
+		}
+		policy.dedup = dedup
+	}
+	if current == nil || query.Has("filter") || query.Has("filter_expr") || query.Has("filter_status") || query.Has("filter_body") {
+		filter, err := s.newChannelFilter(query)
+		if err != nil {
+			return nil, err
+		}
+		policy.filter = filter
+	}
+	return policy, nil
+}
+
+// newChannelDedup returns the deduplication requested by the dedup_key and dedup_ttl query parameters,
+// or the server default. It returns nil when deduplication is disabled.
+func (s *Server) newChannelDedup(query url.Values) (*dedupCache, error) {
+	key, ttl := s.dedupKey, s.dedupTTL
+	if v := query.Get("dedup_key"); v != "" {
+		var err error
+		if key, err = ParseDedupKey(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := query.Get("dedup_ttl"); v != "" {
+		var err error
+		if ttl, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid dedup_ttl: %w", err)
+		}
+	}
+	if key == nil {
+		return nil, nil
+	}
+	return newDedupCache(key, ttl), nil
+}
+
+// newChannelFilter returns the filter requested by the filter, filter_expr, filter_status and filter_body query parameters,
+// falling back to the server defaults. It returns nil when the channel has no filter rules.
+func (s *Server) newChannelFilter(query url.Values) (*channelFilter, error) {
+	f := &channelFilter{rules: s.filterRules, exprs: s.filterExprs, status: s.filterStatus, body: s.filterBody}
+	if query.Has("filter") || query.Has("filter_expr") {
+		f.rules, f.exprs = nil, nil
+		for _, v := range query["filter"] {
+			rule, err := ParseFilterRule(v)
+			if err != nil {
+				return nil, err
+			}
+			f.rules = append(f.rules, rule)
+		}
+		for _, v := range query["filter_expr"] {
+			p, err := expr.Compile(v)
+			if err != nil {
+				return nil, err
+			}
+			f.exprs = append(f.exprs, p)
+		}
+	}
+	if f.isEmpty() {
+		return nil, nil
+	}
+	if v := query.Get("filter_status"); v != "" {
+		status, err := strconv.Atoi(v)
+		if err != nil || status < 100 || status > 999 {
+			return nil, fmt.Errorf("invalid filter_status: %q", v)
+		}
+		f.status = status
+	}
+	if query.Has("filter_body") {
+		f.body = query.Get("filter_body")
+	}
+	return f, nil
+}
+
+type InternalChannelsResp struct {
+	WsChannels      []string `json:"ws_channels"`
+	WebhookChannels []string `json:"webhook_channels"`
+	ServerURL       string   `json:"server_url"`
+}
+
+func (s *Server) localChannels() InternalChannelsResp {
+	var wsChannels []string
+	var webhookChannels []string
+
+	s.channelsMu.RLock()
+	for id, ch := range s.channels {
+		// WS用のルーターは未接続（発行済み）でも作成する
+		wsChannels = append(wsChannels, id)
+		// Webhook用のルーターは実際に接続済み（isActive）の時のみ作成する
+		if ch.isActive() {
+			webhookChannels = append(webhookChannels, id)
+		}
+	}
+	s.channelsMu.RUnlock()
+
+	return InternalChannelsResp{
+		WsChannels:      wsChannels,
+		WebhookChannels: webhookChannels,
+		ServerURL:       s.serverURL,
+	}
+}
+
+func (s *Server) handleInternalChannels(w http.ResponseWriter, r *http.Request) {
+	info := s.localChannels()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&info) //nolint: errcheck,errchkjson
+}
+
+func (s *Server) handleTraefikConfig(w http.ResponseWriter, r *http.Request) {
+	config := traefik.Config{
+		HTTP: traefik.HTTPConfig{
+			Routers:  make(map[string]traefik.RouterConfig),
+			Services: make(map[string]traefik.ServiceConfig),
+		},
+	}
+
+	allChannels := make(map[string]InternalChannelsResp) // key: ServerURL
+
+	// First, obtain your own information.
+	allChannels[s.serverURL] = s.localChannels()
+
+	// The channels of the other nodes are known from memberlist gossip, so no peer has to be asked.
+	if s.mlist != nil {
+		for _, c := range s.mlist.PeerChannels() {
+			// Since my information is the latest in memory, I won't overwrite it.
+			if c.ServerURL == s.serverURL {
+				continue
+			}
+			info := allChannels[c.ServerURL]
+			info.ServerURL = c.ServerURL
+			info.WsChannels = append(info.WsChannels, c.ID)
+			if c.Connected {
+				info.WebhookChannels = append(info.WebhookChannels, c.ID)
+			}
+			allChannels[c.ServerURL] = info
+		}
+	}
+
+	// Merge information from all nodes to create JSON for Traefik
+	for serverURL, info := range allChannels {
+		// First, create the required service definitions uniquely.
+		channelSet := make(map[string]bool)
+		for _, id := range info.WsChannels {
+			channelSet[id] = true
+		}
+		for _, id := range info.WebhookChannels {
+			channelSet[id] = true
+		}
+
+		for channelID := range channelSet {
+			serviceName := "service-" + channelID
+			config.HTTP.Services[serviceName] = traefik.ServiceConfig{
+				LoadBalancer: traefik.LoadBalancerConfig{
+					Servers: []traefik.ServerConfig{{URL: serverURL}},
+				},
+			}
+		}
+		// Webhook connection router (only for connected clients)
+		for _, channelID := range info.WebhookChannels {
+			webhookRouterName := "webhook-" + channelID
+			serviceName := "service-" + channelID
+
+			config.HTTP.Routers[webhookRouterName] = traefik.RouterConfig{
+				Rule:    fmt.Sprintf("PathPrefix(`/webhook/%s`)", channelID),
+				Service: serviceName,
+			}
+		}
+		// Router for WebSocket connections (all channels, including unconnected ones)
+		for _, channelID := range info.WsChannels {
+			wsRouterName := "ws-" + channelID
+			serviceName := "service-" + channelID
+
+			config.HTTP.Routers[wsRouterName] = traefik.RouterConfig{
+				Rule:    fmt.Sprintf("PathPrefix(`/ws/%s`)", channelID),
+				Service: serviceName,
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = config.ToJSON(w) //nolint: errcheck,errchkjson
+}
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) { //nolint: cyclop
+	channelID := r.PathValue("channelId")
+	if channelID == "" {
+		http.Error(w, "Missing channel_id", http.StatusBadRequest)
+		return
+	}
+	s.channelsMu.RLock()
+	ch, exists := s.channels[channelID]
+	s.channelsMu.RUnlock()
+	if !exists || ch.migrating.Load() {
+		// The channel may have been issued by, or moved to, another server behind the same load balancer.
+		if s.forwardToPeer(w, r, channelID) {
+			return
+		}
+		if !exists {
+			http.Error(w, "Forbidden or invalid channel_id", http.StatusForbidden)
+			return
+		}
+	}
+	if s.draining.Load() {
+		writeDraining(w)
+		return
+	}
+	// Only the certificate identity that issued the channel may connect to it.
+	identity := s.clientIdentity(r)
+	if s.requireClientCert && identity == "" {
+		http.Error(w, "Client certificate required", http.StatusUnauthorized)
+		return
+	}
+	if ch.owner != "" && ch.owner != identity {
+		http.Error(w, "Forbidden or invalid channel_id", http.StatusForbidden)
+		return
+	}
+
+	// WebSocket upgrades are an HTTP/1.1 mechanism (RFC 6455); HTTP/2 is only served for webhooks.
+	if r.ProtoMajor != 1 {
+		http.Error(w, "WebSocket requires HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	ch.mu.Lock()
+	if ch.isActive() {
+		ch.mu.Unlock()
+		http.Error(w, "Channel is already in use", http.StatusConflict)
+		return
+	}
+	// The upgrade process causes network I/O waits, so unlock it.
+	ch.mu.Unlock()
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Upgrade error", slog.String("error", err.Error()))
+		return
+	}
+	// After the upgrade succeeds, unlock it again and store it
+	// final confirmation that it hasn't been intercepted in the meantime.
+	ch.mu.Lock()
+	if ch.isActive() {
+		ch.mu.Unlock()
+		_ = conn.WriteMessage( //nolint: errcheck
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Channel is already in use"),
+		)
+		_ = conn.Close() //nolint: errcheck
+		return
+	}
+	ch.wsConn.Store(conn)
+	ch.connectedAt = time.Now()
+	ch.mu.Unlock()
+	s.announceChannel(channelID, true)
+
+	slog.Info(fmt.Sprintf("Client connected: %s", channelID))
+
+	defer func() {
+		// The client may have moved the channel to another server, whose claim must not be retracted.
+		moved := s.movedToPeer(channelID)
+		s.channelsMu.Lock()
+		kept := ch.reconnectable.Swap(false)
+		if kept {
+			// Disconnected by an operator; the client may connect to the channel again.
+			ch.mu.Lock()
+			ch.wsConn.Store(nil)
+			ch.mu.Unlock()
+			ch.disconnectedAt = time.Now()
+		} else if moved {
+			delete(s.channels, channelID)
+		} else if !ch.revoked.Load() {
+			s.closeChannelLocked(channelID, ch)
+		}
+		s.channelsMu.Unlock()
+		switch {
+		case kept:
+			s.announceChannel(channelID, false)
+		case !moved:
+			s.retractChannel(channelID)
+		}
+		_ = conn.Close() //nolint: errcheck
+		slog.Info(fmt.Sprintf("Client disconnected: %s", channelID))
+	}()
+
+	// Loop to receive client responses from WebSocket
+	for {
+		msgType, payload, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		if msgType != websocket.TextMessage && msgType != websocket.BinaryMessage {
+			continue
+		}
+
+		var msg TunnelMessage
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			slog.Warn("Failed to unmarshal tunnel message", slog.String("error", err.Error()))
+			continue
+		}
+
+		s.deliverResponse(msg)
+	}
+}
+
+// deliverResponse passes the response to the handler waiting for the corresponding ReqID.
+func (s *Server) deliverResponse(msg TunnelMessage) {
+	s.pendingMu.RLock()
+	respCh, exists := s.pendingRequests[msg.ReqID]
+	s.pendingMu.RUnlock()
+
+	if !exists {
+		return
+	}
+	// The channel is buffered and only the first response counts, so a handler that has already
+	// timed out never blocks the read loop.
+	select {
+	case respCh <- msg:
+	default:
+	}
+}
+
+func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) { //nolint: cyclop
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/webhook/"), "/")
+	channelID := parts[0]
+
+	s.channelsMu.RLock()
+	ch, exists := s.channels[channelID]
+	s.channelsMu.RUnlock()
+
+	if exists {
+		ch.inflight.Add(1)
+		defer ch.inflight.Add(-1)
+	}
+	// The channel of a draining server is served by the peer its client has moved to.
+	if (!exists || (ch.migrating.Load() && s.movedToPeer(channelID))) && s.forwardToPeer(w, r, channelID) {
+		return
+	}
+	if !exists || !ch.isActive() {
+		s.recordNotConnected(r, ch, channelID)
+		http.Error(w, "Client not connected", http.StatusNotFound)
+		return
+	}
+	policy := ch.policy.Load()
+	ch.stats.request()
+
+	// Blocked callers must never reach the tunnel.
+	if !s.isAllowedSource(r, policy.allowlist) {
+		ch.stats.blocked.Add(1)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Do not tunnel requests while the client is asking to hold off.
+	if holdOff := ch.overloaded(); holdOff > 0 {
+		writeOverloaded(w, holdOff)
+		return
+	}
+
+	if err := normalizeToHTTP1(r); err != nil {
+		http.Error(w, "Error reading request", http.StatusBadRequest)
+		return
+	}
+
+	var webhookReq *webhookRequest
+	if policy.filter != nil || policy.dedup != nil {
+		var err error
+		if webhookReq, err = newWebhookRequest(r, channelID); err != nil {
+			http.Error(w, "Error reading request", http.StatusBadRequest)
+			return
+		}
+	}
+	// Unwanted events never reach the tunnel.
+	if policy.filter != nil {
+		if rule := policy.filter.rejects(webhookReq); rule != nil {
+			ch.stats.filtered.Add(1)
+			logFiltered(r, channelID, rule)
+			policy.filter.write(w)
+			return
+		}
+	}
+
+	// Replay the response of the first delivery to duplicates instead of tunneling them again.
+	var cached *cachedResponse
+	if policy.dedup != nil {
+		id, entry, replayed := s.deduplicate(w, webhookReq, channelID, policy.dedup)
+		if replayed {
+			return
+		}
+		if entry != nil {
+			defer func() { policy.dedup.finish(id, entry, cached) }()
+		}
+	}
+
+	// Convert HTTP requests directly into raw byte sequences (equivalent to TCP dumps)
+	rawReqBytes, err := httputil.DumpRequest(r, true)
+	if err != nil {
+		http.Error(w, "Error dumping request", http.StatusInternalServerError)
+		return
+	}
+
+	respMsg, err := s.roundTrip(r.Context(), ch, rawReqBytes)
+	switch {
+	case errors.Is(err, errSendFailed):
+		s.recordFailure(r, ch, channelID, DeadLetterSendFailed, http.StatusBadGateway, err)
+		http.Error(w, "Failed to send to client", http.StatusBadGateway)
+		return
+	case errors.Is(err, errWebhookTimeout):
+		s.recordFailure(r, ch, channelID, DeadLetterTimeout, http.StatusGatewayTimeout, err)
+		http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+		return
+	case errors.Is(err, errEncryptFailed):
+		http.Error(w, "Failed to encrypt request", http.StatusInternalServerError)
+		return
+	case err != nil:
+		// The webhook sender has gone away.
+		return
+	}
+	if respMsg.Type == messageTypeOverloaded {
+		retryAfter := time.Duration(max(respMsg.RetryAfter, 1)) * time.Second
+		ch.setOverloaded(retryAfter)
+		slog.Warn("Client is overloaded", slog.String("channel-id", channelID), slog.String("req-id", respMsg.ReqID))
+		writeOverloaded(w, retryAfter)
+		return
+	}
+	// Restore the raw byte array to an http.Response object
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respMsg.Payload)), r)
+	if err != nil {
+		http.Error(w, "Bad gateway response from client", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close() //nolint: errcheck,errchkjson
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, "Bad gateway response from client", http.StatusBadGateway)
+		return
+	}
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = w.Write(body) //nolint: errcheck
+	// Failed deliveries are not remembered, so that the sender's retry reaches the client again.
+	if resp.StatusCode < http.StatusInternalServerError {
+		cached = &cachedResponse{status: resp.StatusCode, header: resp.Header.Clone(), body: body}
+	} else {
+		s.recordFailure(r, ch, channelID, DeadLetterUpstreamError, resp.StatusCode, nil)
+	}
+}
+
+// roundTrip tunnels rawReq to the client of ch and waits for its reply, which may be an overloaded message.
+func (s *Server) roundTrip(ctx context.Context, ch *channel, rawReq []byte) (TunnelMessage, error) {
+	reqID := uuid.New().String()
+	respCh := make(chan TunnelMessage, 1)
+
+	s.pendingMu.Lock()
+	s.pendingRequests[reqID] = respCh
+	s.pendingMu.Unlock()
+
+	defer func() {
+		s.pendingMu.Lock()
+		delete(s.pendingRequests, reqID)
+		s.pendingMu.Unlock()
+	}()
+
+	msg := TunnelMessage{ReqID: reqID, Payload: rawReq}
+	if ch.publicKey != nil {
+		sealed, err := e2e.Seal(ch.publicKey, rawReq)
+		if err != nil {
+			return TunnelMessage{}, fmt.Errorf("%w: %w", errEncryptFailed, err)
+		}
+		// Do not keep the plaintext around longer than necessary.
+		clear(rawReq)
+		msg.Payload = sealed
+		msg.Encrypted = true
+	}
+	slog.Debug(
+		"Tunneling webhook request",
+		slog.String("req-id", reqID),
+		slog.Int("size", len(msg.Payload)),
+		slog.Bool("encrypted", msg.Encrypted),
+	)
+	if err := ch.send(msg); err != nil {
+		return TunnelMessage{}, fmt.Errorf("%w: %w", errSendFailed, err)
+	}
+
+	// Waiting for a response from the client
+	select {
+	case respMsg := <-respCh:
+		return respMsg, nil
+	case <-time.After(s.webhookTimeout):
+		return TunnelMessage{}, errWebhookTimeout
+	case <-ctx.Done():
+		return TunnelMessage{}, ctx.Err()
+	}
+}
+
+// recordNotConnected stores r, sent to a channel without a client, as a dead letter. Channel IDs that are not
+// known here, e.g. guessed ones, are not recorded, so that they cannot evict the dead letters of real channels.
+// Blocked callers are not recorded either.
+func (s *Server) recordNotConnected(r *http.Request, ch *channel, channelID string) {
+	if ch != nil {
+		if s.isAllowedSource(r, ch.policy.Load().allowlist) {
+			s.recordFailure(r, ch, channelID, DeadLetterClientNotConnected, http.StatusNotFound, nil)
+		}
+		return
+	}
+	s.channelsMu.RLock()
+	closed := s.closedChannels[channelID]
+	s.channelsMu.RUnlock()
+	if closed == nil || closed.encrypted || !s.isAllowedSource(r, closed.allowlist) {
+		return
+	}
+	s.recordDeadLetter(r, nil, channelID, DeadLetterClientNotConnected, http.StatusNotFound, nil)
+}
+
+// recordFailure counts a delivery error of the channel and stores r as a dead letter.
+func (s *Server) recordFailure(r *http.Request, ch *channel, channelID, reason string, status int, cause error) {
+	if ch != nil {
+		ch.stats.failure(reason, status, cause)
+	}
+	s.recordDeadLetter(r, ch, channelID, reason, status, cause)
+}
+
+// recordDeadLetter stores r as undelivered. Requests of end-to-end encrypted channels are never stored,
+// since the server must not keep their plaintext. ch is nil for a closed channel that was not encrypted.
+func (s *Server) recordDeadLetter(r *http.Request, ch *channel, channelID, reason string, status int, cause error) {
+	if s.deadLetters == nil || (ch != nil && ch.publicKey != nil) {
+		return
+	}
+	dl, err := newDeadLetter(r, channelID, reason, status, cause)
+	if err == nil {
+		err = s.deadLetters.Add(dl)
+	}
+	if err != nil {
+		slog.Warn("Failed to record dead letter", slog.String("channel-id", channelID), slog.String("error", err.Error()))
+		return
+	}
+	slog.Warn(
+		"Webhook recorded as dead letter",
+		slog.String("channel-id", channelID),
+		slog.String("dead-letter-id", dl.ID),
+		slog.String("reason", reason),
+		slog.Int("status", status),
+	)
+}
+
+// Redeliver tunnels the dead letter id to channelID, or to its original channel when channelID is empty,
+// and returns the status of the client's response. The dead letter is deleted once it has been delivered.
+func (s *Server) Redeliver(ctx context.Context, id, channelID string) (int, error) {
+	if s.deadLetters == nil {
+		return 0, ErrDeadLetterNotFound
+	}
+	dl, err := s.deadLetters.Get(id)
+	if err != nil {
+		return 0, err
+	}
+	if channelID == "" {
+		channelID = dl.ChannelID
+	}
+	s.channelsMu.RLock()
+	ch, exists := s.channels[channelID]
+	s.channelsMu.RUnlock()
+	var status int
+	if exists && ch.isActive() {
+		ch.inflight.Add(1)
+		status, err = s.redeliver(ctx, ch, dl, channelID)
+		ch.inflight.Add(-1)
+	} else if peerURL, ok := s.channelOwner(channelID); ok && s.requiresPeerAuth() {
+		status, err = s.redeliverToPeer(ctx, peerURL, dl, channelID)
+	} else {
+		err = fmt.Errorf("%w: %s", ErrClientNotConnected, channelID)
+	}
+	if errors.Is(err, ErrClientNotConnected) {
+		return 0, err
+	}
+	if err == nil {
+		slog.Info("Dead letter redelivered", slog.String("dead-letter-id", id), slog.String("channel-id", channelID))
+		return status, s.deadLetters.Delete(id)
+	}
+	dl.Attempts++
+	dl.Status = status
+	dl.Error = err.Error()
+	dl.UpdatedAt = time.Now()
+	if err := s.deadLetters.Update(dl); err != nil && !errors.Is(err, ErrDeadLetterNotFound) {
+		return status, err
+	}
+	return status, fmt.Errorf("%w: %w", ErrRedeliveryFailed, err)
+}
+
+// redeliverToPeer has the peer that holds channelID deliver dl, as the dead letter store stays on this server.
+func (s *Server) redeliverToPeer(ctx context.Context, peerURL string, dl *DeadLetter, channelID string) (int, error) {
+	body, err := json.Marshal(dl)
+	if err != nil {
+		return 0, err
+	}
+	// The peer waits for the client, so the usual brief peer timeout does not apply.
+	ctx, cancel := context.WithTimeout(ctx, s.webhookTimeout+s.peerClient.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peerURL+"/admin/channels/"+url.PathEscape(channelID)+"/deliver?scope="+scopeLocal, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := *s.peerClient
+	client.Timeout = 0
+	resp, err := client.Do(req)
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	defer resp.Body.Close() //nolint: errcheck
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, fmt.Errorf("%w: %s", ErrClientNotConnected, channelID)
+	}
+	var result RedeliveryResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return http.StatusBadGateway, fmt.Errorf("peer responded with %s", resp.Status)
+	}
+	if result.Error != "" {
+		return result.Status, errors.New(result.Error)
+	}
+	return result.Status, nil
+}
+
+func (s *Server) redeliver(ctx context.Context, ch *channel, dl *DeadLetter, channelID string) (int, error) {
+	rawReq, err := dl.dump(channelID)
+	if err != nil {
+		return 0, err
+	}
+	respMsg, err := s.roundTrip(ctx, ch, rawReq)
+	switch {
+	case errors.Is(err, errSendFailed):
+		return http.StatusBadGateway, err
+	case errors.Is(err, errWebhookTimeout):
+		return http.StatusGatewayTimeout, err
+	case err != nil:
+		return 0, err
+	}
+	if respMsg.Type == messageTypeOverloaded {
+		ch.setOverloaded(time.Duration(max(respMsg.RetryAfter, 1)) * time.Second)
+		return http.StatusServiceUnavailable, errClientOverloaded
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respMsg.Payload)), nil)
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	_ = resp.Body.Close() //nolint: errcheck
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return resp.StatusCode, fmt.Errorf("client responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// deduplicate replays the cached response when r is a duplicate, waiting for the first delivery if it is
+// still in flight. Otherwise it returns the entry the caller must finish as the first delivery,
+// which is nil when r carries no idempotency key.
+func (s *Server) deduplicate(w http.ResponseWriter, r *webhookRequest, channelID string, dedup *dedupCache) (string, *dedupEntry, bool) {
+	id := dedup.key.extract(r)
+	if id == "" {
+		return "", nil, false
+	}
+	timeout := time.After(s.webhookTimeout)
+	for {
+		entry, first := dedup.begin(id)
+		if first {
+			return id, entry, false
+		}
+		select {
+		case <-entry.done:
+		case <-timeout:
+			http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+			return "", nil, true
+		}
+		if entry.resp != nil {
+			slog.Info(
+				"Replaying the response to a duplicate webhook",
+				slog.String("channel-id", channelID),
+				slog.String("dedup-key", dedup.key.String()),
+				slog.String("idempotency-key", id),
+			)
+			entry.resp.write(w)
+			return "", nil, true
+		}
+		// The first delivery failed; try to deliver this one instead.
+	}
+}
+
+// writeOverloaded returns 503 with Retry-After so that the webhook sender retries later instead of timing out.
+func writeOverloaded(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "Client is overloaded", http.StatusServiceUnavailable)
+}
+
+// normalizeToHTTP1 rewrites an HTTP/2 request so that its dump is a valid HTTP/1.1 request for the client.
+// HTTP/2 bodies may arrive without Content-Length, so the body is buffered to set it explicitly.
+func normalizeToHTTP1(r *http.Request) error {
+	if r.ProtoMajor == 1 {
+		return nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	_ = r.Body.Close() //nolint: errcheck
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/1.1", 1, 1
+	return nil
+}
+
+func (s *Server) isAllowedSource(r *http.Request, allowlist *ipfilter.Allowlist) bool {
+	if allowlist.IsEmpty() {
+		return true
+	}
+	clientIP, err := s.clientIP(r)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Failed to resolve client ip", slog.String("error", err.Error()))
+		return false
+	}
+	if !allowlist.Allowed(clientIP) {
+		slog.WarnContext(r.Context(), "Webhook blocked by ip allowlist", slog.String("client-ip", clientIP.String()))
+		return false
+	}
+	return true
+}
+
+func (s *Server) cleanNonActiveSession(gracePeriod time.Duration) {
+	s.channelsMu.RLock() // 【修正】並行アクセス(panic)を防ぐため RLock を追加
+	nonActiveSession := make([]string, 0, len(s.channels))
+	for id, ch := range s.channels {
+		if dedup := ch.policy.Load().dedup; dedup != nil {
+			dedup.sweep()
+		}
+		// Channels issued just now are still waiting for their client to connect.
+		if !ch.isActive() && time.Since(ch.idleSince()) >= gracePeriod {
+			nonActiveSession = append(nonActiveSession, id)
+		}
+	}
+	s.channelsMu.RUnlock() // 読み取り完了後にロック解除
+	s.channelsMu.Lock()
+	for _, id := range nonActiveSession {
+		if ch, ok := s.channels[id]; ok {
+			s.closeChannelLocked(id, ch)
+		}
+	}
+	for id, closed := range s.closedChannels {
+		if time.Since(closed.closedAt) >= closedChannelTTL {
+			delete(s.closedChannels, id)
+		}
+	}
+	s.channelsMu.Unlock()
+	for _, id := range nonActiveSession {
+		s.retractChannel(id)
+	}
+}
+
+// closeChannelLocked deletes the channel and remembers it as closed. channelsMu must be held.
+func (s *Server) closeChannelLocked(channelID string, ch *channel) {
+	delete(s.channels, channelID)
+	s.closedChannels[channelID] = &closedChannel{
+		allowlist: ch.policy.Load().allowlist,
+		encrypted: ch.publicKey != nil,
+		closedAt:  time.Now(),
+	}
+}
+
+// announceChannel shares with the cluster that this server holds the channel.
+func (s *Server) announceChannel(channelID string, connected bool) {
+	if s.mlist != nil {
+		s.mlist.SetChannel(channelID, connected)
+	}
+}
+
+// retractChannel shares with the cluster that this server no longer holds the channel.
+func (s *Server) retractChannel(channelID string) {
+	if s.mlist != nil {
+		s.mlist.RemoveChannel(channelID)
+	}
+}
@@ -0,0 +1,135 @@
+package tunnel
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/nonchan7720/webhook-over-websocket/pkg/cluster"
+	"github.com/nonchan7720/webhook-over-websocket/pkg/expr"
+	"github.com/nonchan7720/webhook-over-websocket/pkg/ipfilter"
+)
+
+type ServerOption interface {
+	apply(s *Server)
+}
+
+type serverOptionFn func(s *Server)
+
+func (fn serverOptionFn) apply(s *Server) {
+	fn(s)
+}
+
+// WithServerURL sets the URL under which this server is reachable by Traefik and cluster peers.
+func WithServerURL(serverURL string) ServerOption {
+	return serverOptionFn(func(s *Server) {
+		s.serverURL = serverURL
+	})
+}
+
+// WithVersion sets the version reported by the admin API.
+func WithVersion(version string) ServerOption {
+	return serverOptionFn(func(s *Server) {
+		s.version = version
+	})
+}
+
+// WithCluster shares channel information with the peers found by memberlist.
+// peerClient is used for requests to the peers' internal endpoints.
+func WithCluster(mlist *cluster.Memberlist, peerScheme string, peerPort int, peerClient *http.Client) ServerOption {
+	return serverOptionFn(func(s *Server) {
+		s.mlist = mlist
+		s.peerScheme = peerScheme
+		s.peerPort = peerPort
+		if peerClient != nil {
+			s.peerClient = peerClient
+		}
+	})
+}
+
+// WithClusterSecret authenticates the requests between peers with a secret shared by the cluster.
+// Peers are otherwise recognized by their address.
+func WithClusterSecret(secret string) ServerOption {
+	return serverOptionFn(func(s *Server) {
+		s.clusterSecret = secret
+	})
+}
+
+// WithPeerIdentities requires the requests between peers to carry a verified client certificate with one of identities.
+func WithPeerIdentities(identities ...string) ServerOption {
+	return serverOptionFn(func(s *Server) {
+		s.peerIdentities = identities
+	})
+}
+
+// WithSeparateInternalEndpoints serves /traefik-config and /internal/channels only from InternalHandler.
+func WithSeparateInternalEndpoints(separate bool) ServerOption {
+	return serverOptionFn(func(s *Server) {
+		s.separateInternal = separate
+	})
+}
+
+// WithIPAllowlist sets the presets available to channel allowlists and the default allowlist
+// applied to channels that do not set their own.
+func WithIPAllowlist(presets ipfilter.Presets, defaultEntries []string) ServerOption {
+	return serverOptionFn(func(s *Server) {
+		s.ipPresets = presets
+		s.defaultAllowlist = defaultEntries
+	})
+}
+
+func WithClientIPResolver(resolver *ipfilter.ClientIPResolver) ServerOption {
+	return serverOptionFn(func(s *Server) {
+		s.ipResolver = resolver
+	})
+}
+
+// WithRequireClientCert requires a verified client certificate on /new and /ws.
+func WithRequireClientCert(require bool) ServerOption {
+	return serverOptionFn(func(s *Server) {
+		s.requireClientCert = require
+	})
+}
+
+// WithWebhookTimeout sets how long a webhook waits for the client's response.
+func WithWebhookTimeout(timeout time.Duration) ServerOption {
+	return serverOptionFn(func(s *Server) {
+		s.webhookTimeout = timeout
+	})
+}
+
+// WithDefaultDedup deduplicates webhooks by key for ttl on channels that do not set their own dedup key.
+// A nil key disables deduplication by default.
+func WithDefaultDedup(key *DedupKey, ttl time.Duration) ServerOption {
+	return serverOptionFn(func(s *Server) {
+		s.dedupKey = key
+		s.dedupTTL = ttl
+	})
+}
+
+// WithDefaultFilter applies rules and expressions to channels that do not set their own filter, and answers filtered webhooks
+// with status and body unless the channel sets its own. A zero status keeps the default 202 Accepted.
+func WithDefaultFilter(rules []*FilterRule, exprs []*expr.Program, status int, body string) ServerOption {
+	return serverOptionFn(func(s *Server) {
+		s.filterRules = rules
+		s.filterExprs = exprs
+		if status != 0 {
+			s.filterStatus = status
+		}
+		s.filterBody = body
+	})
+}
+
+// WithDeadLetters records webhooks that could not be delivered to the client in store.
+func WithDeadLetters(store DeadLetterStore) ServerOption {
+	return serverOptionFn(func(s *Server) {
+		s.deadLetters = store
+	})
+}
+
+// WithAdminToken serves the /admin API to requests that carry the token as a bearer token.
+// The API is disabled when token is empty.
+func WithAdminToken(token string) ServerOption {
+	return serverOptionFn(func(s *Server) {
+		s.adminToken = token
+	})
+}
@@ -0,0 +1,141 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"text/template"
+)
+
+// Transform rewrites a tunneled request or the local response before it is passed on.
+// Headers are removed first, then set and added.
+type Transform struct {
+	Headers HeaderRules `yaml:"headers"`
+	// Host replaces the Host header of the request. It is ignored for responses.
+	Host string `yaml:"host"`
+	// Body is a text/template that replaces the body. See transformData for the available fields.
+	Body string `yaml:"body"`
+
+	body *template.Template
+}
+
+// HeaderRules are declarative header modifications.
+type HeaderRules struct {
+	Add    map[string]string `yaml:"add"`
+	Set    map[string]string `yaml:"set"`
+	Remove []string          `yaml:"remove"`
+}
+
+// transformData is passed to body templates.
+// JSON holds the decoded body when it is valid JSON, otherwise nil.
+type transformData struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Header     http.Header
+	Body       string
+	JSON       any
+}
+
+var transformFuncs = template.FuncMap{
+	"toJSON": func(v any) (string, error) {
+		buf, err := json.Marshal(v)
+		return string(buf), err
+	},
+}
+
+func (t *Transform) compile(name string) error {
+	if t == nil || t.Body == "" {
+		return nil
+	}
+	tmpl, err := template.New(name).Funcs(transformFuncs).Option("missingkey=zero").Parse(t.Body)
+	if err != nil {
+		return fmt.Errorf("invalid body template: %w", err)
+	}
+	t.body = tmpl
+	return nil
+}
+
+func (r HeaderRules) apply(header http.Header) {
+	for _, key := range r.Remove {
+		header.Del(key)
+	}
+	for key, value := range r.Set {
+		header.Set(key, value)
+	}
+	for key, value := range r.Add {
+		header.Add(key, value)
+	}
+}
+
+// applyRequest rewrites req in place.
+func (t *Transform) applyRequest(req *http.Request) error {
+	if t == nil {
+		return nil
+	}
+	t.Headers.apply(req.Header)
+	if t.Host != "" {
+		req.Host = t.Host
+	}
+	if t.body == nil {
+		return nil
+	}
+	body, err := t.render(req.Body, transformData{Method: req.Method, Path: req.URL.Path, Header: req.Header})
+	if err != nil {
+		return err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// applyResponse rewrites resp in place.
+func (t *Transform) applyResponse(resp *http.Response) error {
+	if t == nil {
+		return nil
+	}
+	t.Headers.apply(resp.Header)
+	if t.body == nil {
+		return nil
+	}
+	data := transformData{StatusCode: resp.StatusCode, Header: resp.Header}
+	if resp.Request != nil {
+		data.Method = resp.Request.Method
+		data.Path = resp.Request.URL.Path
+	}
+	body, err := t.render(resp.Body, data)
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// render consumes and closes body and executes the body template against it.
+func (t *Transform) render(body io.ReadCloser, data transformData) ([]byte, error) {
+	if body != nil {
+		raw, err := io.ReadAll(body)
+		_ = body.Close() //nolint: errcheck
+		if err != nil {
+			return nil, err
+		}
+		data.Body = string(raw)
+		var v any
+		if json.Unmarshal(raw, &v) == nil {
+			data.JSON = v
+		}
+	}
+	var buf bytes.Buffer
+	if err := t.body.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to render body template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,1119 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/nonchan7720/webhook-over-websocket/pkg/cluster"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTunnel runs a Server and a Client connected to it, and returns the webhook URL of the issued channel.
+func startTunnel(t *testing.T, serverOpts []ServerOption, clientOpts ...ClientOption) string {
+	t.Helper()
+	server := httptest.NewServer(NewServer(serverOpts...))
+	t.Cleanup(server.Close)
+
+	webhookURLCh := make(chan string, 1)
+	var channelID string
+	clientOpts = append(clientOpts, WithOnChannel(func(id, webhookURL string) {
+		channelID = id
+		webhookURLCh <- webhookURL
+	}))
+	client, err := NewClient(server.URL, clientOpts...)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	errCh := make(chan error, 1)
+	go func() { errCh <- client.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-errCh
+	})
+
+	var webhookURL string
+	select {
+	case webhookURL = <-webhookURLCh:
+	case err := <-errCh:
+		t.Fatalf("client stopped: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel was not issued")
+	}
+	// Wait until the WebSocket is connected and the webhook endpoint accepts requests.
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(server.URL + "/internal/channels")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		var info InternalChannelsResp
+		if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+			return false
+		}
+		return slices.Contains(info.WebhookChannels, channelID)
+	}, 5*time.Second, 20*time.Millisecond)
+	return webhookURL
+}
+
+func TestTunnel_ForwardToTarget(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Path", r.URL.Path)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(target.Close)
+
+	webhookURL := startTunnel(t, nil, WithTargetURL(target.URL))
+
+	resp, err := http.Post(webhookURL+"/github/events", "application/json", strings.NewReader(`{"action":"opened"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, `{"action":"opened"}`, string(body))
+	assert.True(t, strings.HasSuffix(resp.Header.Get("X-Path"), "/github/events"), "The path suffix should be preserved.")
+}
+
+func TestTunnel_E2EEncryption(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	}))
+	t.Cleanup(target.Close)
+
+	webhookURL := startTunnel(t, nil, WithTargetURL(target.URL), WithE2EEncryption(true))
+
+	resp, err := http.Post(webhookURL, "text/plain", strings.NewReader("secret"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "secret", string(body))
+}
+
+func TestServer_IndependentInstances(t *testing.T) {
+	a := httptest.NewServer(NewServer())
+	t.Cleanup(a.Close)
+	b := httptest.NewServer(NewServer())
+	t.Cleanup(b.Close)
+
+	resp, err := http.Get(a.URL + "/new")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	resp, err = http.Get(b.URL + "/internal/channels")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Contains(t, string(body), `"ws_channels":null`, "Channels issued by one server should not leak into another.")
+}
+
+func TestTunnel_Handler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /webhook/{channel}/hooks/github", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Event", r.Header.Get("X-GitHub-Event"))
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write(body)
+	})
+	mux.HandleFunc("/webhook/{channel}/panic", func(http.ResponseWriter, *http.Request) {
+		panic("boom")
+	})
+
+	webhookURL := startTunnel(t, nil, WithHandler(mux))
+
+	req, _ := http.NewRequest(http.MethodPost, webhookURL+"/hooks/github", strings.NewReader(`{"zen":"ok"}`))
+	req.Header.Set("X-GitHub-Event", "ping")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, "ping", resp.Header.Get("X-Event"))
+	assert.Equal(t, `{"zen":"ok"}`, string(body))
+
+	resp, err = http.Get(webhookURL + "/panic")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode, "A panicking handler should result in 502.")
+}
+
+func TestTunnel_Routes(t *testing.T) {
+	newTarget := func(name string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Target", name)
+			w.Header().Set("X-Path", r.URL.Path)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	fallback, github, stripe := newTarget("fallback"), newTarget("github"), newTarget("stripe")
+
+	webhookURL := startTunnel(t, nil,
+		WithTargetURL(fallback.URL),
+		WithRoutes(
+			Route{Name: "github", PathPrefix: "/github", Headers: map[string]string{"X-GitHub-Event": "push"}, Target: github.URL, StripPrefix: true},
+			Route{Name: "stripe", PathPrefix: "/stripe", Target: stripe.URL + "/hooks"},
+			Route{Name: "draft", When: `body.draft == true`, Target: github.URL},
+		),
+	)
+
+	tests := []struct {
+		path, event, body, target, targetPath string
+	}{
+		{path: "/github/events", event: "push", target: "github", targetPath: "/events"},
+		{path: "/github/events", event: "ping", target: "fallback"},
+		{path: "/stripe/charge", target: "stripe", targetPath: "/hooks/stripe/charge"},
+		{path: "/other", body: `{"draft":true}`, target: "github", targetPath: "/other"},
+	}
+	for _, tt := range tests {
+		body := tt.body
+		if body == "" {
+			body = "{}"
+		}
+		req, _ := http.NewRequest(http.MethodPost, webhookURL+tt.path, strings.NewReader(body))
+		req.Header.Set("X-GitHub-Event", tt.event)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, tt.target, resp.Header.Get("X-Target"), "The request to %s should be routed to %s.", tt.path, tt.target)
+		if tt.targetPath != "" {
+			assert.Equal(t, tt.targetPath, resp.Header.Get("X-Path"))
+		}
+	}
+}
+
+func TestTunnel_Transform(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Auth", r.Header.Get("Authorization"))
+		w.Header().Set("X-Forwarded", r.Header.Get("X-Forwarded-For"))
+		w.Header().Set("X-Host", r.Host)
+		w.Header().Set("X-Internal", "secret")
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(target.Close)
+
+	webhookURL := startTunnel(t, nil, WithRoutes(Route{
+		Target: target.URL,
+		Request: &Transform{
+			Headers: HeaderRules{
+				Set:    map[string]string{"Authorization": "Bearer local"},
+				Remove: []string{"X-Forwarded-For"},
+			},
+			Host: "app.local",
+			Body: `{"event":{{toJSON .JSON.action}},"method":"{{.Method}}"}`,
+		},
+		Response: &Transform{
+			Headers: HeaderRules{Remove: []string{"X-Internal"}},
+			Body:    `{{.StatusCode}}:{{.Body}}`,
+		},
+	}))
+
+	req, _ := http.NewRequest(http.MethodPost, webhookURL, strings.NewReader(`{"action":"opened"}`))
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	assert.Equal(t, "Bearer local", resp.Header.Get("X-Auth"))
+	assert.Empty(t, resp.Header.Get("X-Forwarded"), "X-Forwarded-For should be removed.")
+	assert.Equal(t, "app.local", resp.Header.Get("X-Host"))
+	assert.Empty(t, resp.Header.Get("X-Internal"), "Response headers should be removed.")
+	assert.Equal(t, `200:{"event":"opened","method":"POST"}`, string(body))
+}
+
+func TestTunnel_FallbackAndRedeliver(t *testing.T) {
+	// Reserve an address the target will listen on later.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	webhookURL := startTunnel(t, nil,
+		WithTargetURL("http://"+addr),
+		WithFallback(Fallback{
+			Status:            http.StatusAccepted,
+			Headers:           map[string]string{"Content-Type": "application/json"},
+			Body:              `{"queued":true}`,
+			SpoolDir:          t.TempDir(),
+			RedeliverInterval: 50 * time.Millisecond,
+		}),
+	)
+
+	resp, err := http.Post(webhookURL+"/events", "application/json", strings.NewReader(`{"id":1}`))
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode, "The fallback status should be returned while the target is down.")
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `{"queued":true}`, string(body))
+
+	received := make(chan string, 1)
+	l, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	target.Listener = l
+	target.Start()
+	t.Cleanup(target.Close)
+
+	select {
+	case got := <-received:
+		assert.Equal(t, `{"id":1}`, got, "The spooled request should be redelivered once the target is reachable.")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the spooled request was not redelivered")
+	}
+}
+
+func TestTunnel_Retry(t *testing.T) {
+	var attempts atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if attempts.Add(1)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(target.Close)
+
+	webhookURL := startTunnel(t, nil,
+		WithTargetURL(target.URL),
+		WithRoutes(Route{PathPrefix: "/safe", Target: target.URL, Idempotent: true}),
+		WithRetry(RetryPolicy{MaxAttempts: 3, StatusCodes: []int{http.StatusServiceUnavailable}, InitialInterval: time.Millisecond}),
+	)
+
+	resp, err := http.Post(webhookURL+"/safe", "text/plain", strings.NewReader("payload"))
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "payload", string(body), "The body should be resent on every attempt.")
+	assert.EqualValues(t, 3, attempts.Load())
+
+	resp, err = http.Post(webhookURL+"/unsafe", "text/plain", strings.NewReader("payload"))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.EqualValues(t, 4, attempts.Load(), "POST outside idempotent routes should not be retried.")
+}
+
+func TestTunnel_RetryDeadline(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	t.Cleanup(target.Close)
+
+	webhookURL := startTunnel(t, nil,
+		WithTargetURL(target.URL),
+		WithRetry(RetryPolicy{MaxAttempts: 3, MaxElapsedTime: 200 * time.Millisecond}),
+	)
+
+	start := time.Now()
+	resp, err := http.Get(webhookURL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.NotEqual(t, http.StatusOK, resp.StatusCode)
+	assert.Less(t, time.Since(start), 2*time.Second, "An attempt should not outlive the max elapsed time.")
+}
+
+func TestClient_RetryLastResponse(t *testing.T) {
+	// Larger than the buffer of the connection, so that the body is not read along with the header.
+	busy := strings.Repeat("busy", 16<<10)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(busy))
+	}))
+	t.Cleanup(target.Close)
+	client, err := NewClient("http://localhost", WithTargetURL(target.URL), WithRetry(RetryPolicy{
+		MaxAttempts:     2,
+		StatusCodes:     []int{http.StatusServiceUnavailable},
+		InitialInterval: 10 * time.Millisecond,
+		MaxElapsedTime:  time.Second,
+	}))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, target.URL, nil)
+	resp, err := client.doLocalWithRetry(ctx, "test", req, nil)
+	require.NoError(t, err)
+	// The response is read after the context has ended, as it is when the max elapsed time runs out during the attempts.
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	require.NoError(t, err, "The last answer of the target should stay readable.")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, busy, string(body))
+}
+
+func TestTunnel_Overloaded(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}))
+	t.Cleanup(target.Close)
+
+	webhookURL := startTunnel(t, nil, WithTargetURL(target.URL), WithMaxInFlight(1, 0))
+
+	firstDone := make(chan struct{})
+	go func() {
+		defer close(firstDone)
+		resp, err := http.Post(webhookURL, "text/plain", strings.NewReader("first"))
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	<-entered
+	defer func() {
+		close(release)
+		<-firstDone
+	}()
+
+	resp, err := http.Post(webhookURL, "text/plain", strings.NewReader("second"))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "Requests beyond the limit should be rejected.")
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+}
+
+func TestTunnel_Dedup(t *testing.T) {
+	var calls atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		if r.Header.Get("X-Fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Call", strconv.Itoa(int(n)))
+	}))
+	t.Cleanup(target.Close)
+
+	webhookURL := startTunnel(t, nil, WithTargetURL(target.URL), WithDedup("json:event.id", time.Minute))
+
+	send := func(body string, fail bool) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, webhookURL, strings.NewReader(body))
+		if fail {
+			req.Header.Set("X-Fail", "1")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	first := send(`{"event":{"id":"evt_1"}}`, false)
+	duplicate := send(`{"event":{"id":"evt_1"}}`, false)
+	assert.Equal(t, "1", first.Header.Get("X-Call"))
+	assert.Equal(t, "1", duplicate.Header.Get("X-Call"), "A duplicate should get the response of the first delivery.")
+	assert.Equal(t, "true", duplicate.Header.Get(duplicateHeader))
+	assert.EqualValues(t, 1, calls.Load(), "A duplicate should not go over the tunnel.")
+
+	send(`{"event":{"id":"evt_2"}}`, true)
+	retried := send(`{"event":{"id":"evt_2"}}`, false)
+	assert.Equal(t, "3", retried.Header.Get("X-Call"), "A retry of a failed delivery should go over the tunnel again.")
+}
+
+func TestTunnel_Filter(t *testing.T) {
+	var calls atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	t.Cleanup(target.Close)
+
+	webhookURL := startTunnel(t, nil,
+		WithTargetURL(target.URL),
+		WithFilter("header:X-GitHub-Event=push|pull_request"),
+		WithFilterExpr(`!has(body.action) || body.action != "deleted"`),
+		WithFilterResponse(http.StatusNoContent, ""),
+	)
+
+	tests := []struct {
+		event, body string
+		status      int
+	}{
+		{event: "push", body: `{}`, status: http.StatusOK},
+		{event: "pull_request", body: `{"action":"opened"}`, status: http.StatusOK},
+		{event: "check_run", body: `{}`, status: http.StatusNoContent},
+		{event: "pull_request", body: `{"action":"deleted"}`, status: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodPost, webhookURL, strings.NewReader(tt.body))
+		req.Header.Set("X-GitHub-Event", tt.event)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, tt.status, resp.StatusCode, "event=%s body=%s", tt.event, tt.body)
+	}
+	assert.EqualValues(t, 2, calls.Load(), "Filtered webhooks should not go over the tunnel.")
+}
+
+func TestTunnel_DeadLetters(t *testing.T) {
+	var healthy atomic.Bool
+	var received atomic.Value
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received.Store(r.URL.Path + " " + string(body))
+	}))
+	t.Cleanup(target.Close)
+
+	store := NewMemoryDeadLetterStore(10)
+	webhookURL := startTunnel(t, []ServerOption{WithDeadLetters(store), WithAdminToken("secret")}, WithTargetURL(target.URL))
+	serverURL, _, _ := strings.Cut(webhookURL, "/webhook/")
+
+	resp, err := http.Post(webhookURL+"/events?x=1", "application/json", strings.NewReader(`{"id":1}`))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	admin := func(method, path string) *http.Response {
+		req, _ := http.NewRequest(method, serverURL+path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+
+	unauthorized, err := http.Get(serverURL + "/admin/deadletters")
+	require.NoError(t, err)
+	_ = unauthorized.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, unauthorized.StatusCode, "The admin API should require the token.")
+
+	var list []*DeadLetter
+	require.NoError(t, json.NewDecoder(admin(http.MethodGet, "/admin/deadletters").Body).Decode(&list))
+	require.Len(t, list, 1)
+	assert.Equal(t, DeadLetterUpstreamError, list[0].Reason)
+	assert.Equal(t, "/events", list[0].Path)
+	assert.Empty(t, list[0].Body, "The list should not carry the bodies.")
+
+	healthy.Store(true)
+	redelivered := admin(http.MethodPost, "/admin/deadletters/"+list[0].ID+"/redeliver")
+	assert.Equal(t, http.StatusOK, redelivered.StatusCode)
+	assert.True(t, strings.HasSuffix(received.Load().(string), `/events {"id":1}`), "The dead letter should reach the target as it was sent.")
+
+	_, err = store.Get(list[0].ID)
+	assert.ErrorIs(t, err, ErrDeadLetterNotFound, "A redelivered dead letter should be removed.")
+	assert.Equal(t, http.StatusNotFound, admin(http.MethodPost, "/admin/deadletters/"+list[0].ID+"/redeliver").StatusCode)
+}
+
+func TestTunnel_DeadLettersAfterDisconnect(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	t.Cleanup(target.Close)
+	store := NewMemoryDeadLetterStore(10)
+	tunnelServer := NewServer(WithDeadLetters(store))
+	server := httptest.NewServer(tunnelServer)
+	t.Cleanup(server.Close)
+
+	connect := func(opts ...ClientOption) string {
+		channelIDCh := make(chan string, 1)
+		opts = append(opts, WithTargetURL(target.URL), WithOnChannel(func(id, _ string) { channelIDCh <- id }))
+		client, err := NewClient(server.URL, opts...)
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(t.Context())
+		errCh := make(chan error, 1)
+		go func() { errCh <- client.Run(ctx) }()
+		var channelID string
+		select {
+		case channelID = <-channelIDCh:
+		case <-time.After(5 * time.Second):
+			t.Fatal("channel was not issued")
+		}
+		require.Eventually(t, func() bool {
+			tunnelServer.channelsMu.RLock()
+			defer tunnelServer.channelsMu.RUnlock()
+			ch, ok := tunnelServer.channels[channelID]
+			return ok && ch.isActive()
+		}, 5*time.Second, 10*time.Millisecond)
+		cancel()
+		<-errCh
+		require.Eventually(t, func() bool {
+			tunnelServer.channelsMu.RLock()
+			defer tunnelServer.channelsMu.RUnlock()
+			_, ok := tunnelServer.channels[channelID]
+			return !ok
+		}, 5*time.Second, 10*time.Millisecond)
+		return channelID
+	}
+	post := func(channelID string) {
+		resp, err := http.Post(server.URL+"/webhook/"+channelID, "text/plain", strings.NewReader("secret"))
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+
+	plain := connect()
+	encrypted := connect(WithE2EEncryption(true))
+	post(plain)
+	post(encrypted)
+	post("never-issued")
+
+	list, err := store.List("")
+	require.NoError(t, err)
+	require.Len(t, list, 1, "Only the webhook of the plain channel should be recorded.")
+	assert.Equal(t, plain, list[0].ChannelID)
+	assert.Equal(t, DeadLetterClientNotConnected, list[0].Reason)
+}
+
+func TestTunnel_AdminChannels(t *testing.T) {
+	var failing atomic.Bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(target.Close)
+
+	webhookURL := startTunnel(t, []ServerOption{WithAdminToken("secret")}, WithTargetURL(target.URL))
+	serverURL, channelID, _ := strings.Cut(webhookURL, "/webhook/")
+
+	admin := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, serverURL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+	post := func() int {
+		req, _ := http.NewRequest(http.MethodPost, webhookURL, strings.NewReader(`{}`))
+		req.Header.Set("X-Event", "push")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	channelInfo := func() ChannelInfo {
+		var info ChannelInfo
+		require.NoError(t, json.NewDecoder(admin(http.MethodGet, "/admin/channels/"+channelID, "").Body).Decode(&info))
+		return info
+	}
+
+	assert.Equal(t, http.StatusOK, post())
+	failing.Store(true)
+	assert.Equal(t, http.StatusServiceUnavailable, post())
+
+	var list []ChannelInfo
+	require.NoError(t, json.NewDecoder(admin(http.MethodGet, "/admin/channels", "").Body).Decode(&list))
+	require.Len(t, list, 1)
+	assert.Equal(t, channelID, list[0].ID)
+	assert.True(t, list[0].Connected)
+	assert.EqualValues(t, 2, list[0].Requests)
+	assert.EqualValues(t, 1, list[0].Failures)
+	assert.Empty(t, list[0].RecentErrors, "The list should not carry the recent errors.")
+
+	info := channelInfo()
+	require.Len(t, info.RecentErrors, 1)
+	assert.Equal(t, DeadLetterUpstreamError, info.RecentErrors[0].Reason)
+	assert.Equal(t, http.StatusServiceUnavailable, info.RecentErrors[0].Status)
+
+	updated := admin(http.MethodPatch, "/admin/channels/"+channelID+"/policy", `{"filter":["header:X-Event=release"],"filter_status":204}`)
+	require.Equal(t, http.StatusOK, updated.StatusCode)
+	assert.Equal(t, http.StatusNoContent, post(), "The updated filter should apply to the next webhook.")
+	assert.Equal(t, []string{"header:X-Event=release"}, channelInfo().Policy.Filter)
+	assert.EqualValues(t, 1, channelInfo().Filtered)
+
+	invalid := admin(http.MethodPatch, "/admin/channels/"+channelID+"/policy", `{"allow":["not-an-ip"]}`)
+	assert.Equal(t, http.StatusBadRequest, invalid.StatusCode)
+
+	var statuses []NodeStatus
+	require.NoError(t, json.NewDecoder(admin(http.MethodGet, "/admin/status", "").Body).Decode(&statuses))
+	require.Len(t, statuses, 1)
+	assert.Equal(t, 1, statuses[0].ConnectedChannels)
+
+	assert.Equal(t, http.StatusNoContent, admin(http.MethodPost, "/admin/channels/"+channelID+"/disconnect", "").StatusCode)
+	require.Eventually(t, func() bool { return !channelInfo().Connected }, 5*time.Second, 20*time.Millisecond,
+		"A disconnected channel should be kept for the client to reconnect.")
+
+	assert.Equal(t, http.StatusNoContent, admin(http.MethodDelete, "/admin/channels/"+channelID, "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, admin(http.MethodGet, "/admin/channels/"+channelID, "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, post())
+}
+
+func TestTunnel_RevokeConnectedChannel(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	t.Cleanup(target.Close)
+	store := NewMemoryDeadLetterStore(10)
+	tunnelServer := NewServer(WithDeadLetters(store), WithAdminToken("secret"))
+	server := httptest.NewServer(tunnelServer)
+	t.Cleanup(server.Close)
+
+	channelIDCh := make(chan string, 1)
+	client, err := NewClient(server.URL, WithTargetURL(target.URL), WithOnChannel(func(id, _ string) { channelIDCh <- id }))
+	require.NoError(t, err)
+	errCh := make(chan error, 1)
+	go func() { errCh <- client.Run(t.Context()) }()
+	var channelID string
+	select {
+	case channelID = <-channelIDCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel was not issued")
+	}
+	post := func() int {
+		resp, err := http.Post(server.URL+"/webhook/"+channelID, "application/json", strings.NewReader(`{}`))
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Eventually(t, func() bool {
+		tunnelServer.channelsMu.RLock()
+		defer tunnelServer.channelsMu.RUnlock()
+		ch, ok := tunnelServer.channels[channelID]
+		return ok && ch.isActive()
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, http.StatusOK, post())
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/admin/channels/"+channelID, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	select {
+	case <-errCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client was not disconnected")
+	}
+	// Give the server time to clean up after the closed connection.
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, http.StatusNotFound, post())
+	list, err := store.List("")
+	require.NoError(t, err)
+	assert.Empty(t, list, "Webhooks sent to a revoked channel should not be recorded.")
+}
+
+// startClusterServer runs a Server that is a member of a memberlist cluster on localhost,
+// and returns it with its memberlist and memberlist port.
+func startClusterServer(t *testing.T, name string, opts ...ServerOption) (*httptest.Server, *cluster.Memberlist, int) {
+	t.Helper()
+	server := httptest.NewUnstartedServer(nil)
+	serverURL := "http://" + server.Listener.Addr().String()
+	config := memberlist.DefaultLocalConfig()
+	config.Name = name
+	config.BindAddr = "127.0.0.1"
+	config.BindPort = 0
+	config.LogOutput = io.Discard
+	member, err := cluster.New(config, serverURL)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = member.Shutdown() })
+	opts = append(opts, WithServerURL(serverURL), WithCluster(member, "http", 0, nil))
+	server.Config.Handler = NewServer(opts...)
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, member, config.BindPort
+}
+
+func TestTunnel_ForwardToOwner(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get(forwardedByHeader) + "|" + r.Header.Get(forwardedClientIPHeader) + "|" + r.Header.Get(clusterSecretHeader)))
+	}))
+	t.Cleanup(target.Close)
+
+	// Two servers of one cluster behind a round-robin load balancer that knows nothing about channels.
+	a, memberA, portA := startClusterServer(t, "a", WithClusterSecret("cluster-secret"))
+	b, memberB, _ := startClusterServer(t, "b", WithClusterSecret("cluster-secret"))
+	_, err := memberB.Join([]string{"127.0.0.1:" + strconv.Itoa(portA)})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(memberA.ActiveNodes()) == 2 && len(memberB.ActiveNodes()) == 2
+	}, 5*time.Second, 20*time.Millisecond)
+	var next atomic.Int64
+	var backends []*httputil.ReverseProxy
+	for _, s := range []*httptest.Server{a, b} {
+		u, err := url.Parse(s.URL)
+		require.NoError(t, err)
+		backends = append(backends, httputil.NewSingleHostReverseProxy(u))
+	}
+	lb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backends[next.Add(1)%2].ServeHTTP(w, r)
+	}))
+	t.Cleanup(lb.Close)
+
+	webhookURLCh := make(chan string, 1)
+	var channelID string
+	client, err := NewClient(lb.URL, WithTargetURL(target.URL), WithOnChannel(func(id, webhookURL string) {
+		channelID = id
+		webhookURLCh <- webhookURL
+	}))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(t.Context())
+	errCh := make(chan error, 1)
+	go func() { errCh <- client.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-errCh
+	})
+	var webhookURL string
+	select {
+	case webhookURL = <-webhookURLCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel was not issued")
+	}
+
+	// Wait until the other server has learned from the gossip that the client is connected.
+	require.Eventually(t, func() bool {
+		for _, m := range []*cluster.Memberlist{memberA, memberB} {
+			if c, ok := m.PeerChannel(channelID); ok && c.Connected {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// Every webhook reaches the client, whichever server receives it, and the client sees no forwarding headers.
+	for range 4 {
+		resp, err := http.Post(webhookURL, "application/json", strings.NewReader(`{}`))
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "||", string(body))
+	}
+
+	// Forwarding headers from outside the cluster are ignored.
+	outside := NewServer()
+	req := httptest.NewRequest(http.MethodPost, "/webhook/x", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set(forwardedByHeader, "http://192.0.2.1")
+	req.Header.Set(forwardedClientIPHeader, "10.0.0.1")
+	req = outside.acceptPeer(req)
+	assert.Nil(t, forwardedFrom(req))
+	assert.Empty(t, req.Header.Get(forwardedClientIPHeader))
+}
+
+func TestTunnel_Drain(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/slow") {
+			time.Sleep(300 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(target.Close)
+
+	a, memberA, portA := startClusterServer(t, "a")
+	b, memberB, _ := startClusterServer(t, "b")
+	_, err := memberB.Join([]string{"127.0.0.1:" + strconv.Itoa(portA)})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(memberA.ActiveNodes()) == 2 && len(memberB.ActiveNodes()) == 2
+	}, 5*time.Second, 20*time.Millisecond)
+	var next atomic.Int64
+	var backends []*httputil.ReverseProxy
+	for _, s := range []*httptest.Server{a, b} {
+		u, err := url.Parse(s.URL)
+		require.NoError(t, err)
+		backends = append(backends, httputil.NewSingleHostReverseProxy(u))
+	}
+	lb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backends[next.Add(1)%2].ServeHTTP(w, r)
+	}))
+	t.Cleanup(lb.Close)
+
+	channelIDCh := make(chan string, 1)
+	client, err := NewClient(lb.URL, WithTargetURL(target.URL), WithOnChannel(func(id, _ string) {
+		channelIDCh <- id
+	}))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(t.Context())
+	errCh := make(chan error, 1)
+	go func() { errCh <- client.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-errCh
+	})
+	var channelID string
+	select {
+	case channelID = <-channelIDCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel was not issued")
+	}
+	require.Eventually(t, func() bool {
+		for _, m := range []*cluster.Memberlist{memberA, memberB} {
+			if c, ok := m.PeerChannel(channelID); ok && c.Connected {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 20*time.Millisecond)
+	// The server that holds the channel is drained, and the client moves to the other one.
+	owner, other := a, b
+	if _, ok := memberA.PeerChannel(channelID); ok {
+		owner, other = b, a
+	}
+	drained := owner.Config.Handler.(*Server) //nolint: forcetypeassert
+
+	// A webhook in flight when the drain starts completes.
+	slow := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(owner.URL+"/webhook/"+channelID+"/slow", "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			slow <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		slow <- resp.StatusCode
+	}()
+	require.Eventually(t, func() bool {
+		drained.channelsMu.RLock()
+		defer drained.channelsMu.RUnlock()
+		return drained.channels[channelID].inflight.Load() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	drainCtx, cancelDrain := context.WithTimeout(t.Context(), 10*time.Second)
+	defer cancelDrain()
+	drained.Drain(drainCtx)
+	require.NoError(t, drainCtx.Err(), "The client should move before the drain timeout.")
+	assert.Equal(t, http.StatusOK, <-slow)
+
+	resp, err := http.Get(owner.URL + "/healthz")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	resp, err = http.Get(owner.URL + "/new")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "A draining server should not issue channels.")
+
+	// The channel keeps its id on the other server.
+	resp, err = http.Post(other.URL+"/webhook/"+channelID, "application/json", strings.NewReader(`{}`))
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ok", string(body))
+	select {
+	case err := <-errCh:
+		t.Fatalf("client stopped: %v", err)
+	default:
+	}
+}
+
+func TestTunnel_ClusterStatus(t *testing.T) {
+	a, memberA, portA := startClusterServer(t, "a", WithAdminToken("secret"), WithClusterSecret("cluster-secret"))
+	b, memberB, _ := startClusterServer(t, "b", WithAdminToken("secret"), WithClusterSecret("cluster-secret"))
+	_, err := memberB.Join([]string{"127.0.0.1:" + strconv.Itoa(portA)})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(memberA.ActiveNodes()) == 2 && len(memberB.ActiveNodes()) == 2
+	}, 5*time.Second, 20*time.Millisecond)
+
+	clusterStatus := func() ClusterStatus {
+		req, _ := http.NewRequest(http.MethodGet, a.URL+"/cluster/status", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close() //nolint: errcheck
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var status ClusterStatus
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+		return status
+	}
+
+	status := clusterStatus()
+	assert.Equal(t, "a", status.Node)
+	assert.Empty(t, status.Issues)
+	assert.Empty(t, status.Channels, "The channels of a node are only sent to its peers.")
+	require.Len(t, status.Members, 2)
+	for _, m := range status.Members {
+		assert.Equal(t, "alive", m.State)
+		assert.NotZero(t, m.Incarnation)
+		if m.Name == "b" {
+			assert.NotNil(t, m.LastSync, "The join should have synced the channel maps.")
+		}
+	}
+
+	// Both servers issued the same channel, as they would have while partitioned.
+	for _, s := range []*httptest.Server{a, b} {
+		server := s.Config.Handler.(*Server) //nolint: forcetypeassert
+		server.channelsMu.Lock()
+		server.channels["split"] = &channel{createdAt: time.Now()}
+		server.channelsMu.Unlock()
+	}
+	status = clusterStatus()
+	require.Len(t, status.Issues, 1)
+	assert.Equal(t, IssueChannelConflict, status.Issues[0].Kind)
+	assert.Equal(t, "split", status.Issues[0].Channel)
+	assert.Equal(t, []string{"a", "b"}, status.Issues[0].Nodes)
+}
+
+func TestTunnel_ClusterDeadLetters(t *testing.T) {
+	received := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r.URL.Path + " " + string(body)
+	}))
+	t.Cleanup(target.Close)
+
+	storeA, storeB := NewMemoryDeadLetterStore(10), NewMemoryDeadLetterStore(10)
+	a, memberA, portA := startClusterServer(t, "a", WithAdminToken("secret"), WithClusterSecret("cluster-secret"), WithDeadLetters(storeA))
+	b, memberB, _ := startClusterServer(t, "b", WithAdminToken("secret"), WithClusterSecret("cluster-secret"), WithDeadLetters(storeB))
+	_, err := memberB.Join([]string{"127.0.0.1:" + strconv.Itoa(portA)})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(memberA.ActiveNodes()) == 2 && len(memberB.ActiveNodes()) == 2
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// The client is connected to b only.
+	channelIDCh := make(chan string, 1)
+	client, err := NewClient(b.URL, WithTargetURL(target.URL), WithOnChannel(func(id, _ string) { channelIDCh <- id }))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(t.Context())
+	errCh := make(chan error, 1)
+	go func() { errCh <- client.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-errCh
+	})
+	var channelID string
+	select {
+	case channelID = <-channelIDCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel was not issued")
+	}
+	require.Eventually(t, func() bool {
+		c, ok := memberA.PeerChannel(channelID)
+		return ok && c.Connected
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// Each server keeps the dead letters of the webhooks it received.
+	now := time.Now()
+	onA := &DeadLetter{ID: "on-a", ChannelID: "gone", Reason: DeadLetterClientNotConnected, Method: http.MethodPost, Path: "/events", Body: []byte(`{"id":1}`), CreatedAt: now}
+	onB := &DeadLetter{ID: "on-b", ChannelID: "gone", Reason: DeadLetterClientNotConnected, Method: http.MethodPost, Path: "/", CreatedAt: now.Add(time.Second)}
+	require.NoError(t, storeA.Add(onA))
+	require.NoError(t, storeB.Add(onB))
+
+	admin := func(method, path string) *http.Response {
+		req, _ := http.NewRequest(method, a.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+
+	var list []*DeadLetter
+	require.NoError(t, json.NewDecoder(admin(http.MethodGet, "/admin/deadletters").Body).Decode(&list))
+	require.Len(t, list, 2, "The list should have the dead letters of every server.")
+	assert.Equal(t, "on-a", list[0].ID)
+	assert.Equal(t, "on-b", list[1].ID)
+	require.NoError(t, json.NewDecoder(admin(http.MethodGet, "/admin/deadletters?scope=local").Body).Decode(&list))
+	assert.Len(t, list, 1)
+
+	var dl DeadLetter
+	require.NoError(t, json.NewDecoder(admin(http.MethodGet, "/admin/deadletters/on-b").Body).Decode(&dl))
+	assert.Equal(t, "on-b", dl.ID, "A dead letter of a peer should be found through it.")
+
+	// The dead letter stays on a while the channel is on b.
+	redelivered := admin(http.MethodPost, "/admin/deadletters/on-a/redeliver?to="+url.QueryEscape(channelID))
+	assert.Equal(t, http.StatusOK, redelivered.StatusCode)
+	select {
+	case got := <-received:
+		assert.True(t, strings.HasSuffix(got, `/events {"id":1}`), "The dead letter should reach the target as it was sent.")
+	case <-time.After(5 * time.Second):
+		t.Fatal("dead letter was not redelivered")
+	}
+	_, err = storeA.Get("on-a")
+	assert.ErrorIs(t, err, ErrDeadLetterNotFound, "A redelivered dead letter should be removed.")
+
+	redelivered = admin(http.MethodPost, "/admin/deadletters/on-b/redeliver?to=unknown")
+	assert.Equal(t, http.StatusNotFound, redelivered.StatusCode, "A channel that no server holds cannot be redelivered to.")
+	_, err = storeB.Get("on-b")
+	assert.NoError(t, err)
+}
+
+func TestServer_AdminPeerCalls(t *testing.T) {
+	var header http.Header
+	peer := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) { header = r.Header.Clone() }))
+	t.Cleanup(peer.Close)
+	server := NewServer(WithAdminToken("secret"), WithClusterSecret("cluster-secret"))
+
+	r := httptest.NewRequest(http.MethodGet, "/admin/channels", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	resp, err := server.callPeer(r, peer.URL, nil)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Empty(t, header.Get("Authorization"), "The admin token must not be sent to peers.")
+	assert.Equal(t, "cluster-secret", header.Get(clusterSecretHeader))
+
+	get := func(path, secret string) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if secret != "" {
+			r.Header.Set(clusterSecretHeader, secret)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, get("/admin/channels?scope=local", "cluster-secret"))
+	assert.Equal(t, http.StatusUnauthorized, get("/admin/channels", "cluster-secret"), "Peers may only ask for the channels of the server.")
+	assert.Equal(t, http.StatusUnauthorized, get("/admin/channels?scope=local", "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, get("/admin/channels?scope=local", ""))
+}
+
+func TestServer_ClusterSecret(t *testing.T) {
+	server := NewServer(WithClusterSecret("cluster-secret"), WithSeparateInternalEndpoints(true))
+	public := httptest.NewServer(server)
+	t.Cleanup(public.Close)
+	internal := httptest.NewServer(server.InternalHandler())
+	t.Cleanup(internal.Close)
+
+	get := func(url, secret string) int {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		if secret != "" {
+			req.Header.Set(clusterSecretHeader, secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusNotFound, get(public.URL+"/internal/channels", "cluster-secret"), "Internal endpoints should not be public.")
+	assert.Equal(t, http.StatusForbidden, get(internal.URL+"/internal/channels", ""))
+	assert.Equal(t, http.StatusForbidden, get(internal.URL+"/traefik-config", "wrong"))
+	assert.Equal(t, http.StatusOK, get(internal.URL+"/internal/channels", "cluster-secret"))
+	assert.Equal(t, http.StatusOK, get(internal.URL+"/traefik-config", "cluster-secret"))
+
+	// A forged client address is ignored without the secret, even from a peer address.
+	req := httptest.NewRequest(http.MethodPost, "/webhook/x", nil)
+	req.Header.Set(forwardedByHeader, "http://192.0.2.1")
+	req.Header.Set(forwardedClientIPHeader, "10.0.0.1")
+	assert.Nil(t, forwardedFrom(server.acceptPeer(req)))
+	req = httptest.NewRequest(http.MethodPost, "/webhook/x", nil)
+	req.Header.Set(clusterSecretHeader, "cluster-secret")
+	req.Header.Set(forwardedByHeader, "http://192.0.2.1")
+	req.Header.Set(forwardedClientIPHeader, "10.0.0.1")
+	req = server.acceptPeer(req)
+	require.NotNil(t, forwardedFrom(req))
+	assert.Equal(t, "10.0.0.1", forwardedFrom(req).clientIP.String())
+	assert.Empty(t, req.Header.Get(clusterSecretHeader), "The secret must not be tunneled to the client.")
+}